@@ -15,6 +15,8 @@ func newCommandFetch() *cobra.Command {
 		cfgFile         string
 		startTime       string
 		endTime         string
+		format          string
+		filterExpr      string
 		extendedSchemas bool
 	)
 
@@ -35,6 +37,13 @@ func newCommandFetch() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if err := validateFormat(format); err != nil {
+				return err
+			}
+			recordFilter, err := compileFilter(filterExpr)
+			if err != nil {
+				return err
+			}
 
 			config, err := initConfig(cfgFile)
 			if err != nil {
@@ -66,7 +75,20 @@ func newCommandFetch() *cobra.Command {
 
 			// output
 			for _, a := range auditList {
-				auditStr, err := json.Marshal(a)
+				if recordFilter != nil {
+					match, err := recordFilter.Match(a)
+					if err != nil {
+						return err
+					}
+					if !match {
+						continue
+					}
+				}
+				record, err := formatRecord(format, a)
+				if err != nil {
+					return err
+				}
+				auditStr, err := json.Marshal(record)
 				if err != nil {
 					return err
 				}
@@ -78,6 +100,8 @@ func newCommandFetch() *cobra.Command {
 	cmd.Flags().StringVar(&cfgFile, "config", "", "Set configfile alternate location. Defaults are [$HOME/.go-office365.yaml, $CWD/.go-office365.yaml].")
 	cmd.Flags().StringVar(&startTime, "start", "", "Start time.")
 	cmd.Flags().StringVar(&endTime, "end", "", "End time.")
+	cmd.Flags().StringVar(&format, "format", formatJSON, formatsDescription)
+	cmd.Flags().StringVar(&filterExpr, "filter", "", filterDescription)
 	cmd.Flags().BoolVar(&extendedSchemas, "extended-schemas", false, "Set whether to add extended schemas to the output of the record or not.")
 	cmd.Flags().SortFlags = false
 	return cmd
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/filter"
+	"github.com/devodev/go-office365/v0/pkg/office365/ocsf"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -27,8 +30,31 @@ Here are some guidelines on how time args are validated:
 - Start and end time interval must be between 1 minute and 24 hours.
 - Start time must not be earlier than 7 days behind the current time.
 - Time format must match one of: %v`, strings.Join(timeFormats, ", "))
+
+	formatJSON         = "json"
+	formatOCSF         = "ocsf"
+	outputFormats      = []string{formatJSON, formatOCSF}
+	formatsDescription = fmt.Sprintf("Set records output format. Available formats: %s", strings.Join(outputFormats, ", "))
+	filterDescription  = `Only output records matching the provided expression, for example: RecordType == "ExchangeAdmin" && Operation in ["New-InboxRule", "Set-Mailbox"]. Fields are named after the JSON output, nested fields are selected using dots. Operators: ==, !=, <, <=, >, >=, in, not in, contains, matches, !, &&, ||`
+)
+
+// Exit codes.
+const (
+	exitError           = 1
+	exitWindowsFailed   = 2
+	exitNoSubscriptions = 3
 )
 
+// codeError is returned by commands that must exit with a specific code.
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+
+func (e *codeError) Unwrap() error { return e.err }
+
 // Execute executes the root command.
 func Execute() error {
 	rootCmd := newCommandRoot()
@@ -53,6 +79,7 @@ func newCommandRoot() *cobra.Command {
 		newCommandGenDoc(),
 		newCommandListSub(),
 		newCommandStartSub(),
+		newCommandState(),
 		newCommandStopSub(),
 		newCommandWatch(),
 	)
@@ -100,6 +127,38 @@ type Config struct {
 		Identifier string
 	}
 	Credentials office365.Credentials
+	// Webhook is used when starting subscriptions, if provided.
+	Webhook *office365.Webhook
+	// Watch provides settings of the watch command.
+	Watch WatchConfig
+}
+
+// formatRecord converts a record into the provided output format.
+func formatRecord(format string, record interface{}) (interface{}, error) {
+	switch format {
+	case formatJSON:
+		return record, nil
+	case formatOCSF:
+		return ocsf.Map(record)
+	}
+	return nil, fmt.Errorf("format invalid")
+}
+
+// compileFilter returns the filter of the provided expression, or nil when it is empty.
+func compileFilter(expr string) (*filter.Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	return filter.Compile(expr)
+}
+
+func validateFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("format invalid")
 }
 
 func parseDate(param string) time.Time {
@@ -115,6 +174,12 @@ func parseDate(param string) time.Time {
 func main() {
 	if err := Execute(); err != nil {
 		writeOut(err.Error())
-		os.Exit(1)
+
+		code := exitError
+		var codeErr *codeError
+		if errors.As(err, &codeErr) {
+			code = codeErr.code
+		}
+		os.Exit(code)
 	}
 }
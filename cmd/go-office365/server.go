@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/prommetrics"
+	"github.com/sirupsen/logrus"
+)
+
+// serverShutdownTimeout is how long in-flight requests are given to complete
+// when the server is shut down.
+var serverShutdownTimeout = 5 * time.Second
+
+// startServer listens on the provided address and serves handler in the background,
+// until ctx is done.
+func startServer(ctx context.Context, addr string, handler http.Handler, logger *logrus.Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %s", addr, err)
+	}
+	server := &http.Server{Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("server: could not shut down: %s", err)
+		}
+	}()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("server: %s", err)
+		}
+	}()
+	logger.Infof("server: listening on %s", l.Addr().String())
+	return nil
+}
+
+// servers maps listen addresses to the handlers served on them,
+// so that endpoints sharing an address are served by a single server.
+type servers map[string]*http.ServeMux
+
+// handle registers handler for pattern on the server listening on addr.
+func (s servers) handle(addr, pattern string, handler http.Handler) {
+	if s[addr] == nil {
+		s[addr] = http.NewServeMux()
+	}
+	s[addr].Handle(pattern, handler)
+}
+
+// start starts every server until ctx is done.
+func (s servers) start(ctx context.Context, logger *logrus.Logger) error {
+	for addr, mux := range s {
+		if err := startServer(ctx, addr, mux, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusHandlers returns the handlers reporting the status of the watcher.
+// The watcher is healthy when every pipeline completed a cycle within
+// the provided number of intervals of the watcher, the longest one when it is adaptive.
+// The handlers are registered once the configuration is loaded, so readiness
+// only depends on a token being obtained and subscriptions being listed.
+func statusHandlers(watcher *office365.SubscriptionWatcher, intervals int) map[string]http.Handler {
+	withStatus := func(fn func(http.ResponseWriter, *office365.WatcherStatus)) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, err := watcher.Status(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fn(w, status)
+		})
+	}
+	return map[string]http.Handler{
+		"/healthz": withStatus(func(w http.ResponseWriter, status *office365.WatcherStatus) {
+			// the interval can change when the configuration is reloaded
+			maxAge := time.Duration(intervals) * watcher.Config().MaxPollInterval()
+			if err := status.Healthy(time.Now(), maxAge); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		}),
+		"/readyz": withStatus(func(w http.ResponseWriter, status *office365.WatcherStatus) {
+			if !status.Ready() {
+				http.Error(w, "not ready", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		}),
+		"/status": withStatus(func(w http.ResponseWriter, status *office365.WatcherStatus) {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "\t")
+			enc.Encode(status)
+		}),
+	}
+}
+
+// metricsWriter counts the errors returned by the wrapped writer.
+type metricsWriter struct {
+	io.Writer
+	metrics *prommetrics.Metrics
+}
+
+func (w metricsWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.metrics.HandlerWriteError()
+	}
+	return n, err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var checkpointsDescription = fmt.Sprintf("Available checkpoints: %s", strings.Join(checkpointNames(), ", "))
+
+func checkpointNames() []string {
+	var names []string
+	for _, c := range office365.GetCheckpoints() {
+		names = append(names, string(c))
+	}
+	return names
+}
+
+func newCommandState() *cobra.Command {
+	var (
+		stateLocation string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Show, edit or reset the state used by the watch command.",
+		Long: fmt.Sprintf(`Show, edit or reset the state used by the watch command,
+or report the gaps recorded by it.
+The state must not be in use by a running watch command.
+%s`, checkpointsDescription),
+	}
+	cmd.PersistentFlags().StringVar(&stateLocation, "state", "", "Set state location. Available schemes: file://path/to/statefile.json, bolt://path/to/state.db. A path without scheme is a JSON statefile.")
+
+	cmd.AddCommand(
+		newCommandStateShow(&stateLocation),
+		newCommandStateSet(&stateLocation),
+		newCommandStateReset(&stateLocation),
+		newCommandStateGaps(&stateLocation),
+	)
+	return cmd
+}
+
+func newCommandStateShow(stateLocation *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show [content-type]",
+		Short: "Show the checkpoints of every content type, or the provided one.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			contentTypes := sortedContentTypes()
+			if len(args) == 1 {
+				ct, err := getContentTypeArg(args[0])
+				if err != nil {
+					return err
+				}
+				contentTypes = []schema.ContentType{*ct}
+			}
+
+			return withStateReader(*stateLocation, func(ctx context.Context, editor office365.StateEditor) error {
+				result := make(map[string]stateSummary)
+				for _, ct := range contentTypes {
+					s, err := editor.ContentTypeState(ctx, ct)
+					if err != nil {
+						return err
+					}
+					result[ct.String()] = newStateSummary(s)
+				}
+				out, err := json.MarshalIndent(result, "", "\t")
+				if err != nil {
+					return err
+				}
+				writeOut(string(out))
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func newCommandStateSet(stateLocation *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set [content-type] [checkpoint] [time]",
+		Short: "Set a checkpoint of the provided content type, even if earlier than its current value.",
+		Long: fmt.Sprintf(`Set a checkpoint of the provided content type, even if earlier than its current value.
+%s
+Time format must match one of: %s`, checkpointsDescription, strings.Join(append(timeFormats, time.RFC3339), ", ")),
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ct, err := getContentTypeArg(args[0])
+			if err != nil {
+				return err
+			}
+			checkpoint, err := office365.GetCheckpoint(args[1])
+			if err != nil {
+				return err
+			}
+			t := parseDate(args[2])
+			if t.IsZero() {
+				t, err = time.Parse(time.RFC3339, args[2])
+				if err != nil {
+					return fmt.Errorf("time invalid")
+				}
+			}
+
+			return withStateEditor(*stateLocation, func(ctx context.Context, editor office365.StateEditor) error {
+				if err := editor.ReplaceCheckpoint(ctx, *ct, checkpoint, t); err != nil {
+					return err
+				}
+				writeOut(fmt.Sprintf("%s %s set to %s", ct.String(), checkpoint, t.Format(time.RFC3339)))
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func newCommandStateReset(stateLocation *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reset [content-type] [checkpoint]",
+		Short: "Reset the state of every content type, the provided one or one of its checkpoints.",
+		Long: fmt.Sprintf(`Reset the state of every content type, the provided one or one of its checkpoints.
+Resetting a content type also forgets the content already processed and its gaps.
+%s`, checkpointsDescription),
+		Args: cobra.MaximumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			contentTypes := sortedContentTypes()
+			if len(args) > 0 {
+				ct, err := getContentTypeArg(args[0])
+				if err != nil {
+					return err
+				}
+				contentTypes = []schema.ContentType{*ct}
+			}
+			var checkpoint office365.Checkpoint
+			if len(args) > 1 {
+				c, err := office365.GetCheckpoint(args[1])
+				if err != nil {
+					return err
+				}
+				checkpoint = c
+			}
+
+			return withStateEditor(*stateLocation, func(ctx context.Context, editor office365.StateEditor) error {
+				for _, ct := range contentTypes {
+					if checkpoint != "" {
+						if err := editor.ReplaceCheckpoint(ctx, ct, checkpoint, time.Time{}); err != nil {
+							return err
+						}
+						writeOut(fmt.Sprintf("%s %s reset", ct.String(), checkpoint))
+						continue
+					}
+					if err := editor.ResetContentType(ctx, ct); err != nil {
+						return err
+					}
+					writeOut(fmt.Sprintf("%s reset", ct.String()))
+				}
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func newCommandStateGaps(stateLocation *string) *cobra.Command {
+	var (
+		unrecoverable bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "gaps [content-type]",
+		Short: "Report the windows and content the watch command failed to fetch, for every content type or the provided one.",
+		Long: `Report the windows and content the watch command failed to fetch, for every content type or the provided one.
+Gaps are retried by the watch command until they expire, 7 days after the creation of their content.
+Gaps that expired before being fetched are reported as unrecoverable, their records are lost.
+Resetting a content type forgets its gaps.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			contentTypes := sortedContentTypes()
+			if len(args) == 1 {
+				ct, err := getContentTypeArg(args[0])
+				if err != nil {
+					return err
+				}
+				contentTypes = []schema.ContentType{*ct}
+			}
+
+			return withStateReader(*stateLocation, func(ctx context.Context, editor office365.StateEditor) error {
+				result := make(map[string][]office365.Gap)
+				for _, ct := range contentTypes {
+					s, err := editor.ContentTypeState(ctx, ct)
+					if err != nil {
+						return err
+					}
+					var gaps []office365.Gap
+					for _, g := range s.Gaps {
+						if unrecoverable && !g.Unrecoverable {
+							continue
+						}
+						gaps = append(gaps, g)
+					}
+					if len(gaps) == 0 {
+						continue
+					}
+					sort.Slice(gaps, func(i, j int) bool { return gaps[i].Key() < gaps[j].Key() })
+					result[ct.String()] = gaps
+				}
+				out, err := json.MarshalIndent(result, "", "\t")
+				if err != nil {
+					return err
+				}
+				writeOut(string(out))
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&unrecoverable, "unrecoverable", false, "Only report unrecoverable gaps.")
+	return cmd
+}
+
+// stateSummary is the representation of the state of a content type
+// shown by the state command.
+type stateSummary struct {
+	LastContentCreated *time.Time `json:"lastContentCreated,omitempty"`
+	LastRequestTime    *time.Time `json:"lastRequestTime,omitempty"`
+	BackfillProgress   *time.Time `json:"backfillProgress,omitempty"`
+	ProcessedContent   int        `json:"processedContent"`
+	Gaps               int        `json:"gaps"`
+	UnrecoverableGaps  int        `json:"unrecoverableGaps"`
+}
+
+func newStateSummary(s *office365.ContentTypeState) stateSummary {
+	nonZero := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	summary := stateSummary{
+		LastContentCreated: nonZero(s.LastContentCreated),
+		LastRequestTime:    nonZero(s.LastRequestTime),
+		BackfillProgress:   nonZero(s.BackfillProgress),
+		ProcessedContent:   len(s.ProcessedContent),
+		Gaps:               len(s.Gaps),
+	}
+	for _, g := range s.Gaps {
+		if g.Unrecoverable {
+			summary.UnrecoverableGaps++
+		}
+	}
+	return summary
+}
+
+func sortedContentTypes() []schema.ContentType {
+	contentTypes := schema.GetContentTypes()
+	sort.Slice(contentTypes, func(i, j int) bool { return contentTypes[i] < contentTypes[j] })
+	return contentTypes
+}
+
+func getContentTypeArg(arg string) (*schema.ContentType, error) {
+	if !schema.ContentTypeValid(arg) {
+		return nil, fmt.Errorf("ContentType invalid")
+	}
+	return schema.GetContentType(arg)
+}
+
+// withStateEditor opens the state located at stateLocation, calls fn
+// and releases the state, persisting the changes made by fn.
+func withStateEditor(stateLocation string, fn func(context.Context, office365.StateEditor) error) (err error) {
+	if stateLocation == "" {
+		return fmt.Errorf("state location must be provided")
+	}
+	logger := logrus.New()
+	logger.SetOutput(loggerOutput)
+	logger.SetLevel(logrus.WarnLevel)
+
+	ctx := context.Background()
+	state, closeState, err := setupState(ctx, stateLocation, 0, "", logger)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeState(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return callStateEditor(ctx, state, fn)
+}
+
+// withStateReader opens the existing state located at stateLocation
+// without writing to it, calls fn and releases the state.
+func withStateReader(stateLocation string, fn func(context.Context, office365.StateEditor) error) (err error) {
+	if stateLocation == "" {
+		return fmt.Errorf("state location must be provided")
+	}
+	state, closeState, err := openStateReadOnly(stateLocation)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeState(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return callStateEditor(context.Background(), state, fn)
+}
+
+func callStateEditor(ctx context.Context, state office365.State, fn func(context.Context, office365.StateEditor) error) error {
+	editor, ok := state.(office365.StateEditor)
+	if !ok {
+		return fmt.Errorf("state does not support editing")
+	}
+	return fn(ctx, editor)
+}
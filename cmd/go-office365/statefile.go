@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/internal/filelock"
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errInvalidStatefile = errors.New("statefile content empty or invalid, starting fresh")
+	errLockedStatefile  = errors.New("statefile is locked by another process")
+)
+
+// statefile persists a MemoryState on disk.
+// Writes are atomic: state is written to a temporary file which is
+// synced and then renamed over the statefile.
+// A lockfile prevents two processes from using the same statefile.
+type statefile struct {
+	mu    sync.Mutex
+	path  string
+	state *office365.MemoryState
+	lock  *os.File
+}
+
+// openStatefile locks the statefile located at fpath.
+func openStatefile(state *office365.MemoryState, fpath string) (*statefile, error) {
+	path, err := filepath.Abs(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute filepath for provided statefile: %s", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("could not open statefile lock: %s", err)
+	}
+	if err := filelock.Lock(lock); err != nil {
+		lock.Close()
+		return nil, errLockedStatefile
+	}
+	return &statefile{path: path, state: state, lock: lock}, nil
+}
+
+// readStatefile returns the state read from the existing statefile located at fpath,
+// without locking or writing it.
+func readStatefile(fpath string) (*office365.MemoryState, error) {
+	path, err := filepath.Abs(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute filepath for provided statefile: %s", err)
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("statefile does not exist: %s", path)
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	state := office365.NewMemoryState()
+	if err := state.Read(r); err != nil {
+		return nil, fmt.Errorf("could not read statefile: %s", err)
+	}
+	return state, nil
+}
+
+// Path returns the absolute path of the statefile.
+func (f *statefile) Path() string {
+	return f.path
+}
+
+// Read populates the state using the statefile content.
+// It returns errInvalidStatefile when the statefile is missing or invalid.
+// Statefiles using an unsupported format are reported as is, so that
+// they are not overwritten.
+func (f *statefile) Read() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, err := os.Open(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errInvalidStatefile
+		}
+		return err
+	}
+	defer r.Close()
+
+	if err := f.state.Read(r); err != nil {
+		if errors.Is(err, office365.ErrStateFormat) {
+			return err
+		}
+		return errInvalidStatefile
+	}
+	return nil
+}
+
+// Write atomically replaces the statefile with the current state.
+func (f *statefile) Write() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir := filepath.Dir(f.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// no-op once renamed
+	defer os.Remove(tmp.Name())
+
+	if err := f.state.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	return filelock.SyncDir(dir)
+}
+
+// Checkpoint writes the state at every interval until ctx is done.
+func (f *statefile) Checkpoint(ctx context.Context, interval time.Duration, logger *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Write(); err != nil {
+				logger.Errorf("could not write statefile: %s", err)
+				continue
+			}
+			logger.Debugf("statefile written: %s", f.path)
+		}
+	}
+}
+
+// Close writes the state one last time and releases the lock.
+func (f *statefile) Close() error {
+	err := f.Write()
+	f.Release()
+	return err
+}
+
+// Release releases the lock without writing the state.
+func (f *statefile) Release() {
+	filelock.Unlock(f.lock)
+	f.lock.Close()
+}
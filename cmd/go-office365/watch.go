@@ -9,31 +9,141 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/boltstate"
+	"github.com/devodev/go-office365/v0/pkg/office365/filter"
+	"github.com/devodev/go-office365/v0/pkg/office365/logadapter/logrusadapter"
+	"github.com/devodev/go-office365/v0/pkg/office365/ocsf"
+	"github.com/devodev/go-office365/v0/pkg/office365/prommetrics"
+	"github.com/devodev/go-office365/v0/pkg/office365/queue"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var (
-	errInvalidStatefile = errors.New("statefile content empty or invalid, starting fresh")
+// WatchConfig holds the settings of the watch command that can be provided
+// in the configfile. They are read again when the configfile is reloaded.
+// Flags provided on the command line take precedence.
+type WatchConfig struct {
+	ContentTypes []string
+	Interval     int
+	MinInterval  int
+	MaxInterval  int
+	LookBehind   int
+	Output       string
+	// Routes send the records they match to their own output.
+	// Records matching no route are sent to Output.
+	// They can only be provided in the configfile, and changes require a restart.
+	Routes []RouteConfig
+	// Sinks receive every record in addition to Output, each with its own buffer.
+	// They can only be provided in the configfile, and changes require a restart.
+	Sinks []SinkConfig
+}
+
+// RouteConfig holds the settings of a route of the watch command.
+// A record matches when it matches every non empty list, and the first route matched is used.
+// Format defaults to the format of the watch command.
+type RouteConfig struct {
+	Name         string
+	ContentTypes []string
+	RecordTypes  []string
+	Workloads    []string
+	Operations   []string
+	Output       string
+	Format       string
+}
+
+// SinkConfig holds the settings of a sink of the watch command.
+// Policy applies once the buffer of the sink is full: block waits for the sink,
+// drop discards its records and spill stores them in QueueDir until the sink catches up.
+// Name defaults to the output and Format to the format of the watch command.
+type SinkConfig struct {
+	Name         string
+	Output       string
+	Format       string
+	Buffer       int
+	Policy       string
+	QueueDir     string
+	QueueMaxSize int64
+}
+
+const (
+	sinkPolicyBlock = "block"
+	sinkPolicyDrop  = "drop"
+	sinkPolicySpill = "spill"
+
+	// defaultSinkBuffer is the number of records waiting for a sink before its policy applies.
+	defaultSinkBuffer = 1000
 )
 
+// mergeWatchConfig returns the settings provided as flags,
+// falling back to the ones of the configfile.
+func mergeWatchConfig(flags *pflag.FlagSet, flagValues, fileValues WatchConfig) WatchConfig {
+	result := flagValues
+	if !flags.Changed("content-types") && len(fileValues.ContentTypes) > 0 {
+		result.ContentTypes = fileValues.ContentTypes
+	}
+	if !flags.Changed("interval") && fileValues.Interval != 0 {
+		result.Interval = fileValues.Interval
+	}
+	if !flags.Changed("min-interval") && fileValues.MinInterval != 0 {
+		result.MinInterval = fileValues.MinInterval
+	}
+	if !flags.Changed("max-interval") && fileValues.MaxInterval != 0 {
+		result.MaxInterval = fileValues.MaxInterval
+	}
+	if !flags.Changed("lookbehind") && fileValues.LookBehind != 0 {
+		result.LookBehind = fileValues.LookBehind
+	}
+	if !flags.Changed("output") && fileValues.Output != "" {
+		result.Output = fileValues.Output
+	}
+	result.Routes = fileValues.Routes
+	result.Sinks = fileValues.Sinks
+	return result
+}
+
 func newCommandWatch() *cobra.Command {
 	var (
-		logFile   string
-		cfgFile   string
-		stateFile string
+		logFile       string
+		cfgFile       string
+		stateFile     string
+		stateInterval int
 
 		intervalSeconds   int
+		minInterval       int
+		maxInterval       int
 		lookBehindMinutes int
 		output            string
+		format            string
 		indent            bool
 		debug             bool
 		jsonLogging       bool
 		extendedSchemas   bool
+		contentTypes      []string
+		ensureSubs        bool
+		backfillFrom      string
+		backfillWorkers   int
+		rescanHorizon     int
+		rescanInterval    int
+		metricsListen     string
+		statusListen      string
+		healthIntervals   int
+		fetchConcurrency  int
+		ctConcurrency     map[string]int
+		queueDir          string
+		queueMaxSize      int64
+		queueSegmentSize  int64
+		shutdownTimeout   int
+		once              bool
+		filterExpr        string
 	)
 
 	cmd := &cobra.Command{
@@ -50,6 +160,27 @@ func newCommandWatch() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if err := validateFormat(format); err != nil {
+				return err
+			}
+			recordFilter, err := compileFilter(filterExpr)
+			if err != nil {
+				return err
+			}
+			var backfillFromTime time.Time
+			contentTypeFetchConcurrency, err := parseContentTypeValues(ctConcurrency)
+			if err != nil {
+				return err
+			}
+			if healthIntervals <= 0 {
+				return fmt.Errorf("health-intervals must be greater than 0")
+			}
+			if backfillFrom != "" {
+				backfillFromTime = parseDate(backfillFrom)
+				if backfillFromTime.IsZero() {
+					return fmt.Errorf("backfill-from invalid. Time format must match one of: %v", strings.Join(timeFormats, ", "))
+				}
+			}
 
 			// create cancelling context using signals
 			ctx, cancel := context.WithCancel(context.Background())
@@ -64,72 +195,337 @@ func newCommandWatch() *cobra.Command {
 				}
 			}()
 
-			// create state instance
-			state := office365.NewMemoryState()
-			if stateFile != "" {
-				statefileAbs, writeStateDefer, err := setupStatefile(state, stateFile)
+			// settings of the configfile apply unless provided as flags
+			flagSettings := WatchConfig{
+				ContentTypes: contentTypes,
+				Interval:     intervalSeconds,
+				MinInterval:  minInterval,
+				MaxInterval:  maxInterval,
+				LookBehind:   lookBehindMinutes,
+				Output:       output,
+			}
+			settings := mergeWatchConfig(cmd.Flags(), flagSettings, config.Watch)
+			watcherConfig := func(config *Config, settings WatchConfig) (office365.SubscriptionWatcherConfig, error) {
+				includeContentTypes, excludeContentTypes, err := parseContentTypes(settings.ContentTypes)
 				if err != nil {
-					if err != errInvalidStatefile {
-						return err
-					}
-					logger.Info(err)
+					return office365.SubscriptionWatcherConfig{}, err
 				}
-				defer writeStateDefer()
-				logger.Infof("using statefile: %s", statefileAbs)
+				return office365.SubscriptionWatcherConfig{
+					LookBehindMinutes:     settings.LookBehind,
+					TickerIntervalSeconds: settings.Interval,
+					AddExtendedSchemas:    extendedSchemas,
+					IncludeContentTypes:   includeContentTypes,
+					ExcludeContentTypes:   excludeContentTypes,
+					EnsureSubscriptions:   ensureSubs,
+					Webhook:               config.Webhook,
+					BackfillFrom:          backfillFromTime,
+					BackfillConcurrency:   backfillWorkers,
+					RescanHorizonMinutes:  rescanHorizon,
+					RescanIntervalSeconds: rescanInterval,
+
+					FetchConcurrency:            fetchConcurrency,
+					ContentTypeFetchConcurrency: contentTypeFetchConcurrency,
+					ShutdownTimeoutSeconds:      shutdownTimeout,
+					MinPollIntervalSeconds:      settings.MinInterval,
+					MaxPollIntervalSeconds:      settings.MaxInterval,
+				}, nil
+			}
+			watcherConf, err := watcherConfig(config, settings)
+			if err != nil {
+				return err
+			}
+
+			// create state instance
+			state, closeState, err := setupState(ctx, stateFile, stateInterval, config.Credentials.TenantID, logger)
+			if err != nil {
+				return err
 			}
+			defer func() {
+				if err := closeState(); err != nil {
+					logger.Errorf("could not close state: %s", err)
+				}
+			}()
 
 			// setup output target
-			writer, close, err := setupOutput(ctx, output)
+			outputWriter, closeOutput, err := setupOutput(ctx, settings.Output)
 			if err != nil {
 				return err
 			}
-			defer close()
-			if output != "" {
-				logger.Infof("using output: %s", output)
+			out := &swapWriter{w: outputWriter, close: closeOutput}
+			defer out.Close()
+			if settings.Output != "" {
+				logger.Infof("using output: %s", settings.Output)
+			}
+			var writer io.Writer = out
+
+			// setup metrics endpoint
+			endpoints := make(servers)
+			var metrics *prommetrics.Metrics
+			wrapWriter := func(w io.Writer) io.Writer { return w }
+			if metricsListen != "" {
+				metrics = prommetrics.New()
+				endpoints.handle(metricsListen, "/metrics", metrics.Handler())
+				wrapWriter = func(w io.Writer) io.Writer { return metricsWriter{w, metrics} }
+				writer = wrapWriter(writer)
 			}
 
 			// create watcher and start it
 			client := office365.NewClientAuthenticated(&config.Credentials, config.Global.Identifier)
-			handler := office365.NewJSONHandler(writer, logger, indent)
+			libLogger := logrusadapter.New(logger)
+			handler := setupHandler(writer, libLogger, format, indent)
 
-			watcherConf := office365.SubscriptionWatcherConfig{
-				LookBehindMinutes:     lookBehindMinutes,
-				TickerIntervalSeconds: intervalSeconds,
-				AddExtendedSchemas:    extendedSchemas,
+			// setup routes, the output is used by records matching none of them
+			if len(settings.Routes) > 0 {
+				routes, closeRoutes, err := setupRoutes(ctx, settings.Routes, format, indent, wrapWriter, libLogger)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err := closeRoutes(); err != nil {
+						logger.Errorf("could not close route outputs: %s", err)
+					}
+				}()
+				for _, r := range settings.Routes {
+					logger.Infof("using route: %s", routeDescription(r))
+				}
+				handler = office365.NewRouterHandler(routes, handler, libLogger)
 			}
-			watcher, err := office365.NewSubscriptionWatcher(client, watcherConf, state, handler, logger)
+
+			// setup sinks, receiving every record along with the output
+			if len(settings.Sinks) > 0 {
+				sinks, closeSinks, err := setupSinks(ctx, settings.Sinks, format, indent, wrapWriter, metrics, libLogger)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err := closeSinks(); err != nil {
+						logger.Errorf("could not close sinks: %s", err)
+					}
+				}()
+				for i, c := range settings.Sinks {
+					logger.Infof("using sink: %s (%s)", sinks[i].Name, sinkPolicy(c))
+				}
+				output := office365.Sink{Name: "output", Handler: handler, Buffer: defaultSinkBuffer}
+				handler = office365.NewFanOutHandler(append([]office365.Sink{output}, sinks...), libLogger)
+			}
+
+			// setup queue between the watcher and the handler
+			if queueDir != "" {
+				q, err := queue.Open(queueDir, queue.Options{
+					MaxSize:     queueMaxSize << 20,
+					SegmentSize: queueSegmentSize << 20,
+				})
+				if err != nil {
+					return fmt.Errorf("could not open queue: %s", err)
+				}
+				defer func() {
+					if err := q.Close(); err != nil {
+						logger.Errorf("could not close queue: %s", err)
+					}
+				}()
+				logger.Infof("using queue: %s", queueDir)
+				if metrics != nil {
+					metrics.RegisterQueue(q.Depth, q.Size)
+				}
+				handler = queue.NewHandler(q, handler, libLogger)
+			}
+
+			// filter records before they are queued or written
+			if recordFilter != nil {
+				logger.Infof("using filter: %s", recordFilter)
+				handler = filter.NewHandler(recordFilter, handler, libLogger)
+			}
+
+			watcher, err := office365.NewSubscriptionWatcher(client, watcherConf, state, handler, libLogger)
 			if err != nil {
 				return err
 			}
+			if metrics != nil {
+				client.Metrics = metrics
+				watcher.Metrics = metrics
+				metrics.RegisterLag(state, func() []schema.ContentType { return watcher.Config().ContentTypes() })
+			}
+
+			// reload the configfile on SIGHUP
+			reload := func() error {
+				newConfig, err := initConfig(cfgFile)
+				if err != nil {
+					return err
+				}
+				if newConfig.Credentials.TenantID != config.Credentials.TenantID {
+					return fmt.Errorf("tenant can not be changed, state belongs to tenant %s", config.Credentials.TenantID)
+				}
+				newSettings := mergeWatchConfig(cmd.Flags(), flagSettings, newConfig.Watch)
+				if !reflect.DeepEqual(newSettings.Routes, settings.Routes) {
+					logger.Warn("reload: routes can not be changed without a restart, keeping the current ones")
+					newSettings.Routes = settings.Routes
+				}
+				if !reflect.DeepEqual(newSettings.Sinks, settings.Sinks) {
+					logger.Warn("reload: sinks can not be changed without a restart, keeping the current ones")
+					newSettings.Sinks = settings.Sinks
+				}
+				newConf, err := watcherConfig(newConfig, newSettings)
+				if err != nil {
+					return err
+				}
+
+				newClient := client
+				if newConfig.Credentials != config.Credentials || newConfig.Global.Identifier != config.Global.Identifier {
+					newClient = office365.NewClientAuthenticated(&newConfig.Credentials, newConfig.Global.Identifier)
+					if metrics != nil {
+						newClient.Metrics = metrics
+					}
+					logger.Info("reload: using new credentials")
+				}
+				var newWriter io.Writer
+				var newClose func() error
+				if newSettings.Output != settings.Output {
+					newWriter, newClose, err = setupOutput(ctx, newSettings.Output)
+					if err != nil {
+						return err
+					}
+				}
+				if err := watcher.Reload(newClient, newConf); err != nil {
+					if newClose != nil {
+						newClose()
+					}
+					return err
+				}
+				if newWriter != nil {
+					if err := out.swap(newWriter, newClose); err != nil {
+						logger.Errorf("reload: could not close previous output: %s", err)
+					}
+					logger.Infof("reload: using output: %s", newSettings.Output)
+				}
+				config, settings, client = newConfig, newSettings, newClient
+				return nil
+			}
+			go func() {
+				reloadChan := getReloadChan()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-reloadChan:
+						logger.Info("reload: reloading config")
+						if err := reload(); err != nil {
+							logger.Errorf("reload: could not reload config, keeping the current one: %s", err)
+						}
+					}
+				}
+			}()
+
+			// setup status endpoints
+			if statusListen != "" {
+				for pattern, handler := range statusHandlers(watcher, healthIntervals) {
+					endpoints.handle(statusListen, pattern, handler)
+				}
+			}
+			if err := endpoints.start(ctx, logger); err != nil {
+				return err
+			}
+			if once {
+				cmd.SilenceUsage = true
+				err := watcher.RunOnce(ctx)
+				switch {
+				case errors.Is(err, office365.ErrWindowsFailed):
+					return &codeError{code: exitWindowsFailed, err: err}
+				case errors.Is(err, office365.ErrNoSubscriptions):
+					return &codeError{code: exitNoSubscriptions, err: err}
+				}
+				return err
+			}
 			return watcher.Run(ctx)
 		},
 	}
-	cmd.Flags().StringVar(&cfgFile, "config", "", "Set configfile alternate location. Defaults are [$HOME/.go-office365.yaml, $CWD/.go-office365.yaml].")
+	cmd.Flags().StringVar(&cfgFile, "config", "", "Set configfile alternate location. Defaults are [$HOME/.go-office365.yaml, $CWD/.go-office365.yaml]. It is reloaded on SIGHUP.")
 
 	cmd.Flags().StringVar(&logFile, "log", "", "Set logging output to provided file. Default is stderr.")
-	cmd.Flags().StringVar(&stateFile, "state", "", "Set state output to provided file. Default is to not persist state.")
+	cmd.Flags().StringVar(&stateFile, "state", "", "Set state location. Available schemes: file://path/to/statefile.json, bolt://path/to/state.db. A path without scheme is a JSON statefile. Default is to not persist state.")
+	cmd.Flags().IntVar(&stateInterval, "state-interval", 30, "Interval at which state is written to a JSON statefile, in second(s). State is only written on exit when set to 0. Bolt state is written on every update.")
 	cmd.Flags().StringVar(&output, "output", "", "Set records output. Available schemes: file://path/to/file, udp://1.2.3.4:1234, tcp://1.2.3.4:1234")
 
 	cmd.Flags().IntVar(&intervalSeconds, "interval", 5, "Ticker interval used to trigger fetch pipelines, in second(s).")
+	cmd.Flags().IntVar(&minInterval, "min-interval", 5, "Shortest interval between two fetches of a content type, in second(s), when --max-interval is provided.")
+	cmd.Flags().IntVar(&maxInterval, "max-interval", 0, "Make the interval adaptive: it starts at --interval, shortens while content types keep finding new content and backs off, with jitter, when listings are empty, up to the provided number of second(s). Disabled when set to 0.")
 	cmd.Flags().IntVar(&lookBehindMinutes, "lookbehind", 1, "Minimum interval used by fetch actions, in minute(s).")
+	cmd.Flags().StringVar(&queueDir, "queue", "", "Queue records in the provided directory before sending them to the output, so that collection does not wait for the output. Queued records survive restarts. Default is to not queue records.")
+	cmd.Flags().Int64Var(&queueMaxSize, "queue-max-size", 1024, "Maximum size of the queued records, in megabyte(s). Collection waits for the output once the queue is full.")
+	cmd.Flags().Int64Var(&queueSegmentSize, "queue-segment-size", 64, "Size of the queue segment files, in megabyte(s).")
+	cmd.Flags().StringVar(&format, "format", formatJSON, formatsDescription)
+	cmd.Flags().StringVar(&filterExpr, "filter", "", filterDescription)
 	cmd.Flags().BoolVar(&indent, "indent", false, "Set records output to be indented.")
 	cmd.Flags().BoolVar(&debug, "debug", false, "Set log level to DEBUG.")
 	cmd.Flags().BoolVar(&jsonLogging, "json", false, "Set log formatter to JSON.")
 	cmd.Flags().BoolVar(&extendedSchemas, "extended-schemas", false, "Set whether to add extended schemas to the output of the record or not.")
+	cmd.Flags().StringSliceVar(&contentTypes, "content-types", nil, "Set content types to watch, comma separated. Prefix with ! to exclude a content type. Default is all content types.")
+	cmd.Flags().StringVar(&backfillFrom, "backfill-from", "", "Fetch records available since the provided time before tailing. Limited to the last 7 days.")
+	cmd.Flags().IntVar(&backfillWorkers, "backfill-concurrency", 2, "Maximum number of 24 hour chunks fetched concurrently during backfill.")
+	cmd.Flags().IntVar(&fetchConcurrency, "fetch-concurrency", 1, "Maximum number of content blobs fetched concurrently by the pipeline of each content type. Records of a content blob are output together, in listing order.")
+	cmd.Flags().StringToIntVar(&ctConcurrency, "content-type-fetch-concurrency", nil, "Override --fetch-concurrency for some content types, comma separated. For example: Audit.Exchange=8,Audit.SharePoint=8")
+	cmd.Flags().IntVar(&rescanHorizon, "rescan-horizon", 0, "List windows already fetched again, up to the provided number of minute(s) in the past, to pick up content listed late. Disabled when set to 0.")
+	cmd.Flags().IntVar(&rescanInterval, "rescan-interval", 900, "Interval at which windows already fetched are listed again, in second(s).")
+	cmd.Flags().StringVar(&metricsListen, "metrics-listen", "", "Serve Prometheus metrics on /metrics at the provided address, for example :9090. Disabled when empty.")
+	cmd.Flags().StringVar(&statusListen, "status-listen", "", "Serve /healthz, /readyz and a JSON status page on /status at the provided address, for example :8080. Disabled when empty.")
+	cmd.Flags().IntVar(&healthIntervals, "health-intervals", 12, "Number of intervals within which every pipeline must complete a cycle, or fetch a content blob, to be reported healthy.")
+	cmd.Flags().IntVar(&shutdownTimeout, "shutdown-timeout", 30, "Time given to in-flight content blobs to be fetched and written to the output on exit, in second(s). They are abandoned right away when set to 0.")
+	cmd.Flags().BoolVar(&once, "once", false, fmt.Sprintf("Fetch every selected content type from its checkpoint to now, save state and exit, for example from cron. Exits with code %d when some windows failed, and %d when no selected subscription is enabled.", exitWindowsFailed, exitNoSubscriptions))
+	cmd.Flags().BoolVar(&ensureSubs, "ensure-subscriptions", false, "Start subscriptions of selected content types that are missing or disabled. The Webhook section of the configfile is used, if provided.")
 	cmd.Flags().SortFlags = false
 	return cmd
 }
 
+// parseContentTypes splits the provided content types into
+// include and exclude lists. Excluded content types are prefixed with !.
+func parseContentTypes(values []string) ([]schema.ContentType, []schema.ContentType, error) {
+	var include, exclude []schema.ContentType
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		excluded := strings.HasPrefix(v, "!")
+		v = strings.TrimPrefix(v, "!")
+
+		ct, err := schema.GetContentType(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", err, v)
+		}
+		if excluded {
+			exclude = append(exclude, *ct)
+			continue
+		}
+		include = append(include, *ct)
+	}
+	return include, exclude, nil
+}
+
+// parseContentTypeValues maps the provided content type names to their value.
+func parseContentTypeValues(values map[string]int) (map[schema.ContentType]int, error) {
+	result := make(map[schema.ContentType]int)
+	for name, v := range values {
+		ct, err := schema.GetContentType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, name)
+		}
+		result[*ct] = v
+	}
+	return result, nil
+}
+
 func getSigChan() chan os.Signal {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	return sigChan
 }
 
+// getReloadChan returns a channel notified when the configfile must be reloaded.
+func getReloadChan() chan os.Signal {
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	return reloadChan
+}
+
 func initLogger(cmd *cobra.Command, logFile string, setDebug, setJSON bool) (*logrus.Logger, error) {
 	logger := logrus.New()
 
@@ -213,63 +609,334 @@ func setupOutput(ctx context.Context, selection string) (io.Writer, func() error
 	return writer, deferred, nil
 }
 
-func openOutputfile(fpath string) (*os.File, func() error, error) {
-	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+// openStateReadOnly opens the existing state located at selection without writing to it,
+// along with a function releasing it. Statefiles are read without being locked,
+// as they are replaced atomically.
+func openStateReadOnly(selection string) (office365.State, func() error, error) {
+	filePrefix := "file://"
+	boltPrefix := "bolt://"
+
+	if strings.HasPrefix(selection, boltPrefix) {
+		path, err := filepath.Abs(selection[len(boltPrefix):])
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get absolute filepath for provided state database: %s", err)
+		}
+		state, err := boltstate.OpenReadOnly(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("state database does not exist: %s", path)
+			}
+			return nil, nil, fmt.Errorf("could not open state database: %s", err)
+		}
+		return state, state.Close, nil
+	}
+
+	state, err := readStatefile(strings.TrimPrefix(selection, filePrefix))
 	if err != nil {
 		return nil, nil, err
 	}
-	return f, f.Close, nil
+	return state, func() error { return nil }, nil
 }
 
-func setupStatefile(state *office365.MemoryState, fpath string) (string, func() error, error) {
-	statefile, err := filepath.Abs(fpath)
-	if err != nil {
-		return "", nil, fmt.Errorf("could not get absolute filepath for provided statefile: %s", err)
-	}
+// setupState returns the State selected using the provided location,
+// along with a function releasing it.
+func setupState(ctx context.Context, selection string, interval int, tenantID string, logger *logrus.Logger) (office365.State, func() error, error) {
+	filePrefix := "file://"
+	boltPrefix := "bolt://"
 
-	deferred := func() error {
-		return writeState(state, statefile)
+	switch {
+	case selection == "":
+		return office365.NewMemoryState(), func() error { return nil }, nil
+	case strings.HasPrefix(selection, boltPrefix):
+		path, err := filepath.Abs(selection[len(boltPrefix):])
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get absolute filepath for provided state database: %s", err)
+		}
+		state, err := boltstate.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not open state database: %s", err)
+		}
+		if err := checkStateTenant(ctx, state, tenantID); err != nil {
+			state.Close()
+			return nil, nil, err
+		}
+		logger.Infof("using state database: %s", state.Path())
+		return state, state.Close, nil
 	}
-	// readstate could return errInvalidStatefile
-	// which we handle gracefully, therefore,
-	// just send down the err and let the caller handle it
-	err = readState(state, statefile)
 
-	return statefile, deferred, err
-}
-
-func openStatefile(fpath string) (*os.File, func() error, error) {
-	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0640)
+	state := office365.NewMemoryState()
+	sf, err := openStatefile(state, strings.TrimPrefix(selection, filePrefix))
 	if err != nil {
 		return nil, nil, err
 	}
-	return f, f.Close, nil
+	if err := sf.Read(); err != nil {
+		if err != errInvalidStatefile {
+			sf.Release()
+			return nil, nil, err
+		}
+		logger.Info(err)
+	}
+	if err := checkStateTenant(ctx, state, tenantID); err != nil {
+		sf.Release()
+		return nil, nil, err
+	}
+	if interval > 0 {
+		go sf.Checkpoint(ctx, time.Duration(interval)*time.Second, logger)
+	}
+	logger.Infof("using statefile: %s", sf.Path())
+	return state, sf.Close, nil
 }
 
-func readState(state *office365.MemoryState, fpath string) error {
-	f, close, err := openStatefile(fpath)
+// tenantState is implemented by State backends recording the tenant they belong to.
+type tenantState interface {
+	Tenant(context.Context) (string, error)
+	SetTenant(context.Context, string) error
+}
+
+// checkStateTenant records the tenant in the state and prevents
+// a state from being used with another tenant.
+// The check is skipped when tenantID is empty.
+func checkStateTenant(ctx context.Context, state tenantState, tenantID string) error {
+	if tenantID == "" {
+		return nil
+	}
+	stored, err := state.Tenant(ctx)
 	if err != nil {
 		return err
 	}
-	defer close()
+	if stored == "" {
+		return state.SetTenant(ctx, tenantID)
+	}
+	if stored != tenantID {
+		return fmt.Errorf("state belongs to tenant %s, not %s", stored, tenantID)
+	}
+	return nil
+}
+
+func setupHandler(w io.Writer, logger office365.Logger, format string, indent bool) office365.ResourceHandler {
+	if format == formatOCSF {
+		return ocsf.NewHandler(w, logger, indent)
+	}
+	return office365.NewJSONHandler(w, logger, indent)
+}
 
-	err = state.Read(f)
+// setupRoutes returns the provided routes, each writing records to its own output
+// using setupHandler, along with a function closing their outputs.
+// Writers are wrapped using wrap.
+func setupRoutes(ctx context.Context, configs []RouteConfig, format string, indent bool, wrap func(io.Writer) io.Writer, logger office365.Logger) ([]office365.Route, func() error, error) {
+	var closers []func() error
+	closeAll := func() error {
+		var result error
+		for _, c := range closers {
+			if err := c(); err != nil && result == nil {
+				result = err
+			}
+		}
+		return result
+	}
+
+	routes := make([]office365.Route, 0, len(configs))
+	for i, c := range configs {
+		route, closeOutput, err := setupRoute(ctx, c, format, indent, wrap, logger)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("route %d: %s", i, err)
+		}
+		closers = append(closers, closeOutput)
+		routes = append(routes, route)
+	}
+	return routes, closeAll, nil
+}
+
+func setupRoute(ctx context.Context, c RouteConfig, format string, indent bool, wrap func(io.Writer) io.Writer, logger office365.Logger) (office365.Route, func() error, error) {
+	if c.Format != "" {
+		format = c.Format
+	}
+	if err := validateFormat(format); err != nil {
+		return office365.Route{}, nil, err
+	}
+	match := office365.RouteMatch{
+		RecordTypes: c.RecordTypes,
+		Workloads:   c.Workloads,
+		Operations:  c.Operations,
+	}
+	for _, v := range c.ContentTypes {
+		ct, err := schema.GetContentType(strings.TrimSpace(v))
+		if err != nil {
+			return office365.Route{}, nil, fmt.Errorf("%s: %s", err, v)
+		}
+		match.ContentTypes = append(match.ContentTypes, *ct)
+	}
+	w, closeOutput, err := setupOutput(ctx, c.Output)
 	if err != nil {
-		return errInvalidStatefile
+		return office365.Route{}, nil, err
 	}
-	return nil
+	route := office365.Route{
+		Name:    c.Name,
+		Match:   match,
+		Handler: setupHandler(wrap(w), logger, format, indent),
+	}
+	return route, closeOutput, nil
+}
+
+// setupSinks returns the provided sinks, each writing records to its own output
+// using setupHandler, along with a function closing their outputs and queues.
+// Writers are wrapped using wrap. Dropped records are counted when metrics is not nil.
+func setupSinks(ctx context.Context, configs []SinkConfig, format string, indent bool, wrap func(io.Writer) io.Writer, metrics *prommetrics.Metrics, logger office365.Logger) ([]office365.Sink, func() error, error) {
+	var closers []func() error
+	closeAll := func() error {
+		var result error
+		for _, c := range closers {
+			if err := c(); err != nil && result == nil {
+				result = err
+			}
+		}
+		return result
+	}
+
+	sinks := make([]office365.Sink, 0, len(configs))
+	for i, c := range configs {
+		sink, closeSink, err := setupSink(ctx, c, format, indent, wrap, logger)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("sink %d: %s", i, err)
+		}
+		closers = append(closers, closeSink)
+		if metrics != nil {
+			name := sink.Name
+			sink.Dropped = func() { metrics.SinkDropped(name) }
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, closeAll, nil
 }
 
-func writeState(state *office365.MemoryState, fpath string) error {
-	f, close, err := openStatefile(fpath)
+func setupSink(ctx context.Context, c SinkConfig, format string, indent bool, wrap func(io.Writer) io.Writer, logger office365.Logger) (office365.Sink, func() error, error) {
+	policy := sinkPolicy(c)
+	if c.Format != "" {
+		format = c.Format
+	}
+	if err := validateFormat(format); err != nil {
+		return office365.Sink{}, nil, err
+	}
+	sink := office365.Sink{Name: c.Name, Buffer: c.Buffer}
+	if sink.Name == "" {
+		sink.Name = c.Output
+		if sink.Name == "" {
+			sink.Name = "stdout"
+		}
+	}
+	if sink.Buffer <= 0 {
+		sink.Buffer = defaultSinkBuffer
+	}
+	switch policy {
+	case sinkPolicyBlock:
+		sink.Policy = office365.SinkBlock
+	case sinkPolicyDrop:
+		sink.Policy = office365.SinkDrop
+	case sinkPolicySpill:
+		sink.Policy = office365.SinkSpill
+	default:
+		return office365.Sink{}, nil, fmt.Errorf("policy invalid: %s. Available policies: %s, %s, %s", c.Policy, sinkPolicyBlock, sinkPolicyDrop, sinkPolicySpill)
+	}
+	if policy == sinkPolicySpill && c.QueueDir == "" {
+		return office365.Sink{}, nil, fmt.Errorf("QueueDir must be provided with the %s policy", sinkPolicySpill)
+	}
+
+	w, closeOutput, err := setupOutput(ctx, c.Output)
 	if err != nil {
-		return err
+		return office365.Sink{}, nil, err
+	}
+	sink.Handler = setupHandler(wrap(w), logger, format, indent)
+	if sink.Policy != office365.SinkSpill {
+		return sink, closeOutput, nil
 	}
-	defer close()
 
-	err = state.Write(f)
+	// records are stored on disk while the buffer of the sink is full
+	q, err := queue.Open(c.QueueDir, queue.Options{MaxSize: c.QueueMaxSize << 20})
 	if err != nil {
+		closeOutput()
+		return office365.Sink{}, nil, fmt.Errorf("could not open queue: %s", err)
+	}
+	sink.Spill = queue.NewSpill(q)
+	closeSink := func() error {
+		err := q.Close()
+		if closeErr := closeOutput(); err == nil {
+			err = closeErr
+		}
 		return err
 	}
-	return nil
+	return sink, closeSink, nil
+}
+
+// sinkPolicy returns the policy of the provided sink, block by default.
+func sinkPolicy(c SinkConfig) string {
+	if c.Policy == "" {
+		return sinkPolicyBlock
+	}
+	return strings.ToLower(c.Policy)
+}
+
+// routeDescription returns a description of the provided route used when logging.
+func routeDescription(c RouteConfig) string {
+	var criteria []string
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			criteria = append(criteria, fmt.Sprintf("%s=%s", name, strings.Join(values, ",")))
+		}
+	}
+	add("content-types", c.ContentTypes)
+	add("record-types", c.RecordTypes)
+	add("workloads", c.Workloads)
+	add("operations", c.Operations)
+	if len(criteria) == 0 {
+		criteria = append(criteria, "all records")
+	}
+	output := c.Output
+	if output == "" {
+		output = "stdout"
+	}
+	description := fmt.Sprintf("%s -> %s", strings.Join(criteria, " "), output)
+	if c.Name != "" {
+		description = c.Name + ": " + description
+	}
+	return description
+}
+
+// swapWriter is an io.Writer whose underlying output
+// can be replaced while records are being written.
+type swapWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	close func() error
+}
+
+func (w *swapWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// swap replaces the underlying output and closes the previous one.
+func (w *swapWriter) swap(writer io.Writer, close func() error) error {
+	w.mu.Lock()
+	previous := w.close
+	w.w, w.close = writer, close
+	w.mu.Unlock()
+	return previous()
+}
+
+// Close closes the underlying output.
+func (w *swapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+func openOutputfile(fpath string) (*os.File, func() error, error) {
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
 }
@@ -3,8 +3,11 @@ module github.com/devodev/go-office365/v0
 go 1.13
 
 require (
+	github.com/prometheus/client_golang v1.5.1
 	github.com/sirupsen/logrus v1.5.0
 	github.com/spf13/cobra v0.0.7
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.6.2
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
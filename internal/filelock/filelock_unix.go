@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+// Package filelock provides exclusive, non-blocking locks on files,
+// used to prevent two processes from using the same state or queue.
+package filelock
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock acquires an exclusive lock on f, without blocking.
+func Lock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// Unlock releases the lock held on f.
+func Unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// SyncDir flushes the directory entry so that a rename survives a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,55 @@
+//go:build windows
+// +build windows
+
+package filelock
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+)
+
+// Lock acquires an exclusive lock on f, without blocking.
+func Lock(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(
+		f.Fd(),
+		uintptr(lockfileExclusiveLock|lockfileFailImmediately),
+		0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Unlock releases the lock held on f.
+func Unlock(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(
+		f.Fd(),
+		0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// SyncDir is a no-op, directories cannot be synced on windows.
+func SyncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package office365
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// acker calls fn once it has been acknowledged n times.
+type acker struct {
+	remaining int64
+	fn        func()
+}
+
+// newAcker returns an acker expecting n acknowledgements.
+// fn is called right away when n is 0.
+func newAcker(n int, fn func()) *acker {
+	a := &acker{remaining: int64(n), fn: fn}
+	if n <= 0 {
+		fn()
+	}
+	return a
+}
+
+// ackFunc returns a function acknowledging a single record.
+// Calling it more than once has no effect.
+func (a *acker) ackFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt64(&a.remaining, -1) == 0 {
+				a.fn()
+			}
+		})
+	}
+}
+
+// mark is a checkpoint registered on a watermark.
+type mark struct {
+	t        time.Time
+	released bool
+}
+
+// watermark commits checkpoints in the order they were registered.
+// A checkpoint is committed only once it and every checkpoint
+// registered before it have been released.
+type watermark struct {
+	mu     sync.Mutex
+	marks  []*mark
+	commit func(time.Time)
+}
+
+func newWatermark(commit func(time.Time)) *watermark {
+	return &watermark{commit: commit}
+}
+
+// add registers a new checkpoint.
+func (w *watermark) add(t time.Time) *mark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m := &mark{t: t}
+	w.marks = append(w.marks, m)
+	return m
+}
+
+// release releases the checkpoint and commits the last checkpoint
+// of the contiguous sequence of released checkpoints, if any.
+func (w *watermark) release(m *mark) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m.released = true
+
+	var last *mark
+	for len(w.marks) > 0 && w.marks[0].released {
+		last = w.marks[0]
+		w.marks = w.marks[1:]
+	}
+	if last != nil {
+		w.commit(last.t)
+	}
+}
+
+// contentWindow tracks the content listed for a time window
+// until every record it contains has been acknowledged.
+type contentWindow struct {
+	wg      sync.WaitGroup
+	failed  int32
+	created *watermark
+}
+
+// newContentWindow returns a contentWindow that commits the creation time
+// of content once it has been handled, in the order content was added.
+func newContentWindow(commit func(time.Time)) *contentWindow {
+	return &contentWindow{created: newWatermark(commit)}
+}
+
+// add registers content created at the provided time.
+func (w *contentWindow) add(created time.Time) *mark {
+	w.wg.Add(1)
+	return w.created.add(created)
+}
+
+// complete marks the content as handled.
+func (w *contentWindow) complete(m *mark) {
+	w.created.release(m)
+	w.wg.Done()
+}
+
+// fail marks the content as failed. Its creation time and the
+// creation time of content added after it are never committed.
+func (w *contentWindow) fail() {
+	atomic.StoreInt32(&w.failed, 1)
+	w.wg.Done()
+}
+
+// drop removes content that was added but never sent. Its creation time
+// and the creation time of content added after it are never committed.
+func (w *contentWindow) drop() {
+	w.wg.Done()
+}
+
+// wait blocks until every content has been completed or failed,
+// and returns whether they all completed.
+// It returns false when done is closed before then.
+func (w *contentWindow) wait(done chan struct{}) bool {
+	ch := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-done:
+		return false
+	case <-ch:
+	}
+	return atomic.LoadInt32(&w.failed) == 0
+}
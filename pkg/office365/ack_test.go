@@ -0,0 +1,75 @@
+package office365
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatermark(t *testing.T) {
+	var committed []time.Time
+	w := newWatermark(func(t time.Time) {
+		committed = append(committed, t)
+	})
+
+	now := time.Now()
+	m1 := w.add(now)
+	m2 := w.add(now.Add(time.Minute))
+	m3 := w.add(now.Add(2 * time.Minute))
+
+	w.release(m2)
+	if len(committed) != 0 {
+		t.Fatalf("committed %v while first mark is pending", committed)
+	}
+	w.release(m1)
+	testDeep(t, committed, []time.Time{now.Add(time.Minute)})
+
+	w.release(m3)
+	testDeep(t, committed, []time.Time{now.Add(time.Minute), now.Add(2 * time.Minute)})
+}
+
+func TestAcker(t *testing.T) {
+	calls := 0
+	a := newAcker(2, func() { calls++ })
+
+	first := a.ackFunc()
+	first()
+	first()
+	if calls != 0 {
+		t.Fatalf("acker called after a single record was acknowledged twice")
+	}
+	a.ackFunc()()
+	if calls != 1 {
+		t.Fatalf("got %d calls but want 1", calls)
+	}
+
+	newAcker(0, func() { calls++ })
+	if calls != 2 {
+		t.Fatalf("acker not called right away when empty")
+	}
+}
+
+func TestContentWindow(t *testing.T) {
+	done := make(chan struct{})
+	now := time.Now()
+
+	var committed time.Time
+	w := newContentWindow(func(t time.Time) { committed = t })
+	m1 := w.add(now)
+	w.add(now.Add(time.Minute))
+
+	w.complete(m1)
+	w.fail()
+	if w.wait(done) {
+		t.Errorf("window completed with failed content")
+	}
+	if !committed.Equal(now) {
+		t.Errorf("got committed %v but want %v", committed, now)
+	}
+
+	w = newContentWindow(func(time.Time) {})
+	w.add(now)
+	close(done)
+	if w.wait(done) {
+		t.Errorf("window completed while content is pending")
+	}
+}
@@ -0,0 +1,221 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+var (
+	defaultBackfillConcurrency = 2
+
+	// backfillMargin keeps backfill chunks away from the 7 days limit
+	// so that they are still valid by the time they are requested.
+	backfillMargin = 10 * time.Minute
+)
+
+// backfillChunk is a valid time window queried during backfill.
+type backfillChunk struct {
+	ContentType schema.ContentType
+	Start       time.Time
+	End         time.Time
+
+	done bool
+	err  error
+}
+
+// backfillProgress tracks the chunks of a single content type
+// and advances the state once a contiguous sequence of chunks completed.
+type backfillProgress struct {
+	mu     sync.Mutex
+	chunks []*backfillChunk
+	next   int
+}
+
+// complete marks the chunk as completed and returns the end of the
+// last chunk of the contiguous sequence of completed chunks, if it moved.
+func (p *backfillProgress) complete(c *backfillChunk, err error) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.done = true
+	c.err = err
+
+	var progress time.Time
+	for p.next < len(p.chunks) {
+		chunk := p.chunks[p.next]
+		if !chunk.done || chunk.err != nil {
+			break
+		}
+		progress = chunk.End
+		p.next++
+	}
+	return progress, !progress.IsZero()
+}
+
+// completed returns whether every chunk completed successfully.
+func (p *backfillProgress) completed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next == len(p.chunks)
+}
+
+// planBackfill splits the window between the configured BackfillFrom and the point
+// where tailing starts into 24 hour chunks, for the provided content type.
+// It resumes from the backfill progress stored in State, if any.
+func (s *SubscriptionWatcher) planBackfill(ctx context.Context, ct schema.ContentType, now time.Time) ([]*backfillChunk, error) {
+	ctLogger := s.logger.WithField("content-type", ct.String())
+
+	end, err := s.State.LastRequestTime(ctx, ct)
+	if err != nil {
+		return nil, err
+	}
+	if end.IsZero() || end.After(now) {
+		end = now
+	}
+	start := s.Config().BackfillFrom
+	progress, err := s.State.BackfillProgress(ctx, ct)
+	if err != nil {
+		return nil, err
+	}
+	if progress.After(start) {
+		ctLogger.Infof("backfill: resuming from %s", progress.String())
+		start = progress
+	}
+	if earliest := now.Add(-intervalOneWeek).Add(backfillMargin); start.Before(earliest) {
+		ctLogger.Warnf("backfill: start %s is too far in the past, using %s", start.String(), earliest.String())
+		start = earliest
+	}
+	return splitWindow(ct, start, end), nil
+}
+
+// splitWindow truncates the window to the minute
+// and splits it into chunks of at most 24 hours.
+func splitWindow(ct schema.ContentType, start, end time.Time) []*backfillChunk {
+	start = start.Truncate(time.Minute)
+	end = end.Truncate(time.Minute)
+
+	var chunks []*backfillChunk
+	for start.Before(end) {
+		chunkEnd := start.Add(intervalOneDay)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		chunks = append(chunks, &backfillChunk{ContentType: ct, Start: start, End: chunkEnd})
+		start = chunkEnd
+	}
+	return chunks
+}
+
+// backfill walks the window between the configured BackfillFrom and the point
+// where tailing starts, for each provided content type.
+// Chunks are fetched concurrently, up to BackfillConcurrency at a time.
+// Once done, the request time checkpoint is moved to the end of the backfilled window
+// so that tailing picks up from there.
+func (s *SubscriptionWatcher) backfill(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, contentTypes []schema.ContentType) {
+	now := time.Now()
+	s.logger.Infof("backfill: start from %s", s.Config().BackfillFrom.String())
+
+	progresses := make(map[schema.ContentType]*backfillProgress)
+	var chunks []*backfillChunk
+	for _, ct := range contentTypes {
+		ctLogger := s.logger.WithField("content-type", ct.String())
+		ctChunks, err := s.planBackfill(ctx, ct, now)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctLogger.Errorf("backfill: could not plan: %s", err)
+			}
+			continue
+		}
+		ctLogger.Infof("backfill: planned %d chunk(s)", len(ctChunks))
+
+		progresses[ct] = &backfillProgress{chunks: ctChunks}
+		chunks = append(chunks, ctChunks...)
+	}
+
+	concurrency := s.Config().BackfillConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBackfillConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+Loop:
+	for _, chunk := range chunks {
+		select {
+		case <-s.stopping:
+			break Loop
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(c *backfillChunk) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctLogger := s.logger.WithField("content-type", c.ContentType.String())
+
+			err := s.fetchBackfillChunk(ctx, done, out, c, now)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					ctLogger.Errorf("backfill: chunk %s - %s failed: %s", c.Start.String(), c.End.String(), err)
+				}
+				s.status.fail(c.ContentType, err)
+			} else {
+				s.status.cycle(c.ContentType, time.Now())
+			}
+			if progress, ok := progresses[c.ContentType].complete(c, err); ok {
+				if err := s.setCheckpoint(stateContext, c.ContentType, CheckpointBackfillProgress, progress); err != nil {
+					ctLogger.Errorf("backfill: could not set progress: %s", err)
+					s.fetchFailed(&c.ContentType, "", OperationState, err)
+				} else {
+					ctLogger.Debugf("backfill: set progress: %s", progress.String())
+				}
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	if s.stopped() {
+		s.logger.Infof("backfill: interrupted")
+		return
+	}
+
+	for ct, p := range progresses {
+		ct := ct
+		ctLogger := s.logger.WithField("content-type", ct.String())
+		if !p.completed() {
+			ctLogger.Warnf("backfill: incomplete, will resume on next start")
+		}
+		if len(p.chunks) == 0 {
+			continue
+		}
+		lastRequestTime, err := s.State.LastRequestTime(ctx, ct)
+		if err != nil {
+			ctLogger.Errorf("backfill: could not get lastRequestTime: %s", err)
+			continue
+		}
+		if lastRequestTime.IsZero() {
+			end := p.chunks[len(p.chunks)-1].End
+			if err := s.setCheckpoint(ctx, ct, CheckpointLastRequestTime, end); err != nil {
+				ctLogger.Errorf("backfill: could not set lastRequestTime: %s", err)
+				s.fetchFailed(&ct, "", OperationState, err)
+			}
+		}
+	}
+	s.logger.Infof("backfill: end")
+}
+
+// fetchBackfillChunk lists the content available in the chunk and sends its audit records.
+// It returns once every record has been acknowledged.
+// Content already processed, by tailing or a previous run, is skipped.
+func (s *SubscriptionWatcher) fetchBackfillChunk(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, c *backfillChunk, requestTime time.Time) error {
+	ctLogger := s.logger.WithField("content-type", c.ContentType.String())
+	ctLogger.Debugf("backfill: fetching chunk %s - %s", c.Start.String(), c.End.String())
+
+	_, err := s.fetchWindow(ctx, done, out, c.ContentType, WindowSourceBackfill, c.Start, c.End, requestTime)
+	return err
+}
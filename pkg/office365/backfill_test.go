@@ -0,0 +1,114 @@
+package office365
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestPlanBackfill(t *testing.T) {
+	now := time.Date(2020, 4, 16, 12, 30, 45, 0, time.UTC)
+	ct := schema.AuditExchange
+
+	cases := []struct {
+		From            time.Time
+		Progress        time.Time
+		LastRequestTime time.Time
+		WantStart       time.Time
+		WantEnd         time.Time
+		WantChunks      int
+	}{
+		{
+			From:       now.Add(-(intervalOneDay * 2)),
+			WantStart:  now.Add(-(intervalOneDay * 2)).Truncate(time.Minute),
+			WantEnd:    now.Truncate(time.Minute),
+			WantChunks: 2,
+		},
+		{
+			From:       now.Add(-(intervalOneDay * 10)),
+			WantStart:  now.Add(-intervalOneWeek).Add(backfillMargin).Truncate(time.Minute),
+			WantEnd:    now.Truncate(time.Minute),
+			WantChunks: 7,
+		},
+		{
+			From:       now.Add(-(intervalOneDay * 3)),
+			Progress:   now.Add(-(intervalOneDay * 1)),
+			WantStart:  now.Add(-(intervalOneDay * 1)).Truncate(time.Minute),
+			WantEnd:    now.Truncate(time.Minute),
+			WantChunks: 1,
+		},
+		{
+			From:            now.Add(-(intervalOneDay * 3)),
+			LastRequestTime: now.Add(-(intervalOneDay * 2)),
+			WantStart:       now.Add(-(intervalOneDay * 3)).Truncate(time.Minute),
+			WantEnd:         now.Add(-(intervalOneDay * 2)).Truncate(time.Minute),
+			WantChunks:      1,
+		},
+		{
+			From:            now.Add(-(intervalOneDay * 3)),
+			Progress:        now.Add(-(intervalOneDay * 2)),
+			LastRequestTime: now.Add(-(intervalOneDay * 2)),
+			WantChunks:      0,
+		},
+	}
+
+	for idx, c := range cases {
+		t.Run(fmt.Sprintf("%d.", idx+1), func(t *testing.T) {
+			watcher := stubWatcher(t, nil, SubscriptionWatcherConfig{BackfillFrom: c.From})
+			if !c.Progress.IsZero() {
+				watcher.SetBackfillProgress(context.Background(), ct, c.Progress)
+			}
+			if !c.LastRequestTime.IsZero() {
+				watcher.SetLastRequestTime(context.Background(), ct, c.LastRequestTime)
+			}
+
+			chunks, err := watcher.planBackfill(context.Background(), ct, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != c.WantChunks {
+				t.Fatalf("got %d chunks but want %d", len(chunks), c.WantChunks)
+			}
+			if len(chunks) == 0 {
+				return
+			}
+			if got := chunks[0].Start; !got.Equal(c.WantStart) {
+				t.Errorf("start: got %v want %v", got, c.WantStart)
+			}
+			if got := chunks[len(chunks)-1].End; !got.Equal(c.WantEnd) {
+				t.Errorf("end: got %v want %v", got, c.WantEnd)
+			}
+			for _, chunk := range chunks {
+				if err := NewQueryParams().AddStartEndTime(chunk.Start, chunk.End); err != nil && err != ErrIntervalWeek {
+					t.Errorf("chunk %v - %v is invalid: %v", chunk.Start, chunk.End, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillProgress(t *testing.T) {
+	now := time.Now()
+	chunks := []*backfillChunk{
+		{Start: now, End: now.Add(time.Hour)},
+		{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)},
+		{Start: now.Add(2 * time.Hour), End: now.Add(3 * time.Hour)},
+	}
+	p := &backfillProgress{chunks: chunks}
+
+	if _, ok := p.complete(chunks[1], nil); ok {
+		t.Errorf("progress moved while first chunk is pending")
+	}
+	if got, ok := p.complete(chunks[0], nil); !ok || !got.Equal(chunks[1].End) {
+		t.Errorf("got progress %v but want %v", got, chunks[1].End)
+	}
+	if _, ok := p.complete(chunks[2], fmt.Errorf("failed")); ok {
+		t.Errorf("progress moved past a failed chunk")
+	}
+	if p.completed() {
+		t.Errorf("backfill completed with a failed chunk")
+	}
+}
@@ -0,0 +1,485 @@
+// Package boltstate provides an office365.State implementation
+// backed by an embedded bbolt database.
+//
+// Every update is carried out in its own transaction, so the database
+// always holds a consistent state, even after a crash.
+package boltstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	bolt "go.etcd.io/bbolt"
+)
+
+// FormatVersion is the version of the database layout written by this package.
+const FormatVersion = "1"
+
+// Metadata keys written by this package.
+const (
+	MetadataFormatVersion = "format-version"
+	MetadataCreated       = "created"
+	MetadataTenant        = "tenant-id"
+)
+
+// Database layout:
+//
+//	checkpoints/<checkpoint>/<content type name> = time
+//	content/<content type name>/<content id> = expiration
+//	gaps/<content type name>/<gap key> = json encoded office365.Gap
+//	metadata/<key> = value
+var (
+	bucketCheckpoints = []byte("checkpoints")
+	bucketContent     = []byte("content")
+	bucketGaps        = []byte("gaps")
+	bucketMetadata    = []byte("metadata")
+
+	kindLastContentCreated = []byte(office365.CheckpointLastContentCreated)
+	kindLastRequestTime    = []byte(office365.CheckpointLastRequestTime)
+	kindBackfillProgress   = []byte(office365.CheckpointBackfillProgress)
+)
+
+var (
+	// ErrLocked is returned by Open when the database is used by another process.
+	ErrLocked = errors.New("state database is locked by another process")
+	// ErrFormatVersion is returned by Open when the database was written
+	// using an unsupported layout.
+	ErrFormatVersion = errors.New("state database format version not supported")
+)
+
+// openTimeout is how long Open waits for the database lock.
+var openTimeout = time.Second
+
+// State implements the office365.State interface using a bbolt database.
+type State struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database located at path.
+// The database is locked until Close is called.
+func Open(path string) (*State, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	s := &State{db: db}
+	if err := s.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenReadOnly opens the existing database located at path without writing to it.
+// The database can not be updated, and can not be opened for writing until Close is called.
+func OpenReadOnly(path string) (*State, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	s := &State{db: db}
+	err = db.View(func(tx *bolt.Tx) error {
+		var version []byte
+		if meta := tx.Bucket(bucketMetadata); meta != nil {
+			version = meta.Get([]byte(MetadataFormatVersion))
+		}
+		if string(version) != FormatVersion {
+			return fmt.Errorf("%w: %s", ErrFormatVersion, version)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// init creates the top level buckets and metadata of a new database,
+// and verifies the format version of an existing one.
+func (s *State) init() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketCheckpoints, bucketContent, bucketGaps} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMetadata)
+		if err != nil {
+			return err
+		}
+
+		version := meta.Get([]byte(MetadataFormatVersion))
+		if version == nil {
+			if err := meta.Put([]byte(MetadataFormatVersion), []byte(FormatVersion)); err != nil {
+				return err
+			}
+			created := time.Now().UTC().Format(time.RFC3339)
+			return meta.Put([]byte(MetadataCreated), []byte(created))
+		}
+		if string(version) != FormatVersion {
+			return fmt.Errorf("%w: %s", ErrFormatVersion, version)
+		}
+		return nil
+	})
+}
+
+// Path returns the path of the database file.
+func (s *State) Path() string {
+	return s.db.Path()
+}
+
+// Close releases the database.
+func (s *State) Close() error {
+	return s.db.Close()
+}
+
+// view runs fn in a read-only transaction, unless ctx is done.
+func (s *State) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, unless ctx is done.
+func (s *State) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+func (s *State) checkpoint(ctx context.Context, kind []byte, ct schema.ContentType) (time.Time, error) {
+	var t time.Time
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCheckpoints).Bucket(kind)
+		if b == nil {
+			return nil
+		}
+		return decodeTime(b.Get([]byte(ct.String())), &t)
+	})
+	return t, err
+}
+
+func (s *State) setCheckpoint(ctx context.Context, kind []byte, ct schema.ContentType, t time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketCheckpoints).CreateBucketIfNotExists(kind)
+		if err != nil {
+			return err
+		}
+		key := []byte(ct.String())
+
+		var last time.Time
+		if err := decodeTime(b.Get(key), &last); err != nil {
+			return err
+		}
+		if !last.IsZero() && !last.Before(t) {
+			return nil
+		}
+		v, err := t.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+}
+
+// LastContentCreated implements the office365.State interface.
+func (s *State) LastContentCreated(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	return s.checkpoint(ctx, kindLastContentCreated, ct)
+}
+
+// SetLastContentCreated implements the office365.State interface.
+func (s *State) SetLastContentCreated(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	return s.setCheckpoint(ctx, kindLastContentCreated, ct, t)
+}
+
+// LastRequestTime implements the office365.State interface.
+func (s *State) LastRequestTime(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	return s.checkpoint(ctx, kindLastRequestTime, ct)
+}
+
+// SetLastRequestTime implements the office365.State interface.
+func (s *State) SetLastRequestTime(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	return s.setCheckpoint(ctx, kindLastRequestTime, ct, t)
+}
+
+// BackfillProgress implements the office365.State interface.
+func (s *State) BackfillProgress(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	return s.checkpoint(ctx, kindBackfillProgress, ct)
+}
+
+// SetBackfillProgress implements the office365.State interface.
+func (s *State) SetBackfillProgress(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	return s.setCheckpoint(ctx, kindBackfillProgress, ct, t)
+}
+
+// ContentProcessed implements the office365.State interface.
+func (s *State) ContentProcessed(ctx context.Context, ct schema.ContentType, contentID string) (bool, error) {
+	var ok bool
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketContent).Bucket([]byte(ct.String()))
+		ok = b != nil && b.Get([]byte(contentID)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// SetContentProcessed implements the office365.State interface.
+func (s *State) SetContentProcessed(ctx context.Context, ct schema.ContentType, contentID string, expiration time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketContent).CreateBucketIfNotExists([]byte(ct.String()))
+		if err != nil {
+			return err
+		}
+		v, err := expiration.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(contentID), v)
+	})
+}
+
+// PruneContent implements the office365.State interface.
+func (s *State) PruneContent(ctx context.Context, ct schema.ContentType, before time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketContent).Bucket([]byte(ct.String()))
+		if b == nil {
+			return nil
+		}
+		// keys are collected first since deleting
+		// while iterating with a cursor skips items
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var expiration time.Time
+			if err := decodeTime(v, &expiration); err != nil {
+				return err
+			}
+			if expiration.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Gaps implements the office365.GapLedger interface.
+func (s *State) Gaps(ctx context.Context, ct schema.ContentType) ([]office365.Gap, error) {
+	var gaps []office365.Gap
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGaps).Bucket([]byte(ct.String()))
+		if b == nil {
+			return nil
+		}
+		// keys are iterated in byte order
+		return b.ForEach(func(k, v []byte) error {
+			var g office365.Gap
+			if err := json.Unmarshal(v, &g); err != nil {
+				return fmt.Errorf("invalid gap value: %s", err)
+			}
+			gaps = append(gaps, g)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gaps, nil
+}
+
+// SetGap implements the office365.GapLedger interface.
+func (s *State) SetGap(ctx context.Context, ct schema.ContentType, g office365.Gap) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketGaps).CreateBucketIfNotExists([]byte(ct.String()))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(g.Key()), v)
+	})
+}
+
+// DeleteGap implements the office365.GapLedger interface.
+func (s *State) DeleteGap(ctx context.Context, ct schema.ContentType, key string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGaps).Bucket([]byte(ct.String()))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ContentTypeState implements the office365.StateEditor interface.
+func (s *State) ContentTypeState(ctx context.Context, ct schema.ContentType) (*office365.ContentTypeState, error) {
+	state := &office365.ContentTypeState{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		key := []byte(ct.String())
+		checkpoints := map[string]*time.Time{
+			string(kindLastContentCreated): &state.LastContentCreated,
+			string(kindLastRequestTime):    &state.LastRequestTime,
+			string(kindBackfillProgress):   &state.BackfillProgress,
+		}
+		for kind, t := range checkpoints {
+			b := tx.Bucket(bucketCheckpoints).Bucket([]byte(kind))
+			if b == nil {
+				continue
+			}
+			if err := decodeTime(b.Get(key), t); err != nil {
+				return err
+			}
+		}
+
+		if b := tx.Bucket(bucketContent).Bucket(key); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				var expiration time.Time
+				if err := decodeTime(v, &expiration); err != nil {
+					return err
+				}
+				if state.ProcessedContent == nil {
+					state.ProcessedContent = make(map[string]time.Time)
+				}
+				state.ProcessedContent[string(k)] = expiration
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket(bucketGaps).Bucket(key)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var g office365.Gap
+			if err := json.Unmarshal(v, &g); err != nil {
+				return fmt.Errorf("invalid gap value: %s", err)
+			}
+			if state.Gaps == nil {
+				state.Gaps = make(map[string]office365.Gap)
+			}
+			state.Gaps[string(k)] = g
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ReplaceCheckpoint implements the office365.StateEditor interface.
+func (s *State) ReplaceCheckpoint(ctx context.Context, ct schema.ContentType, c office365.Checkpoint, t time.Time) error {
+	if _, err := office365.GetCheckpoint(string(c)); err != nil {
+		return err
+	}
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketCheckpoints).CreateBucketIfNotExists([]byte(c))
+		if err != nil {
+			return err
+		}
+		key := []byte(ct.String())
+		if t.IsZero() {
+			return b.Delete(key)
+		}
+		v, err := t.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+}
+
+// ResetContentType implements the office365.StateEditor interface.
+func (s *State) ResetContentType(ctx context.Context, ct schema.ContentType) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		key := []byte(ct.String())
+		for _, kind := range [][]byte{kindLastContentCreated, kindLastRequestTime, kindBackfillProgress} {
+			b := tx.Bucket(bucketCheckpoints).Bucket(kind)
+			if b == nil {
+				continue
+			}
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{bucketContent, bucketGaps} {
+			parent := tx.Bucket(name)
+			if parent.Bucket(key) == nil {
+				continue
+			}
+			if err := parent.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Tenant returns the tenant the state belongs to, if any.
+func (s *State) Tenant(ctx context.Context) (string, error) {
+	return s.Metadata(ctx, MetadataTenant)
+}
+
+// SetTenant records the tenant the state belongs to.
+func (s *State) SetTenant(ctx context.Context, tenant string) error {
+	return s.SetMetadata(ctx, MetadataTenant, tenant)
+}
+
+// Metadata returns the value of the metadata identified by key.
+// It returns an empty string when the key is not set.
+func (s *State) Metadata(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(bucketMetadata).Get([]byte(key)))
+		return nil
+	})
+	return value, err
+}
+
+// SetMetadata sets the value of the metadata identified by key.
+func (s *State) SetMetadata(ctx context.Context, key, value string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).Put([]byte(key), []byte(value))
+	})
+}
+
+func decodeTime(v []byte, t *time.Time) error {
+	if v == nil {
+		*t = time.Time{}
+		return nil
+	}
+	if err := t.UnmarshalBinary(v); err != nil {
+		return fmt.Errorf("invalid time value: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package boltstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/devodev/go-office365/v0/pkg/office365/statetest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "boltstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestState(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var opened []*State
+	defer func() {
+		for _, s := range opened {
+			s.Close()
+		}
+	}()
+
+	statetest.Run(t, func(t *testing.T) office365.State {
+		s, err := Open(filepath.Join(dir, fmt.Sprintf("%d.db", len(opened))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened = append(opened, s)
+		return s
+	})
+}
+
+func TestStateReopen(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	path := filepath.Join(dir, "state.db")
+	ct := schema.AuditExchange
+	now := time.Date(2020, 4, 16, 12, 30, 45, 0, time.UTC)
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetLastRequestTime(ctx, ct, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetContentProcessed(ctx, ct, "abc", now.Add(intervalOneWeek)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMetadata(ctx, "tenant-id", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err != ErrLocked {
+		t.Errorf("got error %v opening a database in use but want %v", err, ErrLocked)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if got, err := s.LastRequestTime(ctx, ct); err != nil || !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v (err: %v) but want %v", got, err, now)
+	}
+	if ok, err := s.ContentProcessed(ctx, ct, "abc"); err != nil || !ok {
+		t.Errorf("content abc not processed after reopening (err: %v)", err)
+	}
+	if got, err := s.Metadata(ctx, "tenant-id"); err != nil || got != "1234" {
+		t.Errorf("got tenant-id metadata %q (err: %v) but want %q", got, err, "1234")
+	}
+	if got, err := s.Metadata(ctx, MetadataFormatVersion); err != nil || got != FormatVersion {
+		t.Errorf("got format version %q (err: %v) but want %q", got, err, FormatVersion)
+	}
+}
+
+func TestStateFormatVersion(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "state.db")
+	db, err := bolt.Open(path, 0640, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(bucketMetadata)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(MetadataFormatVersion), []byte("999"))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); !errors.Is(err, ErrFormatVersion) {
+		t.Errorf("got error %v but want %v", err, ErrFormatVersion)
+	}
+}
+
+func TestStateOpenReadOnly(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	path := filepath.Join(dir, "state.db")
+	ct := schema.AuditExchange
+	now := time.Date(2020, 4, 16, 12, 30, 45, 0, time.UTC)
+
+	// a missing database is not created
+	if _, err := OpenReadOnly(path); !os.IsNotExist(err) {
+		t.Fatalf("got error %v but want a missing file", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("database created by OpenReadOnly")
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetLastRequestTime(ctx, ct, now); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got, err := s.LastRequestTime(ctx, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v but want %v", got, now)
+	}
+	if err := s.SetLastRequestTime(ctx, ct, now.Add(time.Hour)); err == nil {
+		t.Errorf("read-only database updated")
+	}
+	if after, err := os.Stat(path); err != nil || !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("read-only database written")
+	}
+}
+
+const intervalOneWeek = 7 * 24 * time.Hour
@@ -0,0 +1,245 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"golang.org/x/oauth2"
+)
+
+// Event is implemented by the events sent by the SubscriptionWatcher on its Events channel.
+type Event interface {
+	// EventTime returns the time the event occurred.
+	EventTime() time.Time
+}
+
+// Window sources.
+const (
+	WindowSourceTail     = "tail"
+	WindowSourceBackfill = "backfill"
+	WindowSourceRescan   = "rescan"
+	WindowSourceRetry    = "retry"
+)
+
+// Operations reported by FetchFailed.
+const (
+	OperationSubscriptions = "subscriptions"
+	OperationContent       = "content"
+	OperationAudit         = "audit"
+	OperationState         = "state"
+)
+
+// SubscriptionsListed is sent once the subscriptions have been listed.
+type SubscriptionsListed struct {
+	Time          time.Time
+	Subscriptions []Subscription
+}
+
+// WindowPlanned is sent when a time window is about to be listed.
+// Source is one of the WindowSource constants.
+type WindowPlanned struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Source      string
+	Start       time.Time
+	End         time.Time
+}
+
+// ContentListed is sent with the number of content blobs listed for a window.
+type ContentListed struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Start       time.Time
+	End         time.Time
+	Count       int
+}
+
+// ContentFetched is sent once the records of a content blob have been fetched.
+type ContentFetched struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	ContentID   string
+	Records     int
+}
+
+// ContentSkipped is sent when a content blob is skipped since it has already been processed.
+type ContentSkipped struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	ContentID   string
+}
+
+// FetchFailed is sent when an operation of the watcher failed.
+// ContentType is nil when listing subscriptions failed,
+// and ContentID is only set when fetching a content blob failed.
+type FetchFailed struct {
+	Time        time.Time
+	ContentType *schema.ContentType
+	ContentID   string
+	Operation   string
+	Kind        ErrorKind
+	Err         error
+}
+
+// CheckpointAdvanced is sent once a checkpoint of a content type has been moved forward.
+type CheckpointAdvanced struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Checkpoint  Checkpoint
+	Value       time.Time
+}
+
+// GapRecorded is sent when a window or content blob that could not be fetched
+// has been recorded in the gap ledger.
+type GapRecorded struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Gap         Gap
+}
+
+// GapRecovered is sent once a gap has been fetched and removed from the gap ledger.
+type GapRecovered struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Gap         Gap
+}
+
+// GapUnrecoverable is sent when a gap expired before it could be fetched.
+type GapUnrecoverable struct {
+	Time        time.Time
+	ContentType schema.ContentType
+	Gap         Gap
+}
+
+// EventTime implements the Event interface.
+func (e SubscriptionsListed) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e WindowPlanned) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e ContentListed) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e ContentFetched) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e ContentSkipped) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e FetchFailed) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e CheckpointAdvanced) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e GapRecorded) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e GapRecovered) EventTime() time.Time { return e.Time }
+
+// EventTime implements the Event interface.
+func (e GapUnrecoverable) EventTime() time.Time { return e.Time }
+
+// ErrorKind classifies the errors reported by FetchFailed.
+type ErrorKind string
+
+// ErrorKind enum.
+const (
+	// ErrorThrottled is returned when the API throttled the request.
+	ErrorThrottled ErrorKind = "throttled"
+	// ErrorUnauthorized is returned when a token could not be obtained,
+	// or when the API refused the token.
+	ErrorUnauthorized ErrorKind = "unauthorized"
+	// ErrorClient is returned when the API refused the request.
+	ErrorClient ErrorKind = "client"
+	// ErrorServer is returned when the API failed to handle the request.
+	ErrorServer ErrorKind = "server"
+	// ErrorNetwork is returned when no response was received.
+	ErrorNetwork ErrorKind = "network"
+	// ErrorOther is returned for every other error, such as State errors.
+	ErrorOther ErrorKind = "other"
+)
+
+// ClassifyError returns the ErrorKind of the provided error.
+func ClassifyError(err error) ErrorKind {
+	var errResp *ErrorResponse
+	if errors.As(err, &errResp) {
+		switch code := errResp.Response.StatusCode; {
+		case code == http.StatusTooManyRequests:
+			return ErrorThrottled
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrorUnauthorized
+		case code >= http.StatusInternalServerError:
+			return ErrorServer
+		default:
+			return ErrorClient
+		}
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return ErrorUnauthorized
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorNetwork
+	}
+	return ErrorOther
+}
+
+// emit sends the event on the Events channel, if any.
+// Events are dropped when the channel is full
+// so that a slow consumer does not hold back the watcher.
+func (s *SubscriptionWatcher) emit(e Event) {
+	if s.Events == nil {
+		return
+	}
+	select {
+	case s.Events <- e:
+	default:
+	}
+}
+
+// fetchFailed emits a FetchFailed event for the provided error.
+// Errors caused by the watcher stopping are not reported.
+func (s *SubscriptionWatcher) fetchFailed(ct *schema.ContentType, contentID, operation string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	s.emit(FetchFailed{
+		Time:        time.Now(),
+		ContentType: ct,
+		ContentID:   contentID,
+		Operation:   operation,
+		Kind:        ClassifyError(err),
+		Err:         err,
+	})
+}
+
+// setCheckpoint moves the checkpoint c of ct forward to t, and emits a CheckpointAdvanced
+// event when the stored checkpoint changed. State ignores times that are not later than
+// the stored one, so the stored checkpoint is read first.
+func (s *SubscriptionWatcher) setCheckpoint(ctx context.Context, ct schema.ContentType, c Checkpoint, t time.Time) error {
+	get, set := s.State.LastRequestTime, s.State.SetLastRequestTime
+	switch c {
+	case CheckpointLastContentCreated:
+		get, set = s.State.LastContentCreated, s.State.SetLastContentCreated
+	case CheckpointBackfillProgress:
+		get, set = s.State.BackfillProgress, s.State.SetBackfillProgress
+	}
+	previous, err := get(ctx, ct)
+	if err != nil {
+		return err
+	}
+	if err := set(ctx, ct, t); err != nil {
+		return err
+	}
+	if t.After(previous) {
+		s.emit(CheckpointAdvanced{Time: time.Now(), ContentType: ct, Checkpoint: c, Value: t})
+	}
+	return nil
+}
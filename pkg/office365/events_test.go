@@ -0,0 +1,169 @@
+package office365
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"golang.org/x/oauth2"
+)
+
+func TestClassifyError(t *testing.T) {
+	errResp := func(code int) error {
+		return &ErrorResponse{Response: &http.Response{StatusCode: code}}
+	}
+	cases := []struct {
+		Err  error
+		Want ErrorKind
+	}{
+		{errResp(http.StatusTooManyRequests), ErrorThrottled},
+		{errResp(http.StatusUnauthorized), ErrorUnauthorized},
+		{errResp(http.StatusForbidden), ErrorUnauthorized},
+		{errResp(http.StatusBadRequest), ErrorClient},
+		{errResp(http.StatusServiceUnavailable), ErrorServer},
+		{fmt.Errorf("wrapped: %w", errResp(http.StatusInternalServerError)), ErrorServer},
+		{&url.Error{Op: "Post", URL: "https://login.windows.net", Err: &oauth2.RetrieveError{}}, ErrorUnauthorized},
+		{&url.Error{Op: "Get", URL: "https://manage.office.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, ErrorNetwork},
+		{errors.New("state unavailable"), ErrorOther},
+	}
+	for idx, c := range cases {
+		if got := ClassifyError(c.Err); got != c.Want {
+			t.Errorf("%d. got %s but want %s for %v", idx+1, got, c.Want, c.Err)
+		}
+	}
+}
+
+func TestWatcherEvents(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Content{
+			{ContentType: ct.String(), ContentID: "fetched", ContentCreated: created.Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "skipped", ContentCreated: created.Add(time.Second).Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "failed", ContentCreated: created.Add(2 * time.Second).Format(CreatedDatetimeFormat)},
+		})
+	})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path[len(url.Path):] == "failed" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]schema.AuditRecord{{ID: String("1"), RecordType: &tp}})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{IncludeContentTypes: []schema.ContentType{ct}})
+	events := make(chan Event, 100)
+	watcher.Events = events
+	if err := watcher.SetContentProcessed(context.Background(), ct, "skipped", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+
+	for sub := range watcher.fetchSubscriptions(context.Background(), done, now) {
+		for r := range watcher.fetchAudits(context.Background(), done, ct, watcher.fetchContent(context.Background(), done, sub)) {
+			r.Ack()
+		}
+	}
+	close(events)
+
+	var got []string
+	var checkpoints []CheckpointAdvanced
+	for e := range events {
+		switch e := e.(type) {
+		case SubscriptionsListed:
+			got = append(got, fmt.Sprintf("subscriptions listed: %d", len(e.Subscriptions)))
+		case WindowPlanned:
+			got = append(got, fmt.Sprintf("window planned: %s %s", e.ContentType.String(), e.Source))
+		case ContentListed:
+			got = append(got, fmt.Sprintf("content listed: %s %d", e.ContentType.String(), e.Count))
+		case ContentFetched:
+			got = append(got, fmt.Sprintf("content fetched: %s %d", e.ContentID, e.Records))
+		case ContentSkipped:
+			got = append(got, fmt.Sprintf("content skipped: %s", e.ContentID))
+		case FetchFailed:
+			got = append(got, fmt.Sprintf("fetch failed: %s %s %s", e.ContentID, e.Operation, e.Kind))
+		case GapRecorded:
+			got = append(got, fmt.Sprintf("gap recorded: %s %d", e.Gap.Key(), e.Gap.Attempts))
+		case CheckpointAdvanced:
+			// checkpoints released together can be committed at once
+			checkpoints = append(checkpoints, e)
+		}
+	}
+
+	testDeep(t, got, []string{
+		"subscriptions listed: 1",
+		"window planned: Audit.Exchange tail",
+		"content listed: Audit.Exchange 3",
+		"content fetched: fetched 1",
+		"content skipped: skipped",
+		"fetch failed: failed audit server",
+		"gap recorded: content/failed 1",
+	})
+	// the failed content is left to the gap ledger, so the window is handled
+	if len(checkpoints) == 0 {
+		t.Fatal("got no checkpoint advanced")
+	}
+	last := checkpoints[len(checkpoints)-1]
+	if last.Checkpoint != CheckpointLastRequestTime || !last.Value.Equal(now) {
+		t.Errorf("got last checkpoint %s %v but want %s %v", last.Checkpoint, last.Value, CheckpointLastRequestTime, now)
+	}
+}
+
+func TestSetCheckpoint(t *testing.T) {
+	client, _, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	events := make(chan Event, 10)
+	watcher.Events = events
+
+	// only times later than the stored checkpoint advance it
+	for _, c := range GetCheckpoints() {
+		for _, tm := range []time.Time{now, now, now.Add(-time.Minute), now.Add(time.Minute)} {
+			if err := watcher.setCheckpoint(context.Background(), ct, c, tm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(events)
+
+	var got []string
+	for e := range events {
+		if e, ok := e.(CheckpointAdvanced); ok {
+			got = append(got, fmt.Sprintf("%s %s", e.Checkpoint, e.Value.Sub(now)))
+		}
+	}
+	testDeep(t, got, []string{
+		"lastContentCreated 0s",
+		"lastContentCreated 1m0s",
+		"lastRequestTime 0s",
+		"lastRequestTime 1m0s",
+		"backfillProgress 0s",
+		"backfillProgress 1m0s",
+	})
+}
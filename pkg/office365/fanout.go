@@ -0,0 +1,330 @@
+package office365
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SinkPolicy decides what happens to the records of a sink which can not keep up,
+// or whose handler stopped.
+type SinkPolicy int
+
+const (
+	// SinkBlock waits for the sink once its buffer is full, holding back every other sink.
+	// The FanOutHandler stops when the handler of the sink returns.
+	SinkBlock SinkPolicy = iota
+	// SinkDrop drops the records of the sink while its buffer is full.
+	// Once the handler of the sink returns, every record sent to it is dropped.
+	// Dropped records are acknowledged, and are lost for this sink.
+	SinkDrop
+	// SinkSpill stores the records of the sink in its Spill while its buffer is full,
+	// and sends them to the sink, in order, once its buffer drains.
+	// Spilled records are acknowledged once stored, and records spilled but not
+	// sent to the sink when the FanOutHandler stops are sent on its next run.
+	// The FanOutHandler stops when the handler of the sink returns,
+	// or when a spilled record can not be read back.
+	SinkSpill
+)
+
+// String returns the name of the policy.
+func (p SinkPolicy) String() string {
+	switch p {
+	case SinkBlock:
+		return "block"
+	case SinkDrop:
+		return "drop"
+	case SinkSpill:
+		return "spill"
+	}
+	return fmt.Sprintf("SinkPolicy(%d)", int(p))
+}
+
+// Spill stores the records of a sink using SinkSpill.
+type Spill interface {
+	// Put stores a record, returning once it is durable.
+	Put(ctx context.Context, r ResourceAudits) error
+	// Get returns the oldest record not yet returned, blocking until one is stored.
+	// The record is removed once acknowledged.
+	Get(ctx context.Context) (ResourceAudits, error)
+	// Depth returns the number of records not yet acknowledged.
+	Depth() int64
+}
+
+// Sink is a handler receiving every record sent to a FanOutHandler.
+// Buffer is the number of records waiting for the handler before Policy applies.
+// Spill must be provided with SinkSpill.
+// Dropped is called, if provided, for each record dropped.
+type Sink struct {
+	Name    string
+	Handler ResourceHandler
+	Buffer  int
+	Policy  SinkPolicy
+	Spill   Spill
+	Dropped func()
+}
+
+// FanOutHandler implements the ResourceHandler interface.
+// It sends every record to each sink, each fed by its own buffer,
+// and acknowledges a record once every sink acknowledged or dropped it.
+type FanOutHandler struct {
+	sinks  []Sink
+	logger Logger
+}
+
+// NewFanOutHandler returns a FanOutHandler sending records to the provided sinks.
+// Nothing is logged when l is nil.
+func NewFanOutHandler(sinks []Sink, l Logger) *FanOutHandler {
+	return &FanOutHandler{sinks: sinks, logger: orNop(l)}
+}
+
+// sinkState holds the buffer of a sink, and whether its handler returned.
+type sinkState struct {
+	// spilled is the number of records spilled but not yet sent to the buffer.
+	// It comes first so that it is 64-bit aligned.
+	spilled int64
+	Sink
+	out      chan ResourceAudits
+	down     chan struct{}
+	err      error
+	dropping bool
+	dropped  uint64
+
+	// used with SinkSpill
+	ctx        context.Context
+	cancel     context.CancelFunc
+	spilling   bool
+	spillErr   error
+	replayDone chan struct{}
+}
+
+// drop acknowledges a record that is not sent to the sink.
+func (s *sinkState) drop(r ResourceAudits) {
+	r.Ack()
+	if s.Dropped != nil {
+		s.Dropped()
+	}
+}
+
+// Handle implements the ResourceHandler interface.
+// It returns once in is closed and every sink handler returned, or when the handler
+// of a sink using SinkBlock or SinkSpill returns, with its error.
+// Records spilled but not sent to their sink by then are left in their Spill.
+// Errors of sinks using SinkDrop are logged.
+func (h *FanOutHandler) Handle(in <-chan ResourceAudits) error {
+	for i, sink := range h.sinks {
+		if sink.Policy == SinkSpill && sink.Spill == nil {
+			return fmt.Errorf("fanout: sink #%d uses the %s policy without a spill", i, SinkSpill)
+		}
+	}
+
+	states := make([]*sinkState, len(h.sinks))
+	// sinks using SinkSpill stop either when their handler returns or their spill fails
+	stopped := make(chan *sinkState, 2*len(h.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range h.sinks {
+		if sink.Name == "" {
+			sink.Name = fmt.Sprintf("#%d", i)
+		}
+		s := &sinkState{
+			Sink: sink,
+			out:  make(chan ResourceAudits, sink.Buffer),
+			down: make(chan struct{}),
+		}
+		states[i] = s
+		if s.Policy == SinkSpill {
+			h.startReplay(s, stopped)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.err = s.Handler.Handle(s.out)
+			close(s.down)
+			if s.Policy != SinkDrop {
+				if s.cancel != nil {
+					s.cancel()
+				}
+				stopped <- s
+				return
+			}
+			if s.err != nil {
+				h.logger.Errorf("fanout: sink %s stopped, dropping its records: %s", s.Name, s.err)
+			}
+			// records left in the buffer and sent until in is closed are dropped
+			for r := range s.out {
+				s.drop(r)
+			}
+		}()
+	}
+
+	var failed *sinkState
+loop:
+	for {
+		var res ResourceAudits
+		select {
+		case r, ok := <-in:
+			if !ok {
+				break loop
+			}
+			res = r
+		case s := <-stopped:
+			failed = s
+			break loop
+		}
+
+		remaining := int32(len(states))
+		if remaining == 0 {
+			res.Ack()
+			continue
+		}
+		shared := res.WithAck(func() {
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				res.Ack()
+			}
+		})
+		for _, s := range states {
+			switch s.Policy {
+			case SinkDrop:
+				h.sendOrDrop(s, shared)
+				continue
+			case SinkSpill:
+				if err := h.sendOrSpill(s, shared); err != nil {
+					// the record is never acknowledged and is fetched again on the next run
+					failed = s
+					break loop
+				}
+				continue
+			}
+			select {
+			case s.out <- shared:
+			case s := <-stopped:
+				// the record is never acknowledged and is fetched again on the next run
+				failed = s
+				break loop
+			}
+		}
+	}
+	for _, s := range states {
+		if s.Policy != SinkSpill {
+			continue
+		}
+		// spilled records not sent yet are left for the next run
+		s.cancel()
+		<-s.replayDone
+	}
+	for _, s := range states {
+		close(s.out)
+	}
+	wg.Wait()
+
+	if failed != nil {
+		err := failed.err
+		if err == nil {
+			err = failed.spillErr
+		}
+		if err == nil {
+			return fmt.Errorf("fanout: sink %s stopped", failed.Name)
+		}
+		h.logger.Errorf("fanout: sink %s: %s", failed.Name, err)
+		return err
+	}
+	for _, s := range states {
+		if s.Policy != SinkDrop && s.err != nil {
+			return s.err
+		}
+	}
+	return nil
+}
+
+// sendOrDrop sends a record to a sink using SinkDrop, unless its buffer is full
+// or its handler returned.
+func (h *FanOutHandler) sendOrDrop(s *sinkState, r ResourceAudits) {
+	select {
+	case <-s.down:
+		s.drop(r)
+		return
+	default:
+	}
+	select {
+	case s.out <- r:
+		if s.dropping {
+			h.logger.Warnf("fanout: sink %s caught up, %d record(s) dropped", s.Name, s.dropped)
+			s.dropping, s.dropped = false, 0
+		}
+	default:
+		if !s.dropping {
+			h.logger.Warnf("fanout: sink %s is full, dropping records", s.Name)
+			s.dropping = true
+		}
+		s.dropped++
+		s.drop(r)
+	}
+}
+
+// sendOrSpill sends a record to a sink using SinkSpill, unless its buffer is full
+// or spilled records are waiting to be sent, in which case the record is spilled.
+// Records that can not be spilled are dropped.
+// It returns an error when the handler of the sink returned while spilling.
+func (h *FanOutHandler) sendOrSpill(s *sinkState, r ResourceAudits) error {
+	if atomic.LoadInt64(&s.spilled) == 0 {
+		select {
+		case s.out <- r:
+			if s.spilling {
+				h.logger.Infof("fanout: sink %s caught up", s.Name)
+				s.spilling = false
+			}
+			return nil
+		default:
+		}
+	}
+	if !s.spilling {
+		h.logger.Warnf("fanout: sink %s is full, spilling records", s.Name)
+		s.spilling = true
+	}
+	if err := s.Spill.Put(s.ctx, r); err != nil {
+		if s.ctx.Err() != nil {
+			return err
+		}
+		h.logger.Errorf("fanout: sink %s: could not spill record, dropping it: %s", s.Name, err)
+		s.drop(r)
+		return nil
+	}
+	atomic.AddInt64(&s.spilled, 1)
+	r.Ack()
+	return nil
+}
+
+// startReplay starts sending the spilled records of a sink using SinkSpill to its buffer,
+// beginning with the records left by a previous run.
+// The sink is sent on stopped when its spill fails.
+func (h *FanOutHandler) startReplay(s *sinkState, stopped chan<- *sinkState) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.replayDone = make(chan struct{})
+	if depth := s.Spill.Depth(); depth > 0 {
+		h.logger.Infof("fanout: sink %s: sending %d spilled record(s)", s.Name, depth)
+		s.spilled = depth
+		s.spilling = true
+	}
+
+	go func() {
+		defer close(s.replayDone)
+		for {
+			r, err := s.Spill.Get(s.ctx)
+			if err != nil {
+				if s.ctx.Err() == nil {
+					s.spillErr = err
+					stopped <- s
+				}
+				return
+			}
+			select {
+			case s.out <- r:
+			case <-s.ctx.Done():
+				// the record is not acknowledged and is sent again on the next run
+				return
+			}
+			atomic.AddInt64(&s.spilled, -1)
+		}
+	}()
+}
@@ -0,0 +1,261 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// fanOutRecords returns a closed channel of n records, acknowledged using acked.
+func fanOutRecords(n int, acked *int32) <-chan ResourceAudits {
+	in := make(chan ResourceAudits, n)
+	for i := 0; i < n; i++ {
+		r := routerRecord(schema.AuditExchange, strconv.Itoa(i), schema.ExchangeAdminType, "Exchange", "Set-Mailbox")
+		in <- r.WithAck(func() { atomic.AddInt32(acked, 1) })
+	}
+	close(in)
+	return in
+}
+
+// stallHandler implements the ResourceHandler interface.
+// It does not read records until released.
+type stallHandler struct {
+	release chan struct{}
+	ackHandler
+}
+
+func (h *stallHandler) Handle(in <-chan ResourceAudits) error {
+	<-h.release
+	return h.ackHandler.Handle(in)
+}
+
+func TestFanOutHandler(t *testing.T) {
+	first, second := &ackHandler{}, &ackHandler{}
+	h := NewFanOutHandler([]Sink{
+		{Name: "first", Handler: first, Buffer: 1},
+		{Name: "second", Handler: second},
+	}, nil)
+
+	var acked int32
+	if err := h.Handle(fanOutRecords(3, &acked)); err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+	testDeep(t, first.ids, []string{"0", "1", "2"})
+	testDeep(t, second.ids, []string{"0", "1", "2"})
+	// records are acknowledged once by every sink
+	if got := atomic.LoadInt32(&acked); got != 3 {
+		t.Errorf("got %d acknowledged records but want 3", got)
+	}
+}
+
+func TestFanOutHandlerDrop(t *testing.T) {
+	siem := &ackHandler{}
+	archive := &stallHandler{release: make(chan struct{})}
+	var dropped int32
+	h := NewFanOutHandler([]Sink{
+		{Name: "siem", Handler: siem},
+		{Name: "archive", Handler: archive, Buffer: 1, Policy: SinkDrop, Dropped: func() { atomic.AddInt32(&dropped, 1) }},
+	}, nil)
+
+	var acked int32
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := h.Handle(fanOutRecords(5, &acked)); err != nil {
+			t.Errorf("Handle: unexpected error: %s", err)
+		}
+	}()
+
+	// the stalled sink does not hold back the other one
+	for atomic.LoadInt32(&acked) < 4 {
+		runtime.Gosched()
+	}
+	close(archive.release)
+	wg.Wait()
+
+	testDeep(t, siem.ids, []string{"0", "1", "2", "3", "4"})
+	testDeep(t, archive.ids, []string{"0"})
+	if got := atomic.LoadInt32(&dropped); got != 4 {
+		t.Errorf("got %d dropped records but want 4", got)
+	}
+	if got := atomic.LoadInt32(&acked); got != 5 {
+		t.Errorf("got %d acknowledged records but want 5", got)
+	}
+}
+
+// memSpill implements the Spill interface in memory.
+// Records returned by Get are counted in acks once acknowledged.
+type memSpill struct {
+	records chan ResourceAudits
+	err     error
+	puts    int32
+	acks    int32
+}
+
+func (s *memSpill) Put(ctx context.Context, r ResourceAudits) error {
+	atomic.AddInt32(&s.puts, 1)
+	s.records <- r.WithAck(func() {})
+	return nil
+}
+
+func (s *memSpill) Get(ctx context.Context) (ResourceAudits, error) {
+	if s.err != nil {
+		return ResourceAudits{}, s.err
+	}
+	select {
+	case r := <-s.records:
+		return r.WithAck(func() { atomic.AddInt32(&s.acks, 1) }), nil
+	case <-ctx.Done():
+		return ResourceAudits{}, ctx.Err()
+	}
+}
+
+func (s *memSpill) Depth() int64 {
+	return int64(len(s.records))
+}
+
+// idsHandler implements the ResourceHandler interface.
+// Once released, it acknowledges the records it receives and sends their ID on ids.
+type idsHandler struct {
+	release chan struct{}
+	ids     chan string
+}
+
+func (h *idsHandler) Handle(in <-chan ResourceAudits) error {
+	<-h.release
+	for r := range in {
+		h.ids <- *r.AuditRecord.(schema.AuditRecord).ID
+		r.Ack()
+	}
+	return nil
+}
+
+func TestFanOutHandlerSpill(t *testing.T) {
+	siem := &ackHandler{}
+	archive := &idsHandler{release: make(chan struct{}), ids: make(chan string, 10)}
+	spill := &memSpill{records: make(chan ResourceAudits, 10)}
+	// records left by a previous run are sent first
+	spill.records <- routerRecord(schema.AuditExchange, "previous", schema.ExchangeAdminType, "Exchange", "Set-Mailbox")
+	h := NewFanOutHandler([]Sink{
+		{Name: "siem", Handler: siem},
+		{Name: "archive", Handler: archive, Buffer: 1, Policy: SinkSpill, Spill: spill},
+	}, nil)
+
+	var acked int32
+	in := make(chan ResourceAudits)
+	handleErr := make(chan error)
+	go func() {
+		handleErr <- h.Handle(in)
+	}()
+	for r := range fanOutRecords(5, &acked) {
+		in <- r
+	}
+
+	// the stalled sink does not hold back the other one, its records are
+	// acknowledged once spilled
+	for atomic.LoadInt32(&acked) < 5 {
+		runtime.Gosched()
+	}
+	if got := atomic.LoadInt32(&spill.puts); got != 5 {
+		t.Errorf("got %d spilled records but want 5", got)
+	}
+
+	// spilled records are sent in order once the buffer drains
+	close(archive.release)
+	var ids []string
+	for range []string{"previous", "0", "1", "2", "3", "4"} {
+		ids = append(ids, <-archive.ids)
+	}
+	testDeep(t, ids, []string{"previous", "0", "1", "2", "3", "4"})
+	close(in)
+	if err := <-handleErr; err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+	testDeep(t, siem.ids, []string{"0", "1", "2", "3", "4"})
+
+	// a sink using SinkSpill stops the handler when its spill fails
+	errSpill := errors.New("spill failed")
+	spill = &memSpill{records: make(chan ResourceAudits, 10), err: errSpill}
+	h = NewFanOutHandler([]Sink{
+		{Name: "archive", Handler: &ackHandler{}, Policy: SinkSpill, Spill: spill},
+	}, nil)
+	if err := h.Handle(make(chan ResourceAudits)); !errors.Is(err, errSpill) {
+		t.Fatalf("Handle: got error %v but want %v", err, errSpill)
+	}
+}
+
+func TestFanOutHandlerSpillClose(t *testing.T) {
+	archive := &idsHandler{release: make(chan struct{}), ids: make(chan string, 10)}
+	spill := &memSpill{records: make(chan ResourceAudits, 10)}
+	h := NewFanOutHandler([]Sink{
+		{Name: "archive", Handler: archive, Buffer: 1, Policy: SinkSpill, Spill: spill},
+	}, nil)
+
+	var acked int32
+	handleErr := make(chan error)
+	go func() {
+		handleErr <- h.Handle(fanOutRecords(5, &acked))
+	}()
+	for atomic.LoadInt32(&spill.puts) < 4 {
+		runtime.Gosched()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// once in is closed, the handler does not wait for the backlog of the slow sink
+	close(archive.release)
+	select {
+	case err := <-handleErr:
+		if err != nil {
+			t.Fatalf("Handle: unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handle waited for the spilled records to be sent")
+	}
+	if got := <-archive.ids; got != "0" || len(archive.ids) > 0 {
+		t.Errorf("got record %s and %d more sent to the sink but want 0 only", got, len(archive.ids))
+	}
+	// spilled records are not acknowledged, and are left for the next run
+	if got := atomic.LoadInt32(&spill.acks); got != 0 {
+		t.Errorf("got %d spilled records acknowledged but want 0", got)
+	}
+	if got := atomic.LoadInt32(&acked); got != 5 {
+		t.Errorf("got %d acknowledged records but want 5", got)
+	}
+}
+
+func TestFanOutHandlerError(t *testing.T) {
+	errSink := errors.New("sink failed")
+
+	// a failed sink using SinkDrop does not stop the other ones
+	siem := &ackHandler{}
+	h := NewFanOutHandler([]Sink{
+		{Name: "archive", Handler: errHandler{errSink}, Policy: SinkDrop},
+		{Name: "siem", Handler: siem},
+	}, nil)
+	var acked int32
+	if err := h.Handle(fanOutRecords(2, &acked)); err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+	testDeep(t, siem.ids, []string{"0", "1"})
+	if got := atomic.LoadInt32(&acked); got != 2 {
+		t.Errorf("got %d acknowledged records but want 2", got)
+	}
+
+	// a failed sink using SinkBlock stops the handler
+	h = NewFanOutHandler([]Sink{
+		{Name: "archive", Handler: errHandler{errSink}},
+		{Name: "siem", Handler: &ackHandler{}},
+	}, nil)
+	in := make(chan ResourceAudits)
+	if err := h.Handle(in); !errors.Is(err, errSink) {
+		t.Fatalf("Handle: got error %v but want %v", err, errSink)
+	}
+}
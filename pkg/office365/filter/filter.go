@@ -0,0 +1,297 @@
+// Package filter evaluates boolean expressions over audit records,
+// to select the records sent to a handler.
+//
+// Expressions compare the fields of a record, named after its json representation,
+// to literals or to other fields:
+//
+//	RecordType == "ExchangeAdmin" && Operation in ["New-InboxRule", "Set-Mailbox"]
+//
+// Nested fields, such as the ones added by extended schemas, are selected using dots,
+// and list elements using their index: Parameters[0].Name. A comparison on a field of
+// a list of objects, such as Parameters.Name, holds when it holds for one of its elements.
+// A missing field is null.
+//
+// Operators, by decreasing precedence:
+//
+//	==, !=, <, <=, >, >=, in, not in, contains, matches
+//	!
+//	&&
+//	||
+//
+// Literals are strings, numbers, true, false, null and lists of literals.
+// matches takes a regular expression. contains tests a substring of a string,
+// or an element of a list.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Filter is a compiled expression.
+type Filter struct {
+	expr string
+	root predicate
+}
+
+// Compile parses the provided expression.
+func Compile(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can not be parsed.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// String returns the expression of the filter.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match returns whether the provided record satisfies the expression.
+// The record is evaluated using its json representation.
+func (f *Filter) Match(record interface{}) (bool, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return false, fmt.Errorf("filter: %s", err)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return false, fmt.Errorf("filter: %s", err)
+	}
+	return f.root(doc), nil
+}
+
+// predicate evaluates a boolean expression over a record.
+type predicate func(doc interface{}) bool
+
+// operand evaluates a value of a comparison over a record.
+type operand func(doc interface{}) interface{}
+
+// anyOf holds the values of a field of the elements of a list.
+type anyOf []interface{}
+
+// candidates returns the values a comparison is evaluated with.
+func candidates(v interface{}) []interface{} {
+	if values, ok := v.(anyOf); ok {
+		return values
+	}
+	return []interface{}{v}
+}
+
+// compare returns a predicate holding when cmp holds for one of the candidates of each operand.
+func compare(left, right operand, cmp func(a, b interface{}) bool) predicate {
+	return func(doc interface{}) bool {
+		for _, a := range candidates(left(doc)) {
+			for _, b := range candidates(right(doc)) {
+				if cmp(a, b) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// order returns the order of a relative to b, and false when they can not be ordered.
+func order(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func ordered(test func(int) bool) func(a, b interface{}) bool {
+	return func(a, b interface{}) bool {
+		o, ok := order(a, b)
+		return ok && test(o)
+	}
+}
+
+func in(a, b interface{}) bool {
+	list, ok := b.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, v := range list {
+		if equal(a, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(a, b interface{}) bool {
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		return ok && strings.Contains(a, b)
+	case []interface{}:
+		return in(b, a)
+	}
+	return false
+}
+
+func not(p predicate) predicate {
+	return func(doc interface{}) bool {
+		return !p(doc)
+	}
+}
+
+// truthy returns a predicate holding when the provided operand is true.
+func truthy(o operand) predicate {
+	return func(doc interface{}) bool {
+		for _, v := range candidates(o(doc)) {
+			if v == true {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// segment selects a field by name, or a list element by index when name is empty.
+type segment struct {
+	name  string
+	index int
+}
+
+// field returns an operand selecting the provided path.
+func field(path []segment) operand {
+	return func(doc interface{}) interface{} {
+		v := doc
+		for _, s := range path {
+			v = selectSegment(v, s)
+		}
+		return v
+	}
+}
+
+func selectSegment(v interface{}, s segment) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if s.name == "" {
+			return nil
+		}
+		if value, ok := v[s.name]; ok {
+			return value
+		}
+		for k, value := range v {
+			if strings.EqualFold(k, s.name) {
+				return value
+			}
+		}
+	case []interface{}:
+		if s.name == "" {
+			if s.index < 0 || s.index >= len(v) {
+				return nil
+			}
+			return v[s.index]
+		}
+		return selectAll(anyOf(v), s)
+	case anyOf:
+		return selectAll(v, s)
+	}
+	return nil
+}
+
+// selectAll selects the provided segment of every value, flattening lists.
+func selectAll(values anyOf, s segment) interface{} {
+	var result anyOf
+	for _, value := range values {
+		switch selected := selectSegment(value, s).(type) {
+		case nil:
+		case anyOf:
+			result = append(result, selected...)
+		default:
+			result = append(result, selected)
+		}
+	}
+	return result
+}
+
+func literal(v interface{}) operand {
+	return func(interface{}) interface{} {
+		return v
+	}
+}
+
+// comparison returns the predicate of the provided comparison operator.
+func comparison(op string, left, right operand, pattern *regexp.Regexp) predicate {
+	switch op {
+	case "==":
+		return compare(left, right, equal)
+	case "!=":
+		return not(compare(left, right, equal))
+	case "<":
+		return compare(left, right, ordered(func(o int) bool { return o < 0 }))
+	case "<=":
+		return compare(left, right, ordered(func(o int) bool { return o <= 0 }))
+	case ">":
+		return compare(left, right, ordered(func(o int) bool { return o > 0 }))
+	case ">=":
+		return compare(left, right, ordered(func(o int) bool { return o >= 0 }))
+	case "in":
+		return compare(left, right, in)
+	case "not in":
+		return not(compare(left, right, in))
+	case "contains":
+		return compare(left, right, contains)
+	case "matches":
+		return compare(left, literal(nil), func(a, _ interface{}) bool {
+			s, ok := a.(string)
+			return ok && pattern.MatchString(s)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func str(v string) *string { return &v }
+
+func recordType(t schema.AuditLogRecordType) *schema.AuditLogRecordType { return &t }
+
+func TestMatch(t *testing.T) {
+	record := schema.ExchangeAdmin{
+		AuditRecord: schema.AuditRecord{
+			ID:         str("1"),
+			RecordType: recordType(schema.ExchangeAdminType),
+			Operation:  str("New-InboxRule"),
+			UserID:     str("admin@example.com"),
+			Workload:   str("Exchange"),
+		},
+		Parameters: []schema.NameValuePair{
+			{Name: str("Name"), Value: str("forward")},
+			{Name: str("ForwardTo"), Value: str("someone@external.com")},
+		},
+		ModifiedProperties: []string{"ForwardTo", "Enabled"},
+	}
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`RecordType == "ExchangeAdmin" && Operation in ["New-InboxRule", "Set-Mailbox"]`, true},
+		{`RecordType == "ExchangeAdmin" && Operation in ["Set-Mailbox"]`, false},
+		{`Operation not in ["Set-Mailbox"]`, true},
+		{`Workload != "Exchange" || UserId matches "@example\\.com$"`, true},
+		{`!(Workload == "Exchange")`, false},
+		{`userid contains "admin"`, true},
+		{`ModifiedProperties contains "Enabled"`, true},
+		// nested fields of extended schemas
+		{`Parameters[1].Value == "someone@external.com"`, true},
+		{`Parameters[2].Value == null`, true},
+		{`Parameters.Name == "ForwardTo"`, true},
+		{`Parameters.Name != "ForwardTo"`, false},
+		{`Parameters.Value matches "@external\\.com$" && Parameters.Name == "Name"`, true},
+		{`Missing == null && Missing.Nested == null`, true},
+		{`ExternalAccess == null && !ExternalAccess`, true},
+		{`Operation >= "New" && Operation < "O"`, true},
+		{`Operation > 1`, false},
+	}
+	for _, c := range cases {
+		f, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.expr, err)
+			continue
+		}
+		got, err := f.Match(record)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.expr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %t but want %t", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{``, "unexpected end of expression"},
+		{`Operation ==`, "unexpected end of expression"},
+		{`Operation == "Set-Mailbox`, "unterminated string"},
+		{`Operation in ["a" "b"]`, `unexpected "b" at position 18`},
+		{`Operation not ["a"]`, `unexpected "[" at position 14`},
+		{`Operation matches "("`, "invalid regular expression"},
+		{`Operation matches Workload`, "matches expects a string"},
+		{`(Operation == "a"`, "unexpected end of expression"},
+		{`Operation == "a" Workload`, `unexpected "Workload" at position 17`},
+		{`Parameters[a]`, "invalid index"},
+		{`Operation = "a"`, `unexpected character '='`},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.expr)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v but want %q", c.expr, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"errors"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+)
+
+// Handler implements the office365.ResourceHandler interface.
+// It sends the records matching its filter to the next handler,
+// and acknowledges the other ones.
+type Handler struct {
+	filter *Filter
+	next   office365.ResourceHandler
+	logger office365.Logger
+}
+
+// NewHandler returns a Handler sending the records matching f to next.
+// Nothing is logged when l is nil.
+func NewHandler(f *Filter, next office365.ResourceHandler, l office365.Logger) *Handler {
+	if l == nil {
+		l = office365.NopLogger{}
+	}
+	return &Handler{filter: f, next: next, logger: l}
+}
+
+// Handle implements the office365.ResourceHandler interface.
+// It returns once in is closed and the next handler returned, or when the next handler returns.
+// Records that can not be evaluated are logged and acknowledged.
+func (h *Handler) Handle(in <-chan office365.ResourceAudits) error {
+	out := make(chan office365.ResourceAudits)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.next.Handle(out)
+	}()
+
+	stopped := func(err error) error {
+		if err == nil {
+			err = errors.New("filter: next handler stopped")
+		}
+		return err
+	}
+	for {
+		var res office365.ResourceAudits
+		select {
+		case r, ok := <-in:
+			if !ok {
+				close(out)
+				return <-done
+			}
+			res = r
+		case err := <-done:
+			return stopped(err)
+		}
+
+		match, err := h.filter.Match(res.AuditRecord)
+		if err != nil {
+			h.logger.WithField("content-type", res.ContentType.String()).Errorf("%s", err)
+		}
+		if !match {
+			res.Ack()
+			continue
+		}
+		select {
+		case out <- res:
+		case err := <-done:
+			return stopped(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// ackHandler implements the office365.ResourceHandler interface.
+// It acknowledges and records the ID of every record it receives.
+type ackHandler struct {
+	ids []string
+	err error
+}
+
+func (h *ackHandler) Handle(in <-chan office365.ResourceAudits) error {
+	if h.err != nil {
+		return h.err
+	}
+	for r := range in {
+		h.ids = append(h.ids, *r.AuditRecord.(schema.AuditRecord).ID)
+		r.Ack()
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	ct := schema.AuditExchange
+	operations := []string{"Set-Mailbox", "MailItemsAccessed", "New-InboxRule"}
+	in := make(chan office365.ResourceAudits, len(operations))
+	var acked int32
+	for i, op := range operations {
+		r := office365.ResourceAudits{
+			ContentType: &ct,
+			AuditRecord: schema.AuditRecord{ID: str(string(rune('1' + i))), Operation: str(op)},
+		}
+		in <- r.WithAck(func() { atomic.AddInt32(&acked, 1) })
+	}
+	close(in)
+
+	next := &ackHandler{}
+	h := NewHandler(MustCompile(`Operation in ["Set-Mailbox", "New-InboxRule"]`), next, nil)
+	if err := h.Handle(in); err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+	if got, want := next.ids, []string{"1", "3"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got records %v but want %v", got, want)
+	}
+	// filtered records are acknowledged
+	if got := atomic.LoadInt32(&acked); int(got) != len(operations) {
+		t.Errorf("got %d acknowledged records but want %d", got, len(operations))
+	}
+
+	// the handler stops with the next handler
+	errNext := errors.New("next failed")
+	h = NewHandler(MustCompile(`true`), &ackHandler{err: errNext}, nil)
+	if err := h.Handle(make(chan office365.ResourceAudits)); !errors.Is(err, errNext) {
+		t.Fatalf("Handle: got error %v but want %v", err, errNext)
+	}
+}
@@ -0,0 +1,326 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are sorted so that longer operators are matched first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+// lex splits the provided expression into tokens.
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at position %d: %s", i, err)
+			}
+			tokens = append(tokens, token{tokenString, s, i})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(expr) && (unicode.IsDigit(rune(expr[end])) || expr[end] == '.') {
+				end++
+			}
+			if _, err := strconv.ParseFloat(expr[i:end], 64); err != nil {
+				return nil, fmt.Errorf("filter: invalid number %q at position %d", expr[i:end], i)
+			}
+			tokens = append(tokens, token{tokenNumber, expr[i:end], i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(expr) && (expr[end] == '_' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, expr[i:end], i})
+			i = end
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("filter: unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{tokenOperator, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(expr)}), nil
+}
+
+// parser builds the predicate of an expression using recursive descent.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token when it is the provided operator or keyword.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return fmt.Errorf("filter: unexpected end of expression")
+	}
+	return fmt.Errorf("filter: unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseOr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc interface{}) bool { return l(doc) || right(doc) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (predicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc interface{}) bool { return l(doc) && right(doc) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (predicate, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not(operand), nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (predicate, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	op := ""
+	switch {
+	case t.kind == tokenOperator && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		op = t.text
+	case t.kind == tokenIdent && (t.text == "in" || t.text == "contains" || t.text == "matches"):
+		op = t.text
+	case t.kind == tokenIdent && t.text == "not":
+		p.next()
+		if t := p.peek(); !(t.kind == tokenIdent && t.text == "in") {
+			return nil, p.unexpected(t)
+		}
+		op = "not in"
+	default:
+		// a bare operand holds when it is true
+		return truthy(left), nil
+	}
+	p.next()
+
+	if op == "matches" {
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, fmt.Errorf("filter: matches expects a string at position %d", t.pos)
+		}
+		pattern, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid regular expression at position %d: %s", t.pos, err)
+		}
+		return comparison(op, left, nil, pattern), nil
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison(op, left, right, nil), nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenOperator && t.text == "[":
+		v, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return literal(v), nil
+	case t.kind == tokenIdent && !isKeyword(t.text):
+		return p.parseField()
+	}
+	v, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return literal(v), nil
+}
+
+// parseLiteral parses a string, number, boolean, null or list.
+func (p *parser) parseLiteral() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return f, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	case tokenOperator:
+		if t.text == "[" {
+			p.pos--
+			return p.parseList()
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *parser) parseList() ([]interface{}, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	list := []interface{}{}
+	if p.accept("]") {
+		return list, nil
+	}
+	for {
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		if p.accept("]") {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseField parses a path of field names and list indexes.
+func (p *parser) parseField() (operand, error) {
+	path := []segment{{name: p.next().text}}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokenIdent {
+				return nil, p.unexpected(t)
+			}
+			path = append(path, segment{name: t.text})
+		case p.accept("["):
+			t := p.next()
+			index, err := strconv.Atoi(t.text)
+			if t.kind != tokenNumber || err != nil {
+				return nil, fmt.Errorf("filter: invalid index at position %d", t.pos)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, segment{index: index})
+		default:
+			return field(path), nil
+		}
+	}
+}
+
+func isKeyword(s string) bool {
+	switch s {
+	case "true", "false", "null", "in", "not", "contains", "matches":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,414 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+var (
+	// gapRetryInterval is the interval at which the gap ledger is checked for gaps to retry.
+	gapRetryInterval = time.Minute
+
+	// gapBackoffMin and gapBackoffMax bound the delay between two attempts at fetching a gap.
+	// The delay doubles with every failed attempt.
+	gapBackoffMin = time.Minute
+	gapBackoffMax = time.Hour
+
+	// gapKeyFormat formats the bounds of window gaps so that keys sort in time order.
+	gapKeyFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// GapKind identifies what a Gap covers.
+type GapKind string
+
+// GapKind enum.
+const (
+	// GapWindow is a time window whose content could not be listed.
+	GapWindow GapKind = "window"
+	// GapContent is a content blob whose records could not be fetched.
+	GapContent GapKind = "content"
+)
+
+// Gap is a time window or a content blob the watcher failed to fetch.
+// It is recorded in a GapLedger and retried until it expires.
+type Gap struct {
+	Kind GapKind `json:"kind"`
+
+	// Start and End delimit the time window of a GapWindow.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// ContentID identifies the content blob of a GapContent,
+	// created and expiring at the provided times.
+	ContentID  string    `json:"contentId,omitempty"`
+	Created    time.Time `json:"contentCreated"`
+	Expiration time.Time `json:"contentExpiration"`
+
+	// FirstFailed is the time of the first failed attempt.
+	FirstFailed time.Time `json:"firstFailed"`
+	// Attempts is the number of failed attempts.
+	Attempts int `json:"attempts"`
+	// NextAttempt is the time after which the gap is retried.
+	NextAttempt time.Time `json:"nextAttempt"`
+	// LastError is the error of the last failed attempt.
+	LastError string `json:"lastError"`
+	// Unrecoverable is set once the gap expired before being fetched.
+	// Unrecoverable gaps are kept for reporting and never retried.
+	Unrecoverable bool `json:"unrecoverable,omitempty"`
+}
+
+// Key returns the key identifying the gap within the ledger of its content type.
+func (g Gap) Key() string {
+	if g.Kind == GapContent {
+		return string(GapContent) + "/" + g.ContentID
+	}
+	return fmt.Sprintf("%s/%s/%s", GapWindow, g.Start.UTC().Format(gapKeyFormat), g.End.UTC().Format(gapKeyFormat))
+}
+
+// String returns a description of the gap.
+func (g Gap) String() string {
+	if g.Kind == GapContent {
+		return fmt.Sprintf("content %s created %s", g.ContentID, g.Created.String())
+	}
+	return fmt.Sprintf("window %s - %s", g.Start.String(), g.End.String())
+}
+
+// expired returns whether the gap can no longer be fetched at the provided time.
+// Content can only be listed up to 7 days in the past, so a window expires once
+// its end is past that limit, and content blobs can only be fetched until their expiration.
+func (g Gap) expired(now time.Time) bool {
+	if g.Kind == GapContent {
+		return !g.Expiration.After(now)
+	}
+	return !g.End.After(now.Add(-intervalOneWeek).Add(backfillMargin))
+}
+
+// stateError is an error of a State operation. It is a local failure rather than
+// content missing from the API, so it is never recorded as a gap.
+type stateError struct {
+	err error
+}
+
+func (e *stateError) Error() string { return e.err.Error() }
+
+func (e *stateError) Unwrap() error { return e.err }
+
+// gapBackoff returns the delay before the next attempt
+// at fetching a gap that failed the provided number of times.
+func gapBackoff(attempts int) time.Duration {
+	d := gapBackoffMin
+	for i := 1; i < attempts && d < gapBackoffMax; i++ {
+		d *= 2
+	}
+	if d > gapBackoffMax {
+		d = gapBackoffMax
+	}
+	return d
+}
+
+// gaps holds the gaps per content type and key.
+type gaps struct {
+	mu sync.RWMutex
+	m  map[schema.ContentType]map[string]Gap
+}
+
+func newGaps() *gaps {
+	return &gaps{m: make(map[schema.ContentType]map[string]Gap)}
+}
+
+// list returns the gaps of ct sorted by key.
+func (g *gaps) list(ct schema.ContentType) []Gap {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	keys := make([]string, 0, len(g.m[ct]))
+	for k := range g.m[ct] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []Gap
+	for _, k := range keys {
+		out = append(out, g.m[ct][k])
+	}
+	return out
+}
+
+func (g *gaps) set(ct schema.ContentType, gap Gap) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.m[ct] == nil {
+		g.m[ct] = make(map[string]Gap)
+	}
+	g.m[ct][gap.Key()] = gap
+}
+
+func (g *gaps) delete(ct schema.ContentType, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.m[ct], key)
+}
+
+// copyOne returns a copy of the gaps of ct, or nil when there is none.
+func (g *gaps) copyOne(ct schema.ContentType) map[string]Gap {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if len(g.m[ct]) == 0 {
+		return nil
+	}
+	out := make(map[string]Gap, len(g.m[ct]))
+	for k, gap := range g.m[ct] {
+		out[k] = gap
+	}
+	return out
+}
+
+// replaceOne replaces the gaps of ct.
+func (g *gaps) replaceOne(ct schema.ContentType, m map[string]Gap) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(m) == 0 {
+		delete(g.m, ct)
+		return
+	}
+	g.m[ct] = m
+}
+
+// gapLedger returns the State as a GapLedger, if it implements it.
+func (s *SubscriptionWatcher) gapLedger() (GapLedger, bool) {
+	ledger, ok := s.State.(GapLedger)
+	return ledger, ok
+}
+
+// recordGap records a window or content blob that could not be fetched
+// so that it is retried until it expires. A window gap contiguous to an open one
+// is merged with it, up to 24 hours, so that a long outage does not flood the ledger.
+// Errors of State operations are not recorded, so that the caller fails and retries.
+// It returns whether the gap was recorded, in which case the caller can move past it.
+func (s *SubscriptionWatcher) recordGap(ctLogger Logger, ct schema.ContentType, g Gap, err error) bool {
+	ledger, ok := s.gapLedger()
+	var serr *stateError
+	if !ok || errors.Is(err, context.Canceled) || errors.As(err, &serr) {
+		return false
+	}
+	existing, lerr := ledger.Gaps(stateContext, ct)
+	if lerr != nil {
+		ctLogger.Errorf("could not get gaps: %s", lerr)
+		s.fetchFailed(&ct, g.ContentID, OperationState, lerr)
+		return false
+	}
+
+	now := time.Now()
+	g.FirstFailed = now
+	var merged string
+	for _, e := range existing {
+		if e.Unrecoverable || e.Kind != g.Kind {
+			continue
+		}
+		switch {
+		case g.Kind == GapContent && e.ContentID == g.ContentID:
+		case g.Kind == GapWindow && e.End.Equal(g.Start) && g.End.Sub(e.Start) <= intervalOneDay:
+			g.Start = e.Start
+			merged = e.Key()
+		default:
+			continue
+		}
+		g.FirstFailed = e.FirstFailed
+		g.Attempts = e.Attempts
+		break
+	}
+	g.Attempts++
+	g.LastError = err.Error()
+	g.NextAttempt = now.Add(gapBackoff(g.Attempts))
+
+	if err := ledger.SetGap(stateContext, ct, g); err != nil {
+		ctLogger.Errorf("could not record gap %s: %s", g.String(), err)
+		s.fetchFailed(&ct, g.ContentID, OperationState, err)
+		return false
+	}
+	if merged != "" {
+		if err := ledger.DeleteGap(stateContext, ct, merged); err != nil {
+			ctLogger.Errorf("could not delete merged gap %s: %s", merged, err)
+			s.fetchFailed(&ct, "", OperationState, err)
+		}
+	}
+	ctLogger.Warnf("recorded gap %s, will retry at %s", g.String(), g.NextAttempt.String())
+	s.Metrics.GapRecorded(ct, g.Kind)
+	s.emit(GapRecorded{Time: now, ContentType: ct, Gap: g})
+	return true
+}
+
+// runGapRetry retries the gaps of the selected content types
+// every gapRetryInterval until the watcher stops.
+func (s *SubscriptionWatcher) runGapRetry(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ledger GapLedger) {
+	ticker := time.NewTicker(gapRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case t := <-ticker.C:
+			s.retryGaps(ctx, done, out, ledger, s.Config().ContentTypes(), t)
+		}
+	}
+}
+
+// retryGaps fetches the gaps of the provided content types whose next attempt is due,
+// and forgets the ones fetched successfully. Gaps that expired before being fetched
+// are marked unrecoverable and reported.
+func (s *SubscriptionWatcher) retryGaps(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ledger GapLedger, contentTypes []schema.ContentType, now time.Time) {
+	s.logger.Debugf("retryGaps: start")
+
+	for _, ct := range contentTypes {
+		ctLogger := s.logger.WithField("content-type", ct.String())
+
+		gaps, err := ledger.Gaps(ctx, ct)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctLogger.Errorf("retryGaps: could not get gaps: %s", err)
+			}
+			s.fetchFailed(&ct, "", OperationState, err)
+			continue
+		}
+		for _, g := range gaps {
+			if s.stopped() {
+				return
+			}
+			if g.Unrecoverable {
+				continue
+			}
+			if g.expired(now) {
+				s.gapUnrecoverable(ctLogger, ledger, ct, g)
+				continue
+			}
+			if g.NextAttempt.After(now) {
+				continue
+			}
+
+			ctLogger.Debugf("retryGaps: retrying %s", g.String())
+			if err := s.fetchGap(ctx, done, out, ct, g, now); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+				g.Attempts++
+				g.LastError = err.Error()
+				g.NextAttempt = now.Add(gapBackoff(g.Attempts))
+				ctLogger.Warnf("retryGaps: %s failed %d time(s), will retry at %s: %s", g.String(), g.Attempts, g.NextAttempt.String(), err)
+				if err := ledger.SetGap(stateContext, ct, g); err != nil {
+					ctLogger.Errorf("retryGaps: could not update gap %s: %s", g.String(), err)
+					s.fetchFailed(&ct, g.ContentID, OperationState, err)
+				}
+				continue
+			}
+			if err := ledger.DeleteGap(stateContext, ct, g.Key()); err != nil {
+				ctLogger.Errorf("retryGaps: could not delete gap %s: %s", g.String(), err)
+				s.fetchFailed(&ct, g.ContentID, OperationState, err)
+				continue
+			}
+			ctLogger.Infof("retryGaps: recovered %s after %d failed attempt(s)", g.String(), g.Attempts)
+			s.Metrics.GapRecovered(ct, g.Kind)
+			s.emit(GapRecovered{Time: time.Now(), ContentType: ct, Gap: g})
+		}
+	}
+	s.logger.Debugf("retryGaps: end")
+}
+
+// fetchGap sends the audit records of the gap that have not been processed yet,
+// and returns once every record has been acknowledged.
+func (s *SubscriptionWatcher) fetchGap(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ct schema.ContentType, g Gap, now time.Time) error {
+	switch g.Kind {
+	case GapWindow:
+		// the part of the window past the 7 days limit is lost,
+		// the rest of it can still be fetched
+		start := g.Start
+		if earliest := now.Add(-intervalOneWeek).Add(backfillMargin); start.Before(earliest) {
+			s.logger.WithField("content-type", ct.String()).Warnf("retryGaps: %s is partly expired, fetching from %s", g.String(), earliest.String())
+			start = earliest
+		}
+		_, err := s.fetchWindow(ctx, done, out, ct, WindowSourceRetry, start, g.End, now)
+		return err
+	case GapContent:
+		return s.fetchGapContent(ctx, done, out, ct, g, now)
+	}
+	return fmt.Errorf("unknown gap kind: %s", g.Kind)
+}
+
+// fetchGapContent sends the audit records of the content blob of the gap,
+// unless it has been processed since, and returns once every record has been acknowledged.
+func (s *SubscriptionWatcher) fetchGapContent(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ct schema.ContentType, g Gap, now time.Time) error {
+	ctLogger := s.logger.WithField("content-type", ct.String())
+
+	processed, err := s.State.ContentProcessed(ctx, ct, g.ContentID)
+	if err != nil {
+		s.fetchFailed(&ct, g.ContentID, OperationState, err)
+		return err
+	}
+	if processed {
+		ctLogger.Debugf("fetchGapContent: content skipped: %s already processed", g.ContentID)
+		s.contentSkipped(ct, g.ContentID)
+		return nil
+	}
+
+	_, audits, err := s.getClient().Audit.List(ctx, g.ContentID, s.Config().AddExtendedSchemas)
+	if err != nil {
+		s.fetchFailed(&ct, g.ContentID, OperationAudit, err)
+		return err
+	}
+	s.contentFetched(ct, g.ContentID, len(audits))
+
+	res := ResourceContent{
+		ContentType: &ct,
+		RequestTime: now,
+		Content:     Content{ContentType: ct.String(), ContentID: g.ContentID},
+		created:     g.Created,
+		expiration:  g.Expiration,
+	}
+	handled := make(chan struct{})
+	a := newAcker(len(audits), func() {
+		s.setContentProcessed(ctLogger, res)
+		close(handled)
+	})
+	for _, audit := range audits {
+		r := ResourceAudits{
+			ContentType: &ct,
+			RequestTime: now,
+			AuditRecord: audit,
+			ack:         a.ackFunc(),
+		}
+		if !s.send(done, out, r) {
+			return context.Canceled
+		}
+	}
+	select {
+	case <-done:
+		return context.Canceled
+	case <-handled:
+	}
+	return nil
+}
+
+// gapUnrecoverable marks the gap as unrecoverable and reports it,
+// as the records it holds are no longer available.
+func (s *SubscriptionWatcher) gapUnrecoverable(ctLogger Logger, ledger GapLedger, ct schema.ContentType, g Gap) {
+	g.Unrecoverable = true
+	if err := ledger.SetGap(stateContext, ct, g); err != nil {
+		ctLogger.Errorf("retryGaps: could not update gap %s: %s", g.String(), err)
+		s.fetchFailed(&ct, g.ContentID, OperationState, err)
+		return
+	}
+	ctLogger.Errorf("retryGaps: UNRECOVERABLE GAP: %s expired after %d failed attempt(s) since %s, its records are lost: %s",
+		g.String(), g.Attempts, g.FirstFailed.String(), g.LastError)
+	s.Metrics.GapUnrecoverable(ct, g.Kind)
+	s.emit(GapUnrecoverable{Time: time.Now(), ContentType: ct, Gap: g})
+}
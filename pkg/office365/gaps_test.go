@@ -0,0 +1,307 @@
+package office365
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestGapBackoff(t *testing.T) {
+	cases := []struct {
+		Attempts int
+		Want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+	for _, c := range cases {
+		if got := gapBackoff(c.Attempts); got != c.Want {
+			t.Errorf("gapBackoff(%d): got %s but want %s", c.Attempts, got, c.Want)
+		}
+	}
+}
+
+func TestRecordGap(t *testing.T) {
+	client, _, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditGeneral
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	ctx := context.Background()
+	logger := watcher.logger
+	errFailed := errors.New("failed")
+	t0 := time.Now().Add(-time.Hour).UTC()
+
+	// contiguous windows are merged, up to 24 hours
+	watcher.recordGap(logger, ct, Gap{Kind: GapWindow, Start: t0, End: t0.Add(time.Hour)}, errFailed)
+	watcher.recordGap(logger, ct, Gap{Kind: GapWindow, Start: t0.Add(time.Hour), End: t0.Add(2 * time.Hour)}, errFailed)
+	watcher.recordGap(logger, ct, Gap{Kind: GapWindow, Start: t0.Add(2 * time.Hour), End: t0.Add(25 * time.Hour)}, errFailed)
+	// content failing again is not recorded twice
+	watcher.recordGap(logger, ct, Gap{Kind: GapContent, ContentID: "abc"}, errFailed)
+	watcher.recordGap(logger, ct, Gap{Kind: GapContent, ContentID: "abc"}, errFailed)
+	// the watcher stopping is not a failure
+	if watcher.recordGap(logger, ct, Gap{Kind: GapContent, ContentID: "def"}, context.Canceled) {
+		t.Errorf("recordGap: recorded a cancellation")
+	}
+	// failures of the state are not gaps in the data of the API
+	if watcher.recordGap(logger, ct, Gap{Kind: GapContent, ContentID: "def"}, &stateError{errFailed}) {
+		t.Errorf("recordGap: recorded a failure of the state")
+	}
+
+	gaps, err := watcher.State.(GapLedger).Gaps(ctx, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range gaps {
+		got = append(got, g.String())
+		if g.LastError != errFailed.Error() {
+			t.Errorf("%s: got last error %q but want %q", g.String(), g.LastError, errFailed.Error())
+		}
+	}
+	testDeep(t, got, []string{
+		Gap{Kind: GapContent, ContentID: "abc"}.String(),
+		Gap{Kind: GapWindow, Start: t0, End: t0.Add(2 * time.Hour)}.String(),
+		Gap{Kind: GapWindow, Start: t0.Add(2 * time.Hour), End: t0.Add(25 * time.Hour)}.String(),
+	})
+	if gaps[0].Attempts != 2 || gaps[1].Attempts != 2 || gaps[2].Attempts != 1 {
+		t.Errorf("got attempts %d, %d, %d but want 2, 2, 1", gaps[0].Attempts, gaps[1].Attempts, gaps[2].Attempts)
+	}
+}
+
+// contentStateFailing is a MemoryState whose ContentProcessed fails.
+type contentStateFailing struct {
+	*MemoryState
+	err error
+}
+
+func (s contentStateFailing) ContentProcessed(ctx context.Context, ct schema.ContentType, contentID string) (bool, error) {
+	return false, s.err
+}
+
+func TestWatcherGapsStateError(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	stubContentPipeline(t, mux, client, []Content{
+		{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Format(CreatedDatetimeFormat)},
+	}, nil)
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	state := contentStateFailing{MemoryState: NewMemoryState(), err: errors.New("disk full")}
+	watcher.State = state
+	ctx := context.Background()
+	done := make(chan struct{})
+	defer close(done)
+
+	// the window fails so that it is retried, rather than moving past the content
+	res := ResourceSubscription{ContentType: &ct, RequestTime: now}
+	for r := range watcher.fetchAudits(ctx, done, ct, watcher.fetchContent(ctx, done, res)) {
+		r.Ack()
+	}
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.IsZero() {
+		t.Errorf("got lastRequestTime %v after a failure of the state but want it unchanged", got)
+	}
+	if gaps, err := state.Gaps(ctx, ct); err != nil || len(gaps) != 0 {
+		t.Errorf("got gaps %+v (%v) after a failure of the state but want none", gaps, err)
+	}
+}
+
+func TestWatcherGaps(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	var listed int32
+	var failing int32 = 1
+	url := client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		// only the first listing fails
+		if atomic.AddInt32(&listed, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]Content{
+			{ContentType: ct.String(), ContentID: "good", ContentCreated: created.Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "bad", ContentCreated: created.Add(time.Second).Format(CreatedDatetimeFormat)},
+		})
+	})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		contentID := r.URL.Path[len(url.Path):]
+		if contentID == "bad" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		id := "1"
+		if contentID == "bad" {
+			id = "2"
+		}
+		json.NewEncoder(w).Encode([]schema.AuditRecord{{ID: String(id), RecordType: &tp}})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	metrics := &recordingMetrics{}
+	watcher.Metrics = metrics
+	ledger := watcher.State.(GapLedger)
+	ctx := context.Background()
+	done := make(chan struct{})
+	defer close(done)
+
+	run := func(requestTime time.Time) []string {
+		var ids []string
+		res := ResourceSubscription{ContentType: &ct, RequestTime: requestTime}
+		for r := range watcher.fetchAudits(ctx, done, ct, watcher.fetchContent(ctx, done, res)) {
+			ids = append(ids, *r.AuditRecord.(schema.AuditRecord).ID)
+			r.Ack()
+		}
+		return ids
+	}
+
+	// the window that could not be listed is left to the ledger
+	testDeep(t, run(now), []string(nil))
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v after a failed window but want %v", got, now)
+	}
+	// and so is the content that could not be fetched
+	next := now.Add(time.Second)
+	testDeep(t, run(next), []string{"1"})
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.Equal(next) {
+		t.Errorf("got lastRequestTime %v after a failed content but want %v", got, next)
+	}
+	gaps, err := ledger.Gaps(ctx, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 2 || gaps[0].Key() != "content/bad" || gaps[1].Kind != GapWindow {
+		t.Fatalf("got gaps %+v but want content bad and a window", gaps)
+	}
+
+	retry := func(at time.Time) []string {
+		out := make(chan ResourceAudits)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			watcher.retryGaps(ctx, done, out, ledger, []schema.ContentType{ct}, at)
+		}()
+		var ids []string
+		for {
+			select {
+			case r := <-out:
+				ids = append(ids, *r.AuditRecord.(schema.AuditRecord).ID)
+				r.Ack()
+			case <-finished:
+				return ids
+			}
+		}
+	}
+
+	// gaps are not retried before their next attempt
+	testDeep(t, retry(time.Now()), []string(nil))
+	// gaps failing again are retried later
+	testDeep(t, retry(time.Now().Add(time.Hour)), []string(nil))
+	gaps, _ = ledger.Gaps(ctx, ct)
+	if len(gaps) != 2 || gaps[0].Attempts != 2 {
+		t.Fatalf("got gaps %+v after a failed retry but want 2 attempts", gaps)
+	}
+
+	// gaps are recovered once the content can be fetched
+	atomic.StoreInt32(&failing, 0)
+	testDeep(t, retry(time.Now().Add(2*time.Hour)), []string{"2"})
+	if gaps, _ := ledger.Gaps(ctx, ct); len(gaps) != 0 {
+		t.Errorf("got gaps %+v after recovering them", gaps)
+	}
+	if ok, _ := watcher.ContentProcessed(ctx, ct, "bad"); !ok {
+		t.Errorf("recovered content not recorded as processed")
+	}
+
+	// expired gaps are reported once
+	expired := Gap{Kind: GapContent, ContentID: "expired", Expiration: now.Add(-time.Minute), Attempts: 3}
+	if err := ledger.SetGap(ctx, ct, expired); err != nil {
+		t.Fatal(err)
+	}
+	retry(time.Now())
+	retry(time.Now())
+	gaps, _ = ledger.Gaps(ctx, ct)
+	if len(gaps) != 1 || !gaps[0].Unrecoverable || gaps[0].Attempts != 3 {
+		t.Errorf("got gaps %+v but want %s unrecoverable", gaps, expired.String())
+	}
+
+	for key, want := range map[string]int{
+		"gap recorded Audit.Exchange window":       1,
+		"gap recorded Audit.Exchange content":      1,
+		"gap recovered Audit.Exchange window":      1,
+		"gap recovered Audit.Exchange content":     1,
+		"gap unrecoverable Audit.Exchange content": 1,
+	} {
+		if got := metrics.seen[key]; got != want {
+			t.Errorf("%s: got %d but want %d", key, got, want)
+		}
+	}
+}
+
+func TestWatcherGapsPartlyExpired(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	earliest := now.Add(-intervalOneWeek).Add(backfillMargin)
+
+	var starts []time.Time
+	url := client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		start, err := time.Parse(RequestDatetimeFormat, r.URL.Query().Get("startTime"))
+		if err != nil {
+			t.Errorf("could not parse startTime: %s", err)
+		}
+		starts = append(starts, start)
+		json.NewEncoder(w).Encode([]Content{})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	ledger := watcher.State.(GapLedger)
+	ctx := context.Background()
+	done := make(chan struct{})
+	defer close(done)
+
+	// a window starting past the 7 days limit is fetched from the limit
+	partly := Gap{Kind: GapWindow, Start: earliest.Add(-time.Hour), End: earliest.Add(10 * time.Hour)}
+	// and a window ending past it is unrecoverable
+	expired := Gap{Kind: GapWindow, Start: earliest.Add(-10 * time.Hour), End: earliest.Add(-time.Hour)}
+	for _, g := range []Gap{partly, expired} {
+		if err := ledger.SetGap(ctx, ct, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watcher.retryGaps(ctx, done, make(chan ResourceAudits), ledger, []schema.ContentType{ct}, now)
+
+	if len(starts) != 1 || starts[0].Before(earliest.Truncate(time.Minute)) {
+		t.Errorf("got listings starting at %v but want one from %v", starts, earliest)
+	}
+	gaps, err := ledger.Gaps(ctx, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 1 || gaps[0].Key() != expired.Key() || !gaps[0].Unrecoverable {
+		t.Errorf("got gaps %+v but want only %s unrecoverable", gaps, expired.String())
+	}
+}
@@ -0,0 +1,45 @@
+// Package logrusadapter provides an office365.Logger implementation backed by logrus.
+package logrusadapter
+
+import (
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger implements the office365.Logger interface using logrus.
+type Logger struct {
+	logger logrus.FieldLogger
+}
+
+// New returns a Logger logging to l,
+// which can be a *logrus.Logger or a *logrus.Entry.
+func New(l logrus.FieldLogger) *Logger {
+	return &Logger{logger: l}
+}
+
+// Debugf implements the office365.Logger interface.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf(format, args...)
+}
+
+// Infof implements the office365.Logger interface.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logger.Infof(format, args...)
+}
+
+// Warnf implements the office365.Logger interface.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logger.Warnf(format, args...)
+}
+
+// Errorf implements the office365.Logger interface.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(format, args...)
+}
+
+// WithField implements the office365.Logger interface.
+func (l *Logger) WithField(key string, value interface{}) office365.Logger {
+	return &Logger{logger: l.logger.WithField(key, value)}
+}
+
+var _ office365.Logger = (*Logger)(nil)
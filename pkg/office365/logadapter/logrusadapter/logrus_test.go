@@ -0,0 +1,26 @@
+package logrusadapter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true, DisableSorting: true})
+
+	l := New(logger)
+	l.Debugf("not logged")
+	l.WithField("content-type", "Audit.Exchange").Errorf("fetchContent: %s", "failed")
+
+	got := strings.TrimSpace(buf.String())
+	want := `level=error msg="fetchContent: failed" content-type=Audit.Exchange`
+	if got != want {
+		t.Errorf("got %q but want %q", got, want)
+	}
+}
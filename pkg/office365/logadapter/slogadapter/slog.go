@@ -0,0 +1,61 @@
+//go:build go1.21
+// +build go1.21
+
+// Package slogadapter provides an office365.Logger implementation backed by log/slog.
+// It requires Go 1.21 or later.
+package slogadapter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+)
+
+// Logger implements the office365.Logger interface using log/slog.
+// Fields are added as attributes.
+type Logger struct {
+	logger *slog.Logger
+}
+
+// New returns a Logger logging to l.
+func New(l *slog.Logger) *Logger {
+	return &Logger{logger: l}
+}
+
+// log formats the message only when the level is enabled.
+func (l *Logger) log(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// Debugf implements the office365.Logger interface.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args)
+}
+
+// Infof implements the office365.Logger interface.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args)
+}
+
+// Warnf implements the office365.Logger interface.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args)
+}
+
+// Errorf implements the office365.Logger interface.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args)
+}
+
+// WithField implements the office365.Logger interface.
+func (l *Logger) WithField(key string, value interface{}) office365.Logger {
+	return &Logger{logger: l.logger.With(key, value)}
+}
+
+var _ office365.Logger = (*Logger)(nil)
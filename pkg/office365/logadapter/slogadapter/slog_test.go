@@ -0,0 +1,30 @@
+//go:build go1.21
+// +build go1.21
+
+package slogadapter
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	removeTime := func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	l := New(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: removeTime})))
+	l.Debugf("not logged")
+	l.WithField("content-type", "Audit.Exchange").Errorf("fetchContent: %s", "failed")
+
+	got := strings.TrimSpace(buf.String())
+	want := `level=ERROR msg="fetchContent: failed" content-type=Audit.Exchange`
+	if got != want {
+		t.Errorf("got %q but want %q", got, want)
+	}
+}
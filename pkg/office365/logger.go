@@ -0,0 +1,42 @@
+package office365
+
+// Logger is the structured logger used by the library.
+// Adapters for common logging libraries can be found in the packages under logadapter,
+// each importing only its own logging library.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// WithField returns a Logger adding the provided field to every entry.
+	WithField(key string, value interface{}) Logger
+}
+
+// NopLogger implements the Logger interface and discards every entry.
+// It is used when no Logger is provided.
+type NopLogger struct{}
+
+// Debugf implements the Logger interface.
+func (NopLogger) Debugf(string, ...interface{}) {}
+
+// Infof implements the Logger interface.
+func (NopLogger) Infof(string, ...interface{}) {}
+
+// Warnf implements the Logger interface.
+func (NopLogger) Warnf(string, ...interface{}) {}
+
+// Errorf implements the Logger interface.
+func (NopLogger) Errorf(string, ...interface{}) {}
+
+// WithField implements the Logger interface.
+func (l NopLogger) WithField(string, interface{}) Logger { return l }
+
+// orNop returns l, or a NopLogger when l is nil.
+func orNop(l Logger) Logger {
+	if l == nil {
+		return NopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,112 @@
+package office365
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// Metrics receives measurements from the Client and the SubscriptionWatcher.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// APIRequest is called once a request made to the API completed.
+	// statusCode is 0 when no response was received.
+	APIRequest(operation string, statusCode int)
+
+	// ContentListed is called with the number of content blobs listed for a window.
+	ContentListed(ct schema.ContentType, n int)
+	// ContentFetched is called when the records of a content blob have been fetched.
+	ContentFetched(ct schema.ContentType)
+	// ContentSkipped is called when a content blob is skipped since it has already been processed.
+	ContentSkipped(ct schema.ContentType)
+	// RescannedContent is called when a rescan fetches a content blob which tailing
+	// did not find, with its age, that is the time elapsed between its creation and the rescan.
+	// It is an upper bound of how late the content blob was listed.
+	RescannedContent(ct schema.ContentType, age time.Duration)
+
+	// GapRecorded is called when a window or content blob that could not be fetched
+	// is recorded in the gap ledger.
+	GapRecorded(ct schema.ContentType, kind GapKind)
+	// GapRecovered is called once a gap has been fetched.
+	GapRecovered(ct schema.ContentType, kind GapKind)
+	// GapUnrecoverable is called when a gap expired before it could be fetched.
+	GapUnrecoverable(ct schema.ContentType, kind GapKind)
+
+	// RecordEmitted is called when a record is sent to the handler.
+	RecordEmitted(ct schema.ContentType, recordType string)
+}
+
+// NopMetrics implements the Metrics interface and discards every measurement.
+// It can be embedded by implementations only interested in some measurements.
+type NopMetrics struct{}
+
+// APIRequest implements the Metrics interface.
+func (NopMetrics) APIRequest(string, int) {}
+
+// ContentListed implements the Metrics interface.
+func (NopMetrics) ContentListed(schema.ContentType, int) {}
+
+// ContentFetched implements the Metrics interface.
+func (NopMetrics) ContentFetched(schema.ContentType) {}
+
+// ContentSkipped implements the Metrics interface.
+func (NopMetrics) ContentSkipped(schema.ContentType) {}
+
+// RescannedContent implements the Metrics interface.
+func (NopMetrics) RescannedContent(schema.ContentType, time.Duration) {}
+
+// GapRecorded implements the Metrics interface.
+func (NopMetrics) GapRecorded(schema.ContentType, GapKind) {}
+
+// GapRecovered implements the Metrics interface.
+func (NopMetrics) GapRecovered(schema.ContentType, GapKind) {}
+
+// GapUnrecoverable implements the Metrics interface.
+func (NopMetrics) GapUnrecoverable(schema.ContentType, GapKind) {}
+
+// RecordEmitted implements the Metrics interface.
+func (NopMetrics) RecordEmitted(schema.ContentType, string) {}
+
+// operation returns the name of the API operation targeted by the provided URL path.
+// Content IDs are removed from audit requests so that operations can be used as metric labels.
+func operation(path string) string {
+	if idx := strings.Index(path, "/activity/feed/"); idx >= 0 {
+		path = path[idx+len("/activity/feed/"):]
+	}
+	if strings.HasPrefix(path, "audit/") {
+		return "audit"
+	}
+	return path
+}
+
+// BaseRecord returns the AuditRecord common to every record returned by AuditService.List,
+// whether extended schemas were added or not.
+func BaseRecord(record interface{}) (*schema.AuditRecord, bool) {
+	switch v := record.(type) {
+	case schema.AuditRecord:
+		return &v, true
+	case *schema.AuditRecord:
+		return v, v != nil
+	}
+	rv := reflect.Indirect(reflect.ValueOf(record))
+	if rv.Kind() != reflect.Struct {
+		return nil, false
+	}
+	f := rv.FieldByName("AuditRecord")
+	if !f.IsValid() {
+		return nil, false
+	}
+	base, ok := f.Interface().(schema.AuditRecord)
+	return &base, ok
+}
+
+// recordType returns the record type of the provided record, or an empty string.
+func recordType(record interface{}) string {
+	base, ok := BaseRecord(record)
+	if !ok || base.RecordType == nil {
+		return ""
+	}
+	return base.RecordType.String()
+}
@@ -0,0 +1,127 @@
+package office365
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// recordingMetrics implements the Metrics interface and records measurements as strings.
+type recordingMetrics struct {
+	NopMetrics
+
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func (m *recordingMetrics) record(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen == nil {
+		m.seen = make(map[string]int)
+	}
+	m.seen[fmt.Sprintf(format, args...)]++
+}
+
+func (m *recordingMetrics) APIRequest(operation string, statusCode int) {
+	m.record("request %s %d", operation, statusCode)
+}
+
+func (m *recordingMetrics) ContentListed(ct schema.ContentType, n int) {
+	m.record("listed %s %d", ct.String(), n)
+}
+
+func (m *recordingMetrics) ContentFetched(ct schema.ContentType) {
+	m.record("fetched %s", ct.String())
+}
+
+func (m *recordingMetrics) ContentSkipped(ct schema.ContentType) {
+	m.record("skipped %s", ct.String())
+}
+
+func (m *recordingMetrics) GapRecorded(ct schema.ContentType, kind GapKind) {
+	m.record("gap recorded %s %s", ct.String(), kind)
+}
+
+func (m *recordingMetrics) GapRecovered(ct schema.ContentType, kind GapKind) {
+	m.record("gap recovered %s %s", ct.String(), kind)
+}
+
+func (m *recordingMetrics) GapUnrecoverable(ct schema.ContentType, kind GapKind) {
+	m.record("gap unrecoverable %s %s", ct.String(), kind)
+}
+
+func (m *recordingMetrics) RecordEmitted(ct schema.ContentType, recordType string) {
+	m.record("record %s %s", ct.String(), recordType)
+}
+
+func TestOperation(t *testing.T) {
+	cases := []struct {
+		Path string
+		Want string
+	}{
+		{"/api/v1.0/tenant/activity/feed/subscriptions/list", "subscriptions/list"},
+		{"/api/v1.0/tenant/activity/feed/subscriptions/content", "subscriptions/content"},
+		{"/api/v1.0/tenant/activity/feed/audit/1234$5678", "audit"},
+		{"/other", "/other"},
+	}
+	for _, c := range cases {
+		if got := operation(c.Path); got != c.Want {
+			t.Errorf("operation(%q): got %q but want %q", c.Path, got, c.Want)
+		}
+	}
+}
+
+func TestWatcherMetrics(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditSharePoint
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.SharePointFileOperationType
+	content := []Content{
+		{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Format(CreatedDatetimeFormat)},
+	}
+	audits := map[string][]interface{}{
+		"abc": {
+			schema.AuditRecord{ID: String("1"), RecordType: &tp},
+			schema.AuditRecord{ID: String("2"), RecordType: &tp},
+		},
+	}
+	stubContentPipeline(t, mux, client, content, audits)
+
+	metrics := &recordingMetrics{}
+	client.Metrics = metrics
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	watcher.Metrics = metrics
+	done := make(chan struct{})
+	defer close(done)
+
+	run := func(requestTime time.Time) {
+		res := ResourceSubscription{ContentType: &ct, RequestTime: requestTime}
+		for r := range watcher.fetchAudits(context.Background(), done, ct, watcher.fetchContent(context.Background(), done, res)) {
+			r.Ack()
+		}
+	}
+	run(now)
+	run(now.Add(time.Second))
+
+	want := map[string]int{
+		"request subscriptions/content 200":               2,
+		"request audit 200":                               1,
+		"listed Audit.SharePoint 1":                       2,
+		"fetched Audit.SharePoint":                        1,
+		"skipped Audit.SharePoint":                        1,
+		"record Audit.SharePoint SharePointFileOperation": 2,
+	}
+	for k, v := range want {
+		if got := metrics.seen[k]; got != v {
+			t.Errorf("%s: got %d measurement(s) but want %d, seen: %v", k, got, v, metrics.seen)
+		}
+	}
+}
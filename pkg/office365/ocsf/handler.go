@@ -0,0 +1,63 @@
+package ocsf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+)
+
+// Handler implements the office365.ResourceHandler interface.
+// It maps resources to OCSF events and writes their json representation
+// on the provided writer.
+type Handler struct {
+	writer io.Writer
+	logger office365.Logger
+	indent bool
+}
+
+// NewHandler returns a Handler using the provided writer.
+// Nothing is logged when l is nil.
+func NewHandler(w io.Writer, l office365.Logger, indent bool) *Handler {
+	if l == nil {
+		l = office365.NopLogger{}
+	}
+	return &Handler{w, l, indent}
+}
+
+// Handle .
+func (h Handler) Handle(in <-chan office365.ResourceAudits) error {
+	for res := range in {
+		event, err := Map(res.AuditRecord)
+		if err != nil {
+			h.logger.WithField("content-type", res.ContentType.String()).Errorf("%s", err)
+			res.Ack()
+			continue
+		}
+		eventStr, err := json.Marshal(event)
+		if err != nil {
+			// the record can never be written, acknowledge it so that it does not
+			// hold back the checkpoint of its content type
+			h.logger.Errorf("%s", err)
+			res.Ack()
+			continue
+		}
+		line := string(eventStr)
+		if h.indent {
+			var out bytes.Buffer
+			if err := json.Indent(&out, eventStr, "", "\t"); err != nil {
+				h.logger.Errorf("%s", err)
+				res.Ack()
+				continue
+			}
+			line = out.String()
+		}
+		if _, err := fmt.Fprintln(h.writer, line); err != nil {
+			return err
+		}
+		res.Ack()
+	}
+	return nil
+}
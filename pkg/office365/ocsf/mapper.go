@@ -0,0 +1,333 @@
+package ocsf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+var (
+	productName   = "Office 365 Management Activity API"
+	vendorName    = "Microsoft"
+	cloudProvider = "Microsoft"
+
+	creationTimeFormat = "2006-01-02T15:04:05"
+)
+
+// Map converts an audit record, as returned by AuditService.List,
+// into an OCSF event.
+// Both the base AuditRecord and the extended schemas are supported.
+// Records that do not map to a known class are returned as Base Events
+// so that nothing is lost along the way.
+func Map(record interface{}) (*Event, error) {
+	base, ok := office365.BaseRecord(record)
+	if !ok {
+		return nil, fmt.Errorf("record is not an AuditRecord: %T", record)
+	}
+
+	event := newEvent(base)
+	switch class := classify(base); class {
+	case ClassAuthentication:
+		mapAuthentication(event, base, record)
+	case ClassAPIActivity:
+		mapAPIActivity(event, base, record)
+	case ClassFileSystemActivity:
+		mapFileSystemActivity(event, base, record)
+	case ClassDetectionFinding:
+		mapDetectionFinding(event, base, record)
+	default:
+		event.setClass(ClassBase, ActivityOther)
+		event.setSeverity(SeverityInformational)
+	}
+	return event, nil
+}
+
+// classify returns the OCSF class the record maps to.
+func classify(r *schema.AuditRecord) Class {
+	if r.RecordType == nil {
+		return ClassBase
+	}
+	switch *r.RecordType {
+	case schema.AzureActiveDirectoryAccountLogonType, schema.AzureActiveDirectoryStsLogonType:
+		return ClassAuthentication
+	case schema.AzureActiveDirectoryType:
+		switch deref(r.Operation) {
+		case "UserLoggedIn", "UserLoginFailed":
+			return ClassAuthentication
+		}
+	case schema.ExchangeAdminType, schema.DataCenterSecurityCmdletType:
+		return ClassAPIActivity
+	case schema.SharePointFileOperationType:
+		return ClassFileSystemActivity
+	case schema.ThreatIntelligenceType, schema.ThreatIntelligenceURLType, schema.ThreatIntelligenceAtpContentType:
+		return ClassDetectionFinding
+	}
+	return ClassBase
+}
+
+func newEvent(r *schema.AuditRecord) *Event {
+	event := &Event{
+		Metadata: Metadata{
+			Version: Version,
+			Product: Product{
+				Name:       productName,
+				VendorName: vendorName,
+			},
+			UID:          deref(r.ID),
+			OriginalTime: deref(r.CreationTime),
+			EventCode:    deref(r.Operation),
+		},
+		Message: deref(r.Operation),
+		Unmapped: map[string]interface{}{
+			"RecordType": recordTypeString(r.RecordType),
+		},
+	}
+	if r.Workload != nil {
+		event.Metadata.Product.Feature = &Feature{Name: *r.Workload}
+	}
+	if r.CreationTime != nil {
+		if t, err := time.ParseInLocation(creationTimeFormat, *r.CreationTime, time.UTC); err == nil {
+			event.Time = t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	if r.OrganizationID != nil {
+		event.Cloud = &Cloud{
+			Provider: cloudProvider,
+			Account:  &Account{UID: *r.OrganizationID},
+		}
+	}
+	if r.UserID != nil || r.UserKey != nil {
+		event.Actor = &Actor{User: newUser(r)}
+	}
+	if r.ClientIP != nil {
+		event.SrcEndpoint = &Endpoint{IP: *r.ClientIP}
+	}
+	if r.ObjectID != nil {
+		event.Unmapped["ObjectId"] = *r.ObjectID
+	}
+	return event
+}
+
+func newUser(r *schema.AuditRecord) *User {
+	u := &User{
+		Name: deref(r.UserID),
+		UID:  deref(r.UserKey),
+	}
+	if r.UserType != nil {
+		u.Type = r.UserType.String()
+	}
+	return u
+}
+
+func (e *Event) setClass(c Class, a Activity) {
+	e.CategoryUID = c.Category()
+	e.CategoryName = e.CategoryUID.String()
+	e.ClassUID = c
+	e.ClassName = c.String()
+	e.ActivityID = a
+	e.ActivityName = activityName(c, a)
+	e.TypeUID = int(c)*100 + int(a)
+}
+
+func (e *Event) setSeverity(s Severity) {
+	e.SeverityID = s
+	e.Severity = s.String()
+}
+
+func (e *Event) setStatus(s Status, detail string) {
+	e.StatusID = s
+	e.Status = s.String()
+	e.StatusDetail = detail
+}
+
+func mapAuthentication(e *Event, r *schema.AuditRecord, record interface{}) {
+	e.setClass(ClassAuthentication, ActivityLogon)
+	e.User = newUser(r)
+
+	status := resultStatus(r.ResultStatus)
+	if deref(r.Operation) == "UserLoginFailed" {
+		status = StatusFailure
+	}
+	detail := deref(r.ResultStatus)
+
+	switch v := record.(type) {
+	case schema.AzureActiveDirectoryAccountLogon:
+		e.User.Domain = deref(v.UserDomain)
+		if v.Application != nil {
+			e.Service = &Service{Name: *v.Application}
+		}
+	case schema.AzureActiveDirectorySTSLogon:
+		if v.ApplicationID != nil {
+			e.Service = &Service{UID: *v.ApplicationID}
+		}
+		if v.LogonError != nil && *v.LogonError != "" {
+			status = StatusFailure
+			detail = *v.LogonError
+		}
+	}
+	e.setStatus(status, detail)
+
+	severity := SeverityInformational
+	if status == StatusFailure {
+		severity = SeverityLow
+	}
+	e.setSeverity(severity)
+}
+
+func mapAPIActivity(e *Event, r *schema.AuditRecord, record interface{}) {
+	operation := deref(r.Operation)
+	e.setClass(ClassAPIActivity, cmdletActivity(operation))
+	e.API = &API{
+		Operation: operation,
+		Service:   &Service{Name: deref(r.Workload)},
+	}
+	if r.ObjectID != nil {
+		e.Resources = []Resource{{Name: *r.ObjectID}}
+	}
+
+	severity := SeverityInformational
+	if v, ok := record.(schema.DataCenterSecurityCmdlet); ok {
+		// datacenter cmdlets are run by Microsoft personnel with elevated privileges
+		severity = SeverityLow
+		if v.ElevationApprover != nil {
+			e.Unmapped["ElevationApprover"] = *v.ElevationApprover
+		}
+	}
+	e.setStatus(resultStatus(r.ResultStatus), deref(r.ResultStatus))
+	e.setSeverity(severity)
+}
+
+func mapFileSystemActivity(e *Event, r *schema.AuditRecord, record interface{}) {
+	e.setClass(ClassFileSystemActivity, fileActivity(deref(r.Operation)))
+	e.setSeverity(SeverityInformational)
+
+	file := &File{
+		Name:   deref(r.ObjectID),
+		Path:   deref(r.ObjectID),
+		TypeID: 1,
+	}
+	if v, ok := record.(schema.SharepointFileOperations); ok {
+		if v.SourceFileName != nil {
+			file.Name = *v.SourceFileName
+		}
+		if v.SourceRelativeURL != nil {
+			file.Path = strings.TrimSuffix(deref(v.SiteURL), "/") + "/" + *v.SourceRelativeURL + "/" + file.Name
+		}
+		file.Ext = deref(v.SourceFileExtension)
+	}
+	e.File = file
+}
+
+func mapDetectionFinding(e *Event, r *schema.AuditRecord, record interface{}) {
+	e.setClass(ClassDetectionFinding, ActivityCreate)
+
+	info := &FindingInfo{
+		UID:   deref(r.ID),
+		Title: deref(r.Operation),
+	}
+	severity := SeverityMedium
+	switch v := record.(type) {
+	case schema.ATP:
+		if v.DetectionType != nil {
+			info.Title = *v.DetectionType
+		}
+		if v.DetectionMethod != nil {
+			info.Types = []string{*v.DetectionMethod}
+		}
+		info.Desc = deref(v.Subject)
+		info.URL = deref(v.EventDeepLink)
+		severity = verdictSeverity(deref(v.Verdict))
+		if v.SenderIP != nil {
+			e.SrcEndpoint = &Endpoint{IP: *v.SenderIP}
+		}
+	case schema.URLTimeOfClickEvents:
+		info.Desc = deref(v.URL)
+		if v.URLClickAction != nil {
+			info.Types = []string{v.URLClickAction.String()}
+		}
+		if v.UserIP != nil {
+			e.SrcEndpoint = &Endpoint{IP: *v.UserIP}
+		}
+	}
+	e.FindingInfo = info
+	e.setSeverity(severity)
+}
+
+// cmdletActivity derives the activity of a cmdlet from its verb.
+func cmdletActivity(cmdlet string) Activity {
+	verb := cmdlet
+	if idx := strings.Index(cmdlet, "-"); idx >= 0 {
+		verb = cmdlet[:idx]
+	}
+	switch strings.ToLower(verb) {
+	case "new", "add", "install", "import":
+		return ActivityCreate
+	case "get", "test", "search", "export":
+		return ActivityRead
+	case "set", "update", "enable", "disable", "start", "stop":
+		return ActivityUpdate
+	case "remove", "uninstall", "clear":
+		return ActivityDelete
+	}
+	return ActivityOther
+}
+
+// fileActivity derives the activity of a SharePoint file operation.
+func fileActivity(operation string) Activity {
+	switch operation {
+	case "FileUploaded", "FileCopied", "FolderCreated":
+		return ActivityFileCreate
+	case "FileAccessed", "FileAccessedExtended", "FileDownloaded", "FilePreviewed", "FileSyncDownloadedFull":
+		return ActivityFileRead
+	case "FileModified", "FileModifiedExtended", "FileCheckedIn", "FileCheckedOut", "FileSyncUploadedFull":
+		return ActivityFileUpdate
+	case "FileDeleted", "FileRecycled", "FileDeletedFirstStageRecycleBin", "FileDeletedSecondStageRecycleBin", "FolderDeleted":
+		return ActivityFileDelete
+	case "FileRenamed", "FileMoved", "FolderRenamed", "FolderMoved":
+		return ActivityFileRename
+	}
+	return ActivityOther
+}
+
+// verdictSeverity derives the severity of a threat intelligence verdict.
+func verdictSeverity(verdict string) Severity {
+	v := strings.ToLower(verdict)
+	switch {
+	case strings.Contains(v, "malware"):
+		return SeverityHigh
+	case strings.Contains(v, "phish"):
+		return SeverityHigh
+	case strings.Contains(v, "spam"), strings.Contains(v, "bulk"):
+		return SeverityLow
+	}
+	return SeverityMedium
+}
+
+func resultStatus(s *string) Status {
+	switch strings.ToLower(deref(s)) {
+	case "":
+		return StatusUnknown
+	case "success", "succeeded", "true", "partiallysucceeded":
+		return StatusSuccess
+	case "failed", "failure", "false":
+		return StatusFailure
+	}
+	return StatusUnknown
+}
+
+func recordTypeString(t *schema.AuditLogRecordType) string {
+	if t == nil {
+		return ""
+	}
+	return t.String()
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,131 @@
+package ocsf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func str(v string) *string { return &v }
+
+func recordType(t schema.AuditLogRecordType) *schema.AuditLogRecordType { return &t }
+
+func TestMap(t *testing.T) {
+	base := func(rt schema.AuditLogRecordType, operation, result string) schema.AuditRecord {
+		return schema.AuditRecord{
+			ID:             str("00000000-0000-0000-0000-000000000001"),
+			RecordType:     recordType(rt),
+			CreationTime:   str("2020-04-16T12:00:00"),
+			Operation:      str(operation),
+			OrganizationID: str("tenant"),
+			UserID:         str("user@example.com"),
+			UserKey:        str("10030000A1B2C3D4"),
+			Workload:       str("Workload"),
+			ResultStatus:   str(result),
+			ObjectID:       str("object"),
+			ClientIP:       str("10.0.0.1"),
+		}
+	}
+
+	cases := []struct {
+		Record       interface{}
+		WantClass    Class
+		WantActivity Activity
+		WantSeverity Severity
+		WantStatus   Status
+	}{
+		{
+			Record: schema.AzureActiveDirectorySTSLogon{
+				AuditRecord: base(schema.AzureActiveDirectoryStsLogonType, "UserLoggedIn", "Succeeded"),
+			},
+			WantClass:    ClassAuthentication,
+			WantActivity: ActivityLogon,
+			WantSeverity: SeverityInformational,
+			WantStatus:   StatusSuccess,
+		},
+		{
+			Record:       base(schema.AzureActiveDirectoryType, "UserLoginFailed", "Failed"),
+			WantClass:    ClassAuthentication,
+			WantActivity: ActivityLogon,
+			WantSeverity: SeverityLow,
+			WantStatus:   StatusFailure,
+		},
+		{
+			Record: schema.ExchangeAdmin{
+				AuditRecord: base(schema.ExchangeAdminType, "New-InboxRule", "True"),
+			},
+			WantClass:    ClassAPIActivity,
+			WantActivity: ActivityCreate,
+			WantSeverity: SeverityInformational,
+			WantStatus:   StatusSuccess,
+		},
+		{
+			Record: schema.DataCenterSecurityCmdlet{
+				AuditRecord: base(schema.DataCenterSecurityCmdletType, "Remove-Mailbox", ""),
+			},
+			WantClass:    ClassAPIActivity,
+			WantActivity: ActivityDelete,
+			WantSeverity: SeverityLow,
+			WantStatus:   StatusUnknown,
+		},
+		{
+			Record: schema.SharepointFileOperations{
+				AuditRecord:    base(schema.SharePointFileOperationType, "FileDownloaded", ""),
+				SourceFileName: str("report.docx"),
+			},
+			WantClass:    ClassFileSystemActivity,
+			WantActivity: ActivityFileRead,
+			WantSeverity: SeverityInformational,
+		},
+		{
+			Record: schema.ATP{
+				AuditRecord: base(schema.ThreatIntelligenceType, "TIMailData", ""),
+				Verdict:     str("Phish"),
+			},
+			WantClass:    ClassDetectionFinding,
+			WantActivity: ActivityCreate,
+			WantSeverity: SeverityHigh,
+		},
+		{
+			Record:       base(schema.SwayType, "View", ""),
+			WantClass:    ClassBase,
+			WantActivity: ActivityOther,
+			WantSeverity: SeverityInformational,
+		},
+	}
+
+	for idx, c := range cases {
+		t.Run(fmt.Sprintf("%d.", idx+1), func(t *testing.T) {
+			event, err := Map(c.Record)
+			if err != nil {
+				t.Fatalf("error occurred mapping record: %v", err)
+			}
+			if event.ClassUID != c.WantClass {
+				t.Errorf("class: got %v want %v", event.ClassUID, c.WantClass)
+			}
+			if event.CategoryUID != c.WantClass.Category() {
+				t.Errorf("category: got %v want %v", event.CategoryUID, c.WantClass.Category())
+			}
+			if event.ActivityID != c.WantActivity {
+				t.Errorf("activity: got %v want %v", event.ActivityID, c.WantActivity)
+			}
+			if want := int(c.WantClass)*100 + int(c.WantActivity); event.TypeUID != want {
+				t.Errorf("type_uid: got %v want %v", event.TypeUID, want)
+			}
+			if event.SeverityID != c.WantSeverity {
+				t.Errorf("severity: got %v want %v", event.SeverityID, c.WantSeverity)
+			}
+			if event.StatusID != c.WantStatus {
+				t.Errorf("status: got %v want %v", event.StatusID, c.WantStatus)
+			}
+			if event.Time != 1587038400000 {
+				t.Errorf("time: got %v want %v", event.Time, 1587038400000)
+			}
+		})
+	}
+
+	if _, err := Map("not a record"); err == nil {
+		t.Errorf("no error occurred mapping an invalid record")
+	}
+}
@@ -0,0 +1,305 @@
+// Package ocsf maps audit records returned by the Microsoft Office365
+// Management Activity API to Open Cybersecurity Schema Framework events.
+//
+// OCSF Schema Reference: https://schema.ocsf.io/1.1.0
+package ocsf
+
+// Version is the OCSF schema version events are produced against.
+var Version = "1.1.0"
+
+// Category identifies the OCSF category of an event.
+type Category int
+
+// Category enum.
+const (
+	CategoryUncategorized Category = 0
+	CategorySystem        Category = 1
+	CategoryFindings      Category = 2
+	CategoryIAM           Category = 3
+	CategoryApplication   Category = 6
+)
+
+func (c Category) String() string {
+	literals := map[Category]string{
+		CategoryUncategorized: "Uncategorized",
+		CategorySystem:        "System Activity",
+		CategoryFindings:      "Findings",
+		CategoryIAM:           "Identity & Access Management",
+		CategoryApplication:   "Application Activity",
+	}
+	return literals[c]
+}
+
+// Class identifies the OCSF class of an event.
+type Class int
+
+// Class enum.
+const (
+	ClassBase               Class = 0
+	ClassFileSystemActivity Class = 1001
+	ClassDetectionFinding   Class = 2004
+	ClassAuthentication     Class = 3002
+	ClassAPIActivity        Class = 6003
+)
+
+func (c Class) String() string {
+	literals := map[Class]string{
+		ClassBase:               "Base Event",
+		ClassFileSystemActivity: "File System Activity",
+		ClassDetectionFinding:   "Detection Finding",
+		ClassAuthentication:     "Authentication",
+		ClassAPIActivity:        "API Activity",
+	}
+	return literals[c]
+}
+
+// Category returns the category the class belongs to.
+func (c Class) Category() Category {
+	return Category(int(c) / 1000)
+}
+
+// Activity identifies the activity of an event.
+// Its meaning depends on the Class of the event.
+type Activity int
+
+// Activity enum shared by all classes.
+const (
+	ActivityUnknown Activity = 0
+	ActivityOther   Activity = 99
+)
+
+// Authentication activities.
+const (
+	ActivityLogon  Activity = 1
+	ActivityLogoff Activity = 2
+)
+
+// API Activity and Detection Finding activities.
+const (
+	ActivityCreate Activity = 1
+	ActivityRead   Activity = 2
+	ActivityUpdate Activity = 3
+	ActivityDelete Activity = 4
+)
+
+// File System Activity activities.
+const (
+	ActivityFileCreate Activity = 1
+	ActivityFileRead   Activity = 2
+	ActivityFileUpdate Activity = 3
+	ActivityFileDelete Activity = 4
+	ActivityFileRename Activity = 5
+)
+
+// activityName returns the caption of an activity for the provided class.
+func activityName(c Class, a Activity) string {
+	switch a {
+	case ActivityUnknown:
+		return "Unknown"
+	case ActivityOther:
+		return "Other"
+	}
+	switch c {
+	case ClassAuthentication:
+		literals := map[Activity]string{
+			ActivityLogon:  "Logon",
+			ActivityLogoff: "Logoff",
+		}
+		return literals[a]
+	case ClassFileSystemActivity:
+		literals := map[Activity]string{
+			ActivityFileCreate: "Create",
+			ActivityFileRead:   "Read",
+			ActivityFileUpdate: "Update",
+			ActivityFileDelete: "Delete",
+			ActivityFileRename: "Rename",
+		}
+		return literals[a]
+	case ClassAPIActivity, ClassDetectionFinding:
+		literals := map[Activity]string{
+			ActivityCreate: "Create",
+			ActivityRead:   "Read",
+			ActivityUpdate: "Update",
+			ActivityDelete: "Delete",
+		}
+		return literals[a]
+	}
+	return ""
+}
+
+// Severity identifies the severity of an event.
+type Severity int
+
+// Severity enum.
+const (
+	SeverityUnknown       Severity = 0
+	SeverityInformational Severity = 1
+	SeverityLow           Severity = 2
+	SeverityMedium        Severity = 3
+	SeverityHigh          Severity = 4
+	SeverityCritical      Severity = 5
+)
+
+func (s Severity) String() string {
+	literals := map[Severity]string{
+		SeverityUnknown:       "Unknown",
+		SeverityInformational: "Informational",
+		SeverityLow:           "Low",
+		SeverityMedium:        "Medium",
+		SeverityHigh:          "High",
+		SeverityCritical:      "Critical",
+	}
+	return literals[s]
+}
+
+// Status identifies the outcome of an event.
+type Status int
+
+// Status enum.
+const (
+	StatusUnknown Status = 0
+	StatusSuccess Status = 1
+	StatusFailure Status = 2
+)
+
+func (s Status) String() string {
+	literals := map[Status]string{
+		StatusUnknown: "Unknown",
+		StatusSuccess: "Success",
+		StatusFailure: "Failure",
+	}
+	return literals[s]
+}
+
+// Event represents an OCSF event.
+// Attributes specific to a class are only set for events of that class.
+type Event struct {
+	CategoryUID  Category `json:"category_uid"`
+	CategoryName string   `json:"category_name"`
+	ClassUID     Class    `json:"class_uid"`
+	ClassName    string   `json:"class_name"`
+	ActivityID   Activity `json:"activity_id"`
+	ActivityName string   `json:"activity_name,omitempty"`
+	TypeUID      int      `json:"type_uid"`
+	SeverityID   Severity `json:"severity_id"`
+	Severity     string   `json:"severity"`
+	StatusID     Status   `json:"status_id,omitempty"`
+	Status       string   `json:"status,omitempty"`
+	StatusDetail string   `json:"status_detail,omitempty"`
+	Time         int64    `json:"time"`
+	Message      string   `json:"message,omitempty"`
+	Metadata     Metadata `json:"metadata"`
+	Cloud        *Cloud   `json:"cloud,omitempty"`
+
+	Actor       *Actor    `json:"actor,omitempty"`
+	SrcEndpoint *Endpoint `json:"src_endpoint,omitempty"`
+
+	// Authentication
+	User    *User    `json:"user,omitempty"`
+	Service *Service `json:"service,omitempty"`
+
+	// API Activity
+	API       *API       `json:"api,omitempty"`
+	Resources []Resource `json:"resources,omitempty"`
+
+	// File System Activity
+	File *File `json:"file,omitempty"`
+
+	// Detection Finding
+	FindingInfo *FindingInfo `json:"finding_info,omitempty"`
+
+	Unmapped map[string]interface{} `json:"unmapped,omitempty"`
+}
+
+// Metadata describes the origin of an event.
+type Metadata struct {
+	Version      string  `json:"version"`
+	Product      Product `json:"product"`
+	UID          string  `json:"uid,omitempty"`
+	OriginalTime string  `json:"original_time,omitempty"`
+	EventCode    string  `json:"event_code,omitempty"`
+}
+
+// Product describes the product that reported an event.
+type Product struct {
+	Name       string   `json:"name"`
+	VendorName string   `json:"vendor_name"`
+	Feature    *Feature `json:"feature,omitempty"`
+}
+
+// Feature describes the product feature that reported an event.
+type Feature struct {
+	Name string `json:"name"`
+}
+
+// Cloud describes the cloud environment an event originates from.
+type Cloud struct {
+	Provider string   `json:"provider"`
+	Account  *Account `json:"account,omitempty"`
+}
+
+// Account describes a cloud account.
+type Account struct {
+	UID string `json:"uid"`
+}
+
+// Actor describes the entity that initiated an event.
+type Actor struct {
+	User *User `json:"user,omitempty"`
+	App  *App  `json:"app,omitempty"`
+}
+
+// App describes an application.
+type App struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid,omitempty"`
+}
+
+// User describes a user.
+type User struct {
+	Name   string `json:"name,omitempty"`
+	UID    string `json:"uid,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// Endpoint describes a network endpoint.
+type Endpoint struct {
+	IP string `json:"ip,omitempty"`
+}
+
+// Service describes the service an authentication was made against.
+type Service struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid,omitempty"`
+}
+
+// API describes an API call.
+type API struct {
+	Operation string   `json:"operation"`
+	Service   *Service `json:"service,omitempty"`
+}
+
+// Resource describes a resource affected by an event.
+type Resource struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid,omitempty"`
+	Type string `json:"type,omitempty"`
+}
+
+// File describes a file.
+type File struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	TypeID int    `json:"type_id"`
+	Ext    string `json:"ext,omitempty"`
+}
+
+// FindingInfo describes a finding.
+type FindingInfo struct {
+	UID   string   `json:"uid"`
+	Title string   `json:"title"`
+	Desc  string   `json:"desc,omitempty"`
+	Types []string `json:"types,omitempty"`
+	URL   string   `json:"src_url,omitempty"`
+}
@@ -64,6 +64,9 @@ type Client struct {
 	UserAgent string
 	version   string
 
+	// Metrics receives a measurement for every request made to the API.
+	Metrics Metrics
+
 	client        *http.Client
 	tenantID      string
 	pubIdentifier string
@@ -96,6 +99,7 @@ func NewClient(httpClient *http.Client, tenantID string, pubIdentifier string) *
 		BaseURL:       baseURL,
 		UserAgent:     defaultUserAgent,
 		version:       defaultVersion,
+		Metrics:       NopMetrics{},
 		client:        httpClient,
 		tenantID:      tenantID,
 		pubIdentifier: pubIdentifier,
@@ -156,6 +160,7 @@ func (c *Client) do(ctx context.Context, req *http.Request, out interface{}) (*R
 	req = req.WithContext(ctx)
 	resp, err := c.client.Do(req)
 	if err != nil {
+		c.Metrics.APIRequest(operation(req.URL.Path), 0)
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -164,10 +169,14 @@ func (c *Client) do(ctx context.Context, req *http.Request, out interface{}) (*R
 		return nil, err
 	}
 	defer resp.Body.Close()
+	c.Metrics.APIRequest(operation(req.URL.Path), resp.StatusCode)
 
 	response := &Response{resp}
 
-	err = CheckResponse(resp)
+	// the body of an error response is consumed by CheckResponse
+	if err := CheckResponse(resp); err != nil {
+		return response, err
+	}
 
 	if out != nil {
 		decErr := json.NewDecoder(resp.Body).Decode(&out)
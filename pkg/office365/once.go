@@ -0,0 +1,200 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+var (
+	// ErrWindowsFailed is returned by RunOnce when some windows could not be fetched.
+	ErrWindowsFailed = errors.New("some windows could not be fetched")
+	// ErrNoSubscriptions is returned by RunOnce when no subscription of the selected
+	// content types is enabled, so that there is nothing to fetch.
+	ErrNoSubscriptions = errors.New("no subscription of the selected content types is enabled")
+)
+
+// planCatchUp returns the chunks of the window between the request time checkpoint
+// of the provided content type and now. Without a checkpoint, the window starts at
+// BackfillFrom when provided, or a lookbehind before now.
+// It is limited to the last 7 days, as older content is not available.
+func (s *SubscriptionWatcher) planCatchUp(ctx context.Context, ct schema.ContentType, now time.Time) ([]*backfillChunk, error) {
+	conf := s.Config()
+	start, err := s.State.LastRequestTime(ctx, ct)
+	if err != nil {
+		return nil, err
+	}
+	if start.IsZero() {
+		start = conf.BackfillFrom
+	}
+	if lookBehind := now.Add(-(time.Duration(conf.LookBehindMinutes) * time.Minute)); start.IsZero() || start.After(lookBehind) {
+		start = lookBehind
+	}
+	if earliest := now.Add(-intervalOneWeek).Add(backfillMargin); start.Before(earliest) {
+		start = earliest
+	}
+	return splitWindow(ct, start, now), nil
+}
+
+// catchUp fetches the chunks of the window between the request time checkpoint
+// of the provided content type and now, in order, moving the checkpoint after each one.
+// A chunk that fails is recorded in the gap ledger, if any, and the next ones are fetched.
+// Otherwise the content type stops at the failed chunk.
+// It returns the number of chunks that failed.
+func (s *SubscriptionWatcher) catchUp(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ct schema.ContentType, now time.Time) int {
+	ctLogger := s.logger.WithField("content-type", ct.String())
+
+	chunks, err := s.planCatchUp(ctx, ct, now)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			ctLogger.Errorf("catchUp: could not plan: %s", err)
+			s.status.fail(ct, err)
+			s.fetchFailed(&ct, "", OperationState, err)
+			return 1
+		}
+		return 0
+	}
+	ctLogger.Infof("catchUp: planned %d chunk(s)", len(chunks))
+
+	failed := 0
+	for _, c := range chunks {
+		if s.stopped() {
+			return failed
+		}
+		ctLogger.Debugf("catchUp: fetching chunk %s - %s", c.Start.String(), c.End.String())
+
+		_, err := s.fetchWindow(ctx, done, out, ct, WindowSourceTail, c.Start, c.End, now)
+		if errors.Is(err, context.Canceled) {
+			return failed
+		}
+		if err != nil {
+			ctLogger.Errorf("catchUp: chunk %s - %s failed: %s", c.Start.String(), c.End.String(), err)
+			s.status.fail(ct, err)
+			failed++
+
+			gap := Gap{Kind: GapWindow, Start: c.Start, End: c.End}
+			if !s.recordGap(ctLogger, ct, gap, err) {
+				return failed
+			}
+		}
+		if err := s.setCheckpoint(stateContext, ct, CheckpointLastRequestTime, c.End); err != nil {
+			ctLogger.Errorf("catchUp: could not set lastRequestTime: %s", err)
+			s.status.fail(ct, err)
+			s.fetchFailed(&ct, "", OperationState, err)
+			return failed + 1
+		}
+	}
+	if failed == 0 {
+		s.status.cycle(ct, time.Now())
+	}
+	return failed
+}
+
+// RunOnce fetches the records of the subscriptions of the selected content types,
+// from their request time checkpoint to now, in 24 hour chunks when needed, then returns.
+// Gaps recorded in the gap ledger, if any, whose next attempt is due are retried first.
+// Subscriptions that are not enabled are skipped.
+// It returns once the handler returns, with ErrWindowsFailed when some windows
+// could not be fetched, or ErrNoSubscriptions when no subscription is enabled.
+// Gaps failing again are left to the next run and are not counted.
+// Records are abandoned once ctx is cancelled.
+func (s *SubscriptionWatcher) RunOnce(ctx context.Context) error {
+	done := make(chan struct{})
+	out := make(chan ResourceAudits)
+	s.stopping = make(chan struct{})
+	now := time.Now()
+	s.status.start(now)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-finished:
+			return
+		}
+		close(s.stopping)
+		cancel()
+		close(done)
+	}()
+
+	var mu sync.Mutex
+	failed := 0
+	noSubscriptions := false
+	go func() {
+		defer close(finished)
+		defer close(out)
+
+		// subscriptions are listed once, their failures are reported by fetchSubscriptions
+		var subscriptions []ResourceSubscription
+		for sub := range s.fetchSubscriptions(ctx, done, now) {
+			status := "missing"
+			if sub.Subscription.Status != nil {
+				status = *sub.Subscription.Status
+			}
+			if !strings.EqualFold(status, string(SubscriptionStatusEnabled)) {
+				s.logger.WithField("content-type", sub.ContentType.String()).Warnf("runOnce: subscription %s, skipping", status)
+				continue
+			}
+			subscriptions = append(subscriptions, sub)
+		}
+		if len(subscriptions) == 0 {
+			if s.stopped() {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !s.status.listedSince(now) {
+				// the subscriptions could not be listed, nothing was fetched
+				failed++
+				return
+			}
+			s.logger.Errorf("runOnce: %s", ErrNoSubscriptions)
+			noSubscriptions = true
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, sub := range subscriptions {
+			ct := *sub.ContentType
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ledger, ok := s.gapLedger(); ok {
+					s.retryGaps(ctx, done, out, ledger, []schema.ContentType{ct}, now)
+				}
+				n := s.catchUp(ctx, done, out, ct, now)
+
+				mu.Lock()
+				failed += n
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+	}()
+
+	if err := s.Handler.Handle(out); err != nil {
+		return err
+	}
+	<-finished
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failed > 0 {
+		return fmt.Errorf("%w: %d window(s) failed", ErrWindowsFailed, failed)
+	}
+	if noSubscriptions {
+		return ErrNoSubscriptions
+	}
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	return nil
+}
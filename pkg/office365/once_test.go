@@ -0,0 +1,116 @@
+package office365
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestRunOnce(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Hour).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	var failing int32
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]Content{
+			{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Format(CreatedDatetimeFormat)},
+		})
+	})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]schema.AuditRecord{{ID: String("1"), RecordType: &tp}})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{IncludeContentTypes: []schema.ContentType{ct}})
+	ctx := context.Background()
+	// the checkpoint is 30 hours behind, so the window is fetched in 2 chunks
+	watcher.SetLastRequestTime(ctx, ct, now.Add(-30*time.Hour))
+
+	handler := &ackHandler{}
+	watcher.Handler = handler
+	if err := watcher.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: unexpected error: %s", err)
+	}
+	// content listed by both chunks is only fetched once
+	testDeep(t, handler.ids, []string{"1"})
+	if got, want := checkpoint(t, watcher.LastRequestTime, ct), now.Truncate(time.Minute); !got.Equal(want) {
+		t.Errorf("got lastRequestTime %v but want %v", got, want)
+	}
+
+	// failed windows are reported, and left to the gap ledger
+	atomic.StoreInt32(&failing, 1)
+	handler = &ackHandler{}
+	watcher.Handler = handler
+	err := watcher.RunOnce(ctx)
+	if !errors.Is(err, ErrWindowsFailed) {
+		t.Fatalf("RunOnce: got error %v but want %v", err, ErrWindowsFailed)
+	}
+	gaps, err := watcher.State.(GapLedger).Gaps(ctx, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 1 || gaps[0].Kind != GapWindow {
+		t.Errorf("got gaps %+v but want the failed window", gaps)
+	}
+}
+
+func TestRunOnceNoSubscriptions(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	var listFails int32
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&listFails) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusDisabled))},
+		})
+	})
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("content of a disabled subscription was listed")
+		json.NewEncoder(w).Encode([]Content{})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{IncludeContentTypes: []schema.ContentType{ct}})
+	ctx := context.Background()
+
+	// disabled subscriptions are skipped, and are not reported as failed windows
+	watcher.Handler = &ackHandler{}
+	if err := watcher.RunOnce(ctx); !errors.Is(err, ErrNoSubscriptions) {
+		t.Fatalf("RunOnce: got error %v but want %v", err, ErrNoSubscriptions)
+	}
+
+	// subscriptions that could not be listed are reported as failed windows
+	atomic.StoreInt32(&listFails, 1)
+	watcher.Handler = &ackHandler{}
+	if err := watcher.RunOnce(ctx); !errors.Is(err, ErrWindowsFailed) {
+		t.Fatalf("RunOnce: got error %v but want %v", err, ErrWindowsFailed)
+	}
+}
@@ -0,0 +1,46 @@
+package prommetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lagDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(Namespace, "", "lag_seconds"),
+	"Time elapsed since the creation of the last content blob processed, by content type.",
+	[]string{"content_type"}, nil,
+)
+
+// lagCollector implements the prometheus.Collector interface.
+// It reads the lastContentCreated checkpoints when metrics are collected,
+// so that the lag keeps growing while no content is processed.
+type lagCollector struct {
+	state        office365.State
+	contentTypes func() []schema.ContentType
+	now          func() time.Time
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lagDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now()
+	for _, ct := range c.contentTypes() {
+		created, err := c.state.LastContentCreated(context.Background(), ct)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(lagDesc, err)
+			continue
+		}
+		if created.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, now.Sub(created).Seconds(), ct.String())
+	}
+}
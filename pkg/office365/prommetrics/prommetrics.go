@@ -0,0 +1,220 @@
+// Package prommetrics provides an office365.Metrics implementation
+// exposing measurements as Prometheus metrics.
+package prommetrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the name of every metric registered by this package.
+const Namespace = "go_office365"
+
+// statusError is the status label of requests which did not receive a response.
+const statusError = "error"
+
+// Metrics implements the office365.Metrics interface using Prometheus collectors
+// registered to a dedicated registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	apiRequests        *prometheus.CounterVec
+	apiThrottled       *prometheus.CounterVec
+	contentListed      *prometheus.CounterVec
+	contentFetched     *prometheus.CounterVec
+	contentSkipped     *prometheus.CounterVec
+	contentRescanned   *prometheus.HistogramVec
+	gapsRecorded       *prometheus.CounterVec
+	gapsRecovered      *prometheus.CounterVec
+	gapsUnrecoverable  *prometheus.CounterVec
+	records            *prometheus.CounterVec
+	handlerWriteErrors prometheus.Counter
+	sinkDropped        *prometheus.CounterVec
+}
+
+// New returns Metrics with every collector registered, along with
+// the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "api_requests_total",
+			Help:      "Requests made to the Management Activity API, by operation and response status.",
+		}, []string{"operation", "status"}),
+		apiThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "api_throttled_total",
+			Help:      "Requests throttled by the Management Activity API, by operation.",
+		}, []string{"operation"}),
+		contentListed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "content_listed_total",
+			Help:      "Content blobs listed, by content type.",
+		}, []string{"content_type"}),
+		contentFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "content_fetched_total",
+			Help:      "Content blobs fetched, by content type.",
+		}, []string{"content_type"}),
+		contentSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "content_skipped_total",
+			Help:      "Content blobs skipped since already processed, by content type.",
+		}, []string{"content_type"}),
+		contentRescanned: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "content_rescan_age_seconds",
+			Help:      "Time elapsed between the creation of content blobs found by a rescan and the rescan, an upper bound of how late they were listed, by content type.",
+			Buckets:   prometheus.ExponentialBuckets(60, 2, 10),
+		}, []string{"content_type"}),
+		gapsRecorded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "gaps_recorded_total",
+			Help:      "Windows and content blobs that could not be fetched and were recorded for retry, by content type and kind.",
+		}, []string{"content_type", "kind"}),
+		gapsRecovered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "gaps_recovered_total",
+			Help:      "Gaps fetched on retry, by content type and kind.",
+		}, []string{"content_type", "kind"}),
+		gapsUnrecoverable: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "gaps_unrecoverable_total",
+			Help:      "Gaps that expired before they could be fetched, by content type and kind.",
+		}, []string{"content_type", "kind"}),
+		records: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "records_total",
+			Help:      "Records sent to the handler, by content type and record type.",
+		}, []string{"content_type", "record_type"}),
+		handlerWriteErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "handler_write_errors_total",
+			Help:      "Errors encountered by the handler writing records to its output.",
+		}),
+		sinkDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "sink_records_dropped_total",
+			Help:      "Records dropped by a sink which could not keep up or stopped, by sink.",
+		}, []string{"sink"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.apiRequests,
+		m.apiThrottled,
+		m.contentListed,
+		m.contentFetched,
+		m.contentSkipped,
+		m.contentRescanned,
+		m.gapsRecorded,
+		m.gapsRecovered,
+		m.gapsUnrecoverable,
+		m.records,
+		m.handlerWriteErrors,
+		m.sinkDropped,
+	)
+	return m
+}
+
+// Handler returns an http.Handler serving the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// APIRequest implements the office365.Metrics interface.
+func (m *Metrics) APIRequest(operation string, statusCode int) {
+	status := statusError
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	m.apiRequests.WithLabelValues(operation, status).Inc()
+	if statusCode == http.StatusTooManyRequests {
+		m.apiThrottled.WithLabelValues(operation).Inc()
+	}
+}
+
+// ContentListed implements the office365.Metrics interface.
+func (m *Metrics) ContentListed(ct schema.ContentType, n int) {
+	m.contentListed.WithLabelValues(ct.String()).Add(float64(n))
+}
+
+// ContentFetched implements the office365.Metrics interface.
+func (m *Metrics) ContentFetched(ct schema.ContentType) {
+	m.contentFetched.WithLabelValues(ct.String()).Inc()
+}
+
+// ContentSkipped implements the office365.Metrics interface.
+func (m *Metrics) ContentSkipped(ct schema.ContentType) {
+	m.contentSkipped.WithLabelValues(ct.String()).Inc()
+}
+
+// RescannedContent implements the office365.Metrics interface.
+func (m *Metrics) RescannedContent(ct schema.ContentType, age time.Duration) {
+	m.contentRescanned.WithLabelValues(ct.String()).Observe(age.Seconds())
+}
+
+// GapRecorded implements the office365.Metrics interface.
+func (m *Metrics) GapRecorded(ct schema.ContentType, kind office365.GapKind) {
+	m.gapsRecorded.WithLabelValues(ct.String(), string(kind)).Inc()
+}
+
+// GapRecovered implements the office365.Metrics interface.
+func (m *Metrics) GapRecovered(ct schema.ContentType, kind office365.GapKind) {
+	m.gapsRecovered.WithLabelValues(ct.String(), string(kind)).Inc()
+}
+
+// GapUnrecoverable implements the office365.Metrics interface.
+func (m *Metrics) GapUnrecoverable(ct schema.ContentType, kind office365.GapKind) {
+	m.gapsUnrecoverable.WithLabelValues(ct.String(), string(kind)).Inc()
+}
+
+// RecordEmitted implements the office365.Metrics interface.
+func (m *Metrics) RecordEmitted(ct schema.ContentType, recordType string) {
+	m.records.WithLabelValues(ct.String(), recordType).Inc()
+}
+
+// RegisterLag registers a gauge reporting, for each content type returned by contentTypes,
+// the time elapsed since the creation of the last content blob processed,
+// read from the lastContentCreated checkpoint of state when metrics are collected.
+// Content types without checkpoint are not reported.
+func (m *Metrics) RegisterLag(state office365.State, contentTypes func() []schema.ContentType) {
+	m.registry.MustRegister(&lagCollector{state: state, contentTypes: contentTypes, now: time.Now})
+}
+
+// RegisterQueue registers gauges reporting the number of records
+// and the size, in bytes, of the records waiting in a queue.
+func (m *Metrics) RegisterQueue(depth, size func() int64) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "queue_depth",
+			Help:      "Records waiting in the queue to be delivered to the output.",
+		}, func() float64 { return float64(depth()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "queue_bytes",
+			Help:      "Size of the records waiting in the queue to be delivered to the output.",
+		}, func() float64 { return float64(size()) }),
+	)
+}
+
+// HandlerWriteError counts an error encountered by the handler writing a record.
+func (m *Metrics) HandlerWriteError() {
+	m.handlerWriteErrors.Inc()
+}
+
+// SinkDropped counts a record dropped by the provided sink.
+func (m *Metrics) SinkDropped(sink string) {
+	m.sinkDropped.WithLabelValues(sink).Inc()
+}
+
+var _ office365.Metrics = (*Metrics)(nil)
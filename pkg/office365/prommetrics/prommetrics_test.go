@@ -0,0 +1,111 @@
+package prommetrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.APIRequest("content", 200)
+	m.APIRequest("audit", 429)
+	m.APIRequest("audit", 0)
+	m.ContentListed(schema.AuditExchange, 3)
+	m.ContentFetched(schema.AuditExchange)
+	m.ContentSkipped(schema.AuditExchange)
+	m.RescannedContent(schema.AuditExchange, 5*time.Minute)
+	m.GapRecorded(schema.AuditExchange, office365.GapContent)
+	m.GapRecovered(schema.AuditExchange, office365.GapContent)
+	m.GapUnrecoverable(schema.AuditExchange, office365.GapWindow)
+	m.RecordEmitted(schema.AuditExchange, "ExchangeAdmin")
+	m.HandlerWriteError()
+	m.SinkDropped("archive")
+
+	cases := []struct {
+		Name string
+		Got  float64
+		Want float64
+	}{
+		{"api_requests_total 200", testutil.ToFloat64(m.apiRequests.WithLabelValues("content", "200")), 1},
+		{"api_requests_total 429", testutil.ToFloat64(m.apiRequests.WithLabelValues("audit", "429")), 1},
+		{"api_requests_total error", testutil.ToFloat64(m.apiRequests.WithLabelValues("audit", statusError)), 1},
+		{"api_throttled_total", testutil.ToFloat64(m.apiThrottled.WithLabelValues("audit")), 1},
+		{"content_listed_total", testutil.ToFloat64(m.contentListed.WithLabelValues("Audit.Exchange")), 3},
+		{"content_fetched_total", testutil.ToFloat64(m.contentFetched.WithLabelValues("Audit.Exchange")), 1},
+		{"content_skipped_total", testutil.ToFloat64(m.contentSkipped.WithLabelValues("Audit.Exchange")), 1},
+		{"gaps_recorded_total", testutil.ToFloat64(m.gapsRecorded.WithLabelValues("Audit.Exchange", "content")), 1},
+		{"gaps_recovered_total", testutil.ToFloat64(m.gapsRecovered.WithLabelValues("Audit.Exchange", "content")), 1},
+		{"gaps_unrecoverable_total", testutil.ToFloat64(m.gapsUnrecoverable.WithLabelValues("Audit.Exchange", "window")), 1},
+		{"records_total", testutil.ToFloat64(m.records.WithLabelValues("Audit.Exchange", "ExchangeAdmin")), 1},
+		{"handler_write_errors_total", testutil.ToFloat64(m.handlerWriteErrors), 1},
+		{"sink_records_dropped_total", testutil.ToFloat64(m.sinkDropped.WithLabelValues("archive")), 1},
+	}
+	for _, c := range cases {
+		if c.Got != c.Want {
+			t.Errorf("%s: got %v but want %v", c.Name, c.Got, c.Want)
+		}
+	}
+}
+
+func TestLag(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 4, 16, 12, 30, 0, 0, time.UTC)
+	state := office365.NewMemoryState()
+	if err := state.SetLastContentCreated(ctx, schema.AuditExchange, now.Add(-90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// content types without checkpoint are not reported
+	c := &lagCollector{
+		state:        state,
+		contentTypes: func() []schema.ContentType { return []schema.ContentType{schema.AuditExchange, schema.DLPAll} },
+		now:          func() time.Time { return now },
+	}
+	if got := testutil.ToFloat64(c); got != 90 {
+		t.Errorf("got lag_seconds %v but want 90", got)
+	}
+
+	// the lag grows while no content is processed
+	now = now.Add(time.Hour)
+	if got := testutil.ToFloat64(c); got != 3690 {
+		t.Errorf("got lag_seconds %v but want 3690", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := New()
+	m.RecordEmitted(schema.AuditExchange, "ExchangeAdmin")
+	m.RegisterQueue(func() int64 { return 3 }, func() int64 { return 42 })
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`go_office365_records_total{content_type="Audit.Exchange",record_type="ExchangeAdmin"} 1`,
+		`go_office365_queue_depth 3`,
+		`go_office365_queue_bytes 42`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metric %q not found in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+)
+
+var (
+	// syncInterval is the interval at which queued records are synced,
+	// then acknowledged to the watcher.
+	syncInterval = 200 * time.Millisecond
+	// maxUnsynced is the number of queued records after which they are synced
+	// without waiting for the next interval.
+	maxUnsynced = 1000
+)
+
+// Handler implements the office365.ResourceHandler interface.
+// It queues the records it receives, acknowledging them once durable,
+// and delivers queued records to the next handler.
+// Records are removed from the queue once the next handler acknowledges them.
+type Handler struct {
+	queue  *Queue
+	next   office365.ResourceHandler
+	logger office365.Logger
+}
+
+// NewHandler returns a Handler queueing records in q and delivering them to next.
+// Nothing is logged when l is nil.
+func NewHandler(q *Queue, next office365.ResourceHandler, l office365.Logger) *Handler {
+	if l == nil {
+		l = office365.NopLogger{}
+	}
+	return &Handler{queue: q, next: next, logger: l}
+}
+
+// Handle implements the office365.ResourceHandler interface.
+// It returns once in is closed, when the next handler returns,
+// or when a record can not be queued, with its error.
+// Records delivered but not acknowledged by then are delivered again
+// the next time the queue is opened.
+func (h *Handler) Handle(in <-chan office365.ResourceAudits) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if depth := h.queue.Depth(); depth > 0 {
+		h.logger.Infof("queue: delivering %d queued record(s)", depth)
+	}
+
+	delivered := make(chan struct{})
+	var deliverErr error
+	go func() {
+		defer close(delivered)
+		deliverErr = h.next.Handle(h.deliver(ctx))
+		if deliverErr == nil && ctx.Err() == nil {
+			deliverErr = errors.New("queue: next handler stopped")
+		}
+		cancel()
+	}()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	var unsynced []office365.ResourceAudits
+	sync := func() error {
+		if len(unsynced) == 0 {
+			return nil
+		}
+		if err := h.queue.Sync(); err != nil {
+			return err
+		}
+		for _, r := range unsynced {
+			r.Ack()
+		}
+		unsynced = unsynced[:0]
+		return nil
+	}
+	// stop delivery and wait for the next handler
+	stop := func(err error) error {
+		cancel()
+		<-delivered
+		if err == nil {
+			err = deliverErr
+		}
+		if ferr := h.queue.Flush(); err == nil {
+			err = ferr
+		}
+		return err
+	}
+
+	for {
+		select {
+		case r, ok := <-in:
+			if !ok {
+				return stop(sync())
+			}
+			data, err := encodeRecord(r)
+			if err != nil {
+				// the record is not acknowledged, so that its content is fetched again
+				return stop(fmt.Errorf("queue: could not encode record: %s", err))
+			}
+			if err := h.queue.Put(ctx, data); err != nil {
+				if errors.Is(err, context.Canceled) {
+					// delivery stopped while the queue was full
+					return stop(nil)
+				}
+				return stop(err)
+			}
+			unsynced = append(unsynced, r)
+			if len(unsynced) >= maxUnsynced {
+				if err := sync(); err != nil {
+					return stop(err)
+				}
+			}
+		case <-ticker.C:
+			if err := sync(); err != nil {
+				return stop(err)
+			}
+			if err := h.queue.Flush(); err != nil {
+				return stop(err)
+			}
+		case <-delivered:
+			return stop(sync())
+		}
+	}
+}
+
+// deliver returns a channel of the queued records, until ctx is done.
+func (h *Handler) deliver(ctx context.Context) <-chan office365.ResourceAudits {
+	out := make(chan office365.ResourceAudits)
+	go func() {
+		defer close(out)
+		for {
+			e, err := h.queue.Get(ctx)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) && !errors.Is(err, ErrClosed) {
+					h.logger.Errorf("queue: could not get record: %s", err)
+				}
+				return
+			}
+			r, err := decodeRecord(e.Data)
+			if err != nil {
+				h.logger.Errorf("queue: could not decode record: %s", err)
+				h.queue.Ack(e)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- r.WithAck(func() { h.queue.Ack(e) }):
+			}
+		}
+	}()
+	return out
+}
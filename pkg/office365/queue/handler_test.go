@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func testDeep(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%v\nbut want\n%v", got, want)
+	}
+}
+
+// recordingHandler implements the office365.ResourceHandler interface
+// and sends the records it receives on a channel, acknowledging them when ack is set.
+type recordingHandler struct {
+	ack      bool
+	received chan office365.ResourceAudits
+}
+
+func (h recordingHandler) Handle(in <-chan office365.ResourceAudits) error {
+	for r := range in {
+		h.received <- r
+		if h.ack {
+			r.Ack()
+		}
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	ct := schema.AuditExchange
+	tp := schema.ExchangeAdminType
+	scope := schema.Onprem
+	records := []interface{}{
+		schema.AuditRecord{ID: office365.String("1"), RecordType: &tp, Scope: &scope},
+		schema.ExchangeAdmin{AuditRecord: schema.AuditRecord{ID: office365.String("2"), RecordType: &tp}},
+	}
+	requestTime := time.Date(2020, 4, 16, 12, 30, 0, 0, time.UTC)
+
+	// records are acknowledged to the watcher once queued,
+	// even though the next handler does not acknowledge them
+	run := func(in []interface{}, next recordingHandler) []office365.ResourceAudits {
+		q := openQueue(t, dir, Options{})
+		defer q.Close()
+
+		var acked sync.WaitGroup
+		ch := make(chan office365.ResourceAudits)
+		handleErr := make(chan error)
+		go func() {
+			handleErr <- NewHandler(q, next, nil).Handle(ch)
+		}()
+		for _, r := range in {
+			acked.Add(1)
+			ch <- office365.ResourceAudits{ContentType: &ct, RequestTime: requestTime, AuditRecord: r}.WithAck(acked.Done)
+		}
+		acked.Wait()
+		var received []office365.ResourceAudits
+		for range records {
+			received = append(received, <-next.received)
+		}
+		close(ch)
+		if err := <-handleErr; err != nil {
+			t.Fatal(err)
+		}
+		return received
+	}
+
+	run(records, recordingHandler{received: make(chan office365.ResourceAudits, len(records))})
+
+	// records not acknowledged by the next handler are delivered again,
+	// using the type they were queued with
+	received := run(nil, recordingHandler{ack: true, received: make(chan office365.ResourceAudits, len(records))})
+
+	var got []interface{}
+	for _, r := range received {
+		if r.ContentType == nil || *r.ContentType != ct || !r.RequestTime.Equal(requestTime) {
+			t.Errorf("got content type %v and request time %v", r.ContentType, r.RequestTime)
+		}
+		got = append(got, r.AuditRecord)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d record(s) but want %d", len(got), len(records))
+	}
+	testDeep(t, got, records)
+
+	q := openQueue(t, dir, Options{})
+	defer q.Close()
+	if got := q.Depth(); got != 0 {
+		t.Errorf("got depth %d once every record was acknowledged", got)
+	}
+}
+
+type failingHandler struct{}
+
+func (failingHandler) Handle(in <-chan office365.ResourceAudits) error {
+	<-in
+	return errors.New("output down")
+}
+
+func TestHandlerNextError(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	defer q.Close()
+
+	ct := schema.AuditExchange
+	ch := make(chan office365.ResourceAudits, 1)
+	ch <- office365.ResourceAudits{ContentType: &ct, AuditRecord: schema.AuditRecord{}}
+
+	err := NewHandler(q, failingHandler{}, nil).Handle(ch)
+	if err == nil || err.Error() != "output down" {
+		t.Errorf("got error %v but want the error of the next handler", err)
+	}
+	if got := q.Depth(); got != 1 {
+		t.Errorf("got depth %d but want the record to be kept", got)
+	}
+}
+
+func TestHandlerEncodeError(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	defer q.Close()
+
+	ct := schema.AuditExchange
+	var acked bool
+	ch := make(chan office365.ResourceAudits, 1)
+	// records of an unregistered type can not be queued
+	ch <- office365.ResourceAudits{ContentType: &ct, AuditRecord: map[string]interface{}{"Id": "1"}}.WithAck(func() { acked = true })
+
+	next := recordingHandler{received: make(chan office365.ResourceAudits, 1)}
+	if err := NewHandler(q, next, nil).Handle(ch); err == nil {
+		t.Errorf("got no error for a record that can not be queued")
+	}
+	if acked {
+		t.Errorf("record that can not be queued was acknowledged")
+	}
+	if got := q.Depth(); got != 0 {
+		t.Errorf("got depth %d but want no record queued", got)
+	}
+}
@@ -0,0 +1,549 @@
+// Package queue provides a persistent queue of records, used to decouple
+// the collection of records from their delivery to an output.
+//
+// Records are appended to segment files of a directory and delivered in order.
+// The position of the first record not yet acknowledged is kept in a cursor file,
+// so that records that were not delivered before a restart are delivered again.
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/devodev/go-office365/v0/internal/filelock"
+)
+
+const (
+	segmentExt = ".seg"
+	cursorName = "cursor"
+	lockName   = "lock"
+
+	// headerSize is the size of the length and checksum preceding every entry.
+	headerSize = 8
+	// maxEntrySize guards against reading a corrupted length.
+	maxEntrySize = 1 << 28
+)
+
+var (
+	// ErrLocked is returned by Open when the queue is used by another process.
+	ErrLocked = errors.New("queue is locked by another process")
+	// ErrClosed is returned when using a closed queue.
+	ErrClosed = errors.New("queue is closed")
+	// ErrCorrupted is returned when an entry cannot be read back.
+	ErrCorrupted = errors.New("queue entry corrupted")
+)
+
+// Options configures a Queue.
+type Options struct {
+	// SegmentSize is the size, in bytes, above which a new segment file is started.
+	SegmentSize int64
+	// MaxSize is the maximum size, in bytes, of the entries not yet acknowledged.
+	// Put blocks while the queue is full.
+	MaxSize int64
+}
+
+var (
+	defaultSegmentSize int64 = 64 << 20
+	defaultMaxSize     int64 = 1 << 30
+)
+
+// position locates an entry within the segments.
+type position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Entry is an entry returned by Get. It must be acknowledged using Ack
+// once it has been delivered.
+type Entry struct {
+	Data []byte
+
+	end   position
+	size  int64
+	acked bool
+}
+
+// Queue is a persistent FIFO queue backed by segment files.
+// It is safe for concurrent use.
+type Queue struct {
+	dir  string
+	opts Options
+	lock *os.File
+
+	mu      sync.Mutex
+	changed chan struct{}
+	closed  bool
+
+	writer    *os.File
+	write     position
+	reader    *os.File
+	readerSeg uint64
+	read      position
+	committed position
+	pending   []*Entry
+	persisted position
+
+	size  int64
+	depth int64
+}
+
+// Open opens or creates the queue located in dir.
+// Entries that were not acknowledged before the queue was last closed
+// are delivered again.
+func Open(dir string, opts Options) (*Queue, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := filelock.Lock(lock); err != nil {
+		lock.Close()
+		return nil, ErrLocked
+	}
+
+	q := &Queue{dir: dir, opts: opts, lock: lock, changed: make(chan struct{})}
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	return q, nil
+}
+
+// recover restores the cursor and the write position from the files found in dir,
+// discarding a partially written entry, if any.
+func (q *Queue) recover() error {
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+	cursor, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	// segments preceding the cursor may not have been removed yet
+	for len(segments) > 0 && segments[0] < cursor.Segment {
+		if err := os.Remove(q.segmentPath(segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		segments = []uint64{cursor.Segment}
+	}
+	if segments[0] > cursor.Segment {
+		cursor = position{Segment: segments[0]}
+	}
+
+	for idx, seg := range segments {
+		start := int64(0)
+		if seg == cursor.Segment {
+			start = cursor.Offset
+		}
+		end, depth, err := q.scan(seg, start)
+		if err != nil {
+			return err
+		}
+		if end < start {
+			// entries delivered before being synced were lost
+			cursor.Offset = end
+			start = end
+		}
+		q.size += end - start
+		q.depth += depth
+
+		if idx == len(segments)-1 {
+			f, err := os.OpenFile(q.segmentPath(seg), os.O_RDWR|os.O_CREATE, 0640)
+			if err != nil {
+				return err
+			}
+			// discard a partially written entry
+			if err := f.Truncate(end); err != nil {
+				f.Close()
+				return err
+			}
+			if _, err := f.Seek(end, io.SeekStart); err != nil {
+				f.Close()
+				return err
+			}
+			q.writer = f
+			q.write = position{seg, end}
+		}
+	}
+	q.committed = cursor
+	q.persisted = cursor
+	q.read = cursor
+	return nil
+}
+
+// scan returns the end of the last valid entry of the segment
+// and the number of entries found from start.
+func (q *Queue) scan(seg uint64, start int64) (int64, int64, error) {
+	f, err := os.Open(q.segmentPath(seg))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if start > info.Size() {
+		return info.Size(), 0, nil
+	}
+
+	var depth int64
+	offset := start
+	for {
+		data, err := readEntry(f, offset)
+		if err != nil {
+			return offset, depth, nil
+		}
+		offset += headerSize + int64(len(data))
+		depth++
+	}
+}
+
+// Put appends an entry to the queue, blocking while the queue is full.
+// The entry is durable once Sync returns.
+func (q *Queue) Put(ctx context.Context, data []byte) error {
+	n := headerSize + int64(len(data))
+
+	q.mu.Lock()
+	for {
+		if q.closed {
+			q.mu.Unlock()
+			return ErrClosed
+		}
+		// an entry larger than the queue is accepted once the queue is empty
+		if q.size == 0 || q.size+n <= q.opts.MaxSize {
+			break
+		}
+		if err := q.wait(ctx); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	defer q.mu.Unlock()
+
+	if q.write.Offset > 0 && q.write.Offset+n > q.opts.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+	if _, err := q.writer.Write(buf); err != nil {
+		return err
+	}
+	q.write.Offset += n
+	q.size += n
+	q.depth++
+	q.notify()
+	return nil
+}
+
+// rotate syncs the current segment and starts a new one.
+func (q *Queue) rotate() error {
+	if err := q.writer.Sync(); err != nil {
+		return err
+	}
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+	next := q.write.Segment + 1
+	f, err := os.OpenFile(q.segmentPath(next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	q.writer = f
+	q.write = position{Segment: next}
+	return filelock.SyncDir(q.dir)
+}
+
+// Sync makes the entries put so far durable.
+func (q *Queue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	return q.writer.Sync()
+}
+
+// Get returns the next entry, blocking until one is available.
+// Entries are returned in order, once each.
+func (q *Queue) Get(ctx context.Context) (*Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil, ErrClosed
+		}
+		if q.read == q.write {
+			if err := q.wait(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if q.reader == nil || q.readerSeg != q.read.Segment {
+			if q.reader != nil {
+				q.reader.Close()
+			}
+			f, err := os.Open(q.segmentPath(q.read.Segment))
+			if err != nil {
+				return nil, err
+			}
+			q.reader = f
+			q.readerSeg = q.read.Segment
+		}
+		data, err := readEntry(q.reader, q.read.Offset)
+		if err != nil {
+			if q.read.Segment < q.write.Segment {
+				// end of a previous segment
+				q.read = position{Segment: q.read.Segment + 1}
+				continue
+			}
+			return nil, err
+		}
+
+		size := headerSize + int64(len(data))
+		q.read.Offset += size
+		e := &Entry{Data: data, end: q.read, size: size}
+		q.pending = append(q.pending, e)
+		return e, nil
+	}
+}
+
+// Ack acknowledges an entry returned by Get. The cursor moves past the entry
+// once every entry returned before it has also been acknowledged.
+func (q *Queue) Ack(e *Entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e.acked {
+		return
+	}
+	e.acked = true
+
+	moved := false
+	for len(q.pending) > 0 && q.pending[0].acked {
+		head := q.pending[0]
+		q.pending = q.pending[1:]
+		q.committed = head.end
+		q.size -= head.size
+		q.depth--
+		moved = true
+	}
+	if moved {
+		q.notify()
+	}
+}
+
+// Flush persists the cursor, so that acknowledged entries are not delivered
+// again after a restart, and removes the segments it moved past.
+func (q *Queue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.flush()
+}
+
+func (q *Queue) flush() error {
+	if q.committed == q.persisted {
+		return nil
+	}
+	data, err := json.Marshal(q.committed)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.dir, cursorName+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, cursorName)); err != nil {
+		return err
+	}
+	if err := filelock.SyncDir(q.dir); err != nil {
+		return err
+	}
+	for seg := q.persisted.Segment; seg < q.committed.Segment; seg++ {
+		if err := os.Remove(q.segmentPath(seg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	q.persisted = q.committed
+	return nil
+}
+
+// Depth returns the number of entries not yet acknowledged.
+func (q *Queue) Depth() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// Size returns the size, in bytes, of the entries not yet acknowledged.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Close persists the cursor and releases the queue.
+// Blocked calls to Put and Get return ErrClosed.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.notify()
+
+	err := q.flush()
+	if serr := q.writer.Sync(); err == nil {
+		err = serr
+	}
+	q.closeFiles()
+	return err
+}
+
+func (q *Queue) closeFiles() {
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	filelock.Unlock(q.lock)
+	q.lock.Close()
+}
+
+// wait releases the lock until the queue changes or ctx is done.
+// It must be called with the lock held.
+func (q *Queue) wait(ctx context.Context) error {
+	ch := q.changed
+	q.mu.Unlock()
+	defer q.mu.Lock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+		return nil
+	}
+}
+
+// notify wakes up the calls waiting for the queue to change.
+// It must be called with the lock held.
+func (q *Queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *Queue) segmentPath(seg uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016x%s", seg, segmentExt))
+}
+
+// segments returns the segments found in the directory, in order.
+func (q *Queue) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seg, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// readCursor returns the persisted cursor, or the start of the first segment.
+func (q *Queue) readCursor() (position, error) {
+	cursor := position{Segment: 1}
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, cursorName))
+	if os.IsNotExist(err) {
+		return cursor, nil
+	}
+	if err != nil {
+		return cursor, err
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("could not read queue cursor: %s", err)
+	}
+	return cursor, nil
+}
+
+// readEntry reads the entry located at offset.
+func readEntry(f *os.File, offset int64) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n > maxEntrySize {
+		return nil, ErrCorrupted
+	}
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, offset+headerSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrCorrupted
+	}
+	return data, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,232 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func openQueue(t *testing.T, dir string, opts Options) *Queue {
+	t.Helper()
+	q, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("could not open queue: %s", err)
+	}
+	return q
+}
+
+func put(t *testing.T, q *Queue, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		if err := q.Put(context.Background(), []byte(v)); err != nil {
+			t.Fatalf("could not put %s: %s", v, err)
+		}
+	}
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, q *Queue, n int) ([]string, []*Entry) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var values []string
+	var entries []*Entry
+	for i := 0; i < n; i++ {
+		e, err := q.Get(ctx)
+		if err != nil {
+			t.Fatalf("could not get entry %d: %s", i, err)
+		}
+		values = append(values, string(e.Data))
+		entries = append(entries, e)
+	}
+	return values, entries
+}
+
+func TestQueue(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	put(t, q, "a", "b", "c")
+	if got := q.Depth(); got != 3 {
+		t.Errorf("got depth %d but want 3", got)
+	}
+
+	values, entries := get(t, q, 3)
+	testDeep(t, values, []string{"a", "b", "c"})
+
+	// the cursor only moves past contiguous acknowledged entries
+	q.Ack(entries[1])
+	if got := q.Depth(); got != 3 {
+		t.Errorf("got depth %d but want 3", got)
+	}
+	q.Ack(entries[0])
+	if got := q.Depth(); got != 1 {
+		t.Errorf("got depth %d but want 1", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got error %v from an empty queue but want %v", err, context.DeadlineExceeded)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	put(t, q, "a", "b", "c")
+	_, entries := get(t, q, 2)
+	q.Ack(entries[0])
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, Options{})
+	defer q.Close()
+
+	// b was delivered but never acknowledged
+	if got := q.Depth(); got != 2 {
+		t.Errorf("got depth %d but want 2", got)
+	}
+	values, _ := get(t, q, 2)
+	testDeep(t, values, []string{"b", "c"})
+}
+
+func TestQueueLocked(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	defer q.Close()
+
+	if _, err := Open(dir, Options{}); err != ErrLocked {
+		t.Errorf("got error %v but want %v", err, ErrLocked)
+	}
+}
+
+func TestQueueSegments(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	// every entry gets its own segment
+	q := openQueue(t, dir, Options{SegmentSize: headerSize + 1})
+	put(t, q, "a", "b", "c")
+
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("got %d segment(s) but want 3", len(segments))
+	}
+
+	values, entries := get(t, q, 3)
+	testDeep(t, values, []string{"a", "b", "c"})
+	q.Ack(entries[0])
+	q.Ack(entries[1])
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// segments are removed once the cursor moves past them
+	segments, err = q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Errorf("got %d segment(s) but want 2", len(segments))
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, Options{SegmentSize: headerSize + 1})
+	defer q.Close()
+	values, _ = get(t, q, 1)
+	testDeep(t, values, []string{"c"})
+}
+
+func TestQueueMaxSize(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{MaxSize: 2 * (headerSize + 1)})
+	defer q.Close()
+	put(t, q, "a", "b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Put(ctx, []byte("c")); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v putting to a full queue but want %v", err, context.DeadlineExceeded)
+	}
+
+	putErr := make(chan error)
+	go func() {
+		putErr <- q.Put(context.Background(), []byte("c"))
+	}()
+	_, entries := get(t, q, 1)
+	q.Ack(entries[0])
+	select {
+	case err := <-putErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("put still blocked after the queue freed space")
+	}
+}
+
+func TestQueuePartialWrite(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	q := openQueue(t, dir, Options{})
+	put(t, q, "a", "b")
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash while writing c
+	path := filepath.Join(dir, fmt.Sprintf("%016x%s", segments[0], segmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 1, 0})
+	f.Close()
+
+	q = openQueue(t, dir, Options{})
+	defer q.Close()
+	if got := q.Depth(); got != 2 {
+		t.Errorf("got depth %d but want 2", got)
+	}
+	put(t, q, "d")
+	values, _ := get(t, q, 3)
+	testDeep(t, values, []string{"a", "b", "d"})
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// Records are encoded using gob so that they are delivered using the type
+// they were queued with. Their JSON representation cannot always be decoded back.
+// Records of an unregistered type can not be queued.
+func init() {
+	// types returned by office365.AuditService.List
+	gob.Register(schema.AuditRecord{})
+	gob.Register(schema.ATP{})
+	gob.Register(schema.AzureActiveDirectory{})
+	gob.Register(schema.AzureActiveDirectoryAccountLogon{})
+	gob.Register(schema.AzureActiveDirectorySTSLogon{})
+	gob.Register(schema.DataCenterSecurityCmdlet{})
+	gob.Register(schema.ExchangeAdmin{})
+	gob.Register(schema.ExchangeItem{})
+	gob.Register(schema.MicrosoftTeams{})
+	gob.Register(schema.PowerBI{})
+	gob.Register(schema.Project{})
+	gob.Register(schema.Quarantine{})
+	gob.Register(schema.SecurityComplianceAlerts{})
+	gob.Register(schema.SecurityComplianceCenter{})
+	gob.Register(schema.Sharepoint{})
+	gob.Register(schema.SharepointBase{})
+	gob.Register(schema.SharepointFileOperations{})
+	gob.Register(schema.SharepointSharing{})
+	gob.Register(schema.Sway{})
+	gob.Register(schema.URLTimeOfClickEvents{})
+	gob.Register(schema.WorkplaceAnalytics{})
+	gob.Register(schema.Yammer{})
+}
+
+// record is the queued representation of an office365.ResourceAudits.
+type record struct {
+	ContentType string
+	RequestTime time.Time
+	Record      interface{}
+}
+
+// encodeRecord returns the queued representation of the provided record.
+// It returns an error when the type of the record is not registered with gob.
+func encodeRecord(r office365.ResourceAudits) ([]byte, error) {
+	rec := record{ContentType: r.ContentType.String(), RequestTime: r.RequestTime, Record: r.AuditRecord}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		return nil, fmt.Errorf("record of type %T: %s", r.AuditRecord, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRecord returns the record queued using encodeRecord.
+// It is not acknowledged using any function.
+func decodeRecord(data []byte) (office365.ResourceAudits, error) {
+	var rec record
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		return office365.ResourceAudits{}, err
+	}
+	ct, err := schema.GetContentType(rec.ContentType)
+	if err != nil {
+		return office365.ResourceAudits{}, fmt.Errorf("%s: %s", err, rec.ContentType)
+	}
+	return office365.ResourceAudits{
+		ContentType: ct,
+		RequestTime: rec.RequestTime,
+		AuditRecord: rec.Record,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestRecordTypes(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+	q := openQueue(t, dir, Options{})
+	defer q.Close()
+
+	ct := schema.AuditGeneral
+	requestTime := time.Date(2020, 4, 16, 12, 30, 0, 0, time.UTC)
+
+	// every type returned by office365.AuditService.List is queued using its own type
+	var records []interface{}
+	for tp := schema.ExchangeAdminType; tp <= schema.MicrosoftFormsType; tp++ {
+		if tp.String() == "" {
+			continue
+		}
+		raw := json.RawMessage(fmt.Sprintf(`{"Id":"%d","RecordType":%d,"Operation":"op","UserId":"user"}`, tp, tp))
+		var r schema.AuditRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			t.Fatal(err)
+		}
+		var data interface{} = r
+		office365.AddExtendedSchema(r.RecordType, raw, &data)
+		records = append(records, data)
+
+		enc, err := encodeRecord(office365.ResourceAudits{ContentType: &ct, RequestTime: requestTime, AuditRecord: data})
+		if err != nil {
+			t.Fatalf("%s: could not encode record: %s", tp, err)
+		}
+		put(t, q, string(enc))
+	}
+
+	_, entries := get(t, q, len(records))
+	for i, e := range entries {
+		got, err := decodeRecord(e.Data)
+		if err != nil {
+			t.Fatalf("could not decode record %d: %s", i, err)
+		}
+		if got.ContentType == nil || *got.ContentType != ct || !got.RequestTime.Equal(requestTime) {
+			t.Errorf("got content type %v and request time %v", got.ContentType, got.RequestTime)
+		}
+		if !reflect.DeepEqual(got.AuditRecord, records[i]) {
+			t.Errorf("got %T\n%v\nbut want %T\n%v", got.AuditRecord, got.AuditRecord, records[i], records[i])
+		}
+	}
+
+	// records of an unregistered type can not be queued
+	if _, err := encodeRecord(office365.ResourceAudits{ContentType: &ct, AuditRecord: map[string]interface{}{"Id": "1"}}); err == nil {
+		t.Error("encodeRecord: got no error for a record of an unregistered type")
+	}
+}
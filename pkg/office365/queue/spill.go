@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+)
+
+// Spill implements the office365.Spill interface using a Queue,
+// for sinks using office365.SinkSpill.
+type Spill struct {
+	queue   *Queue
+	flushed time.Time
+}
+
+// NewSpill returns a Spill storing records in q.
+func NewSpill(q *Queue) *Spill {
+	return &Spill{queue: q, flushed: time.Now()}
+}
+
+// Put implements the office365.Spill interface.
+// It blocks while the queue is full.
+func (s *Spill) Put(ctx context.Context, r office365.ResourceAudits) error {
+	data, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	if err := s.queue.Put(ctx, data); err != nil {
+		return err
+	}
+	return s.queue.Sync()
+}
+
+// Get implements the office365.Spill interface.
+// It persists the cursor of the queue at most every syncInterval, so that
+// acknowledged records are not returned again after a restart.
+// A record that can not be decoded is removed, and its error returned.
+// Get must not be called concurrently.
+func (s *Spill) Get(ctx context.Context) (office365.ResourceAudits, error) {
+	if time.Since(s.flushed) >= syncInterval {
+		if err := s.queue.Flush(); err != nil {
+			return office365.ResourceAudits{}, err
+		}
+		s.flushed = time.Now()
+	}
+	e, err := s.queue.Get(ctx)
+	if err != nil {
+		return office365.ResourceAudits{}, err
+	}
+	r, err := decodeRecord(e.Data)
+	if err != nil {
+		s.queue.Ack(e)
+		return office365.ResourceAudits{}, fmt.Errorf("queue: could not decode record: %s", err)
+	}
+	return r.WithAck(func() { s.queue.Ack(e) }), nil
+}
+
+// Depth implements the office365.Spill interface.
+func (s *Spill) Depth() int64 {
+	return s.queue.Depth()
+}
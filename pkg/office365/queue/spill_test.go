@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestSpill(t *testing.T) {
+	dir, teardown := tempDir(t)
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ct := schema.AuditExchange
+	records := []interface{}{
+		schema.AuditRecord{ID: office365.String("1")},
+		schema.AuditRecord{ID: office365.String("2")},
+	}
+
+	q := openQueue(t, dir, Options{})
+	spill := NewSpill(q)
+	for _, r := range records {
+		if err := spill.Put(ctx, office365.ResourceAudits{ContentType: &ct, AuditRecord: r}); err != nil {
+			t.Fatalf("Put: unexpected error: %s", err)
+		}
+	}
+	if got := spill.Depth(); got != 2 {
+		t.Errorf("got depth %d but want 2", got)
+	}
+	// the first record is acknowledged, the second one is returned again once reopened
+	r, err := spill.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %s", err)
+	}
+	testDeep(t, r.AuditRecord, records[0])
+	r.Ack()
+	if _, err := spill.Get(ctx); err != nil {
+		t.Fatalf("Get: unexpected error: %s", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, Options{})
+	defer q.Close()
+	spill = NewSpill(q)
+	if got := spill.Depth(); got != 1 {
+		t.Errorf("got depth %d but want 1", got)
+	}
+	r, err = spill.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %s", err)
+	}
+	testDeep(t, r.AuditRecord, records[1])
+}
@@ -0,0 +1,96 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// planRescan returns the chunks of the window that tailing already went through,
+// up to RescanHorizonMinutes in the past, for the provided content type.
+// The window stops a lookbehind short of the request time checkpoint
+// so that it does not overlap with the window currently tailed.
+func (s *SubscriptionWatcher) planRescan(ctx context.Context, ct schema.ContentType, now time.Time) ([]*backfillChunk, error) {
+	lastRequestTime, err := s.State.LastRequestTime(ctx, ct)
+	if err != nil {
+		return nil, err
+	}
+	if lastRequestTime.IsZero() {
+		return nil, nil
+	}
+
+	end := lastRequestTime.Add(-(time.Duration(s.Config().LookBehindMinutes) * time.Minute))
+	start := end.Add(-(time.Duration(s.Config().RescanHorizonMinutes) * time.Minute))
+	if earliest := now.Add(-intervalOneWeek).Add(backfillMargin); start.Before(earliest) {
+		start = earliest
+	}
+	return splitWindow(ct, start, end), nil
+}
+
+// rescan lists the trailing windows of the provided content types again,
+// so that content showing up in listings after tailing went past their
+// creation time is picked up. Content already processed is skipped.
+// Late content is reported along with its age when it was found.
+func (s *SubscriptionWatcher) rescan(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, contentTypes []schema.ContentType, now time.Time) {
+	s.logger.Debugf("rescan: start")
+
+	for _, ct := range contentTypes {
+		ctLogger := s.logger.WithField("content-type", ct.String())
+
+		chunks, err := s.planRescan(ctx, ct, now)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctLogger.Errorf("rescan: could not plan: %s", err)
+			}
+			continue
+		}
+
+		var late int
+		var maxAge time.Duration
+		for _, c := range chunks {
+			ctLogger.Debugf("rescan: fetching chunk %s - %s", c.Start.String(), c.End.String())
+
+			fetched, err := s.fetchWindow(ctx, done, out, c.ContentType, WindowSourceRescan, c.Start, c.End, now)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+				ctLogger.Errorf("rescan: chunk %s - %s failed: %s", c.Start.String(), c.End.String(), err)
+				s.status.fail(ct, err)
+				continue
+			}
+			for _, res := range fetched {
+				age := now.Sub(res.created)
+				ctLogger.Warnf("rescan: fetched late content %s created %s, found %s after its creation", res.Content.ContentID, res.created.String(), age.String())
+
+				s.Metrics.RescannedContent(ct, age)
+				late++
+				if age > maxAge {
+					maxAge = age
+				}
+			}
+		}
+		if late > 0 {
+			ctLogger.Infof("rescan: fetched %d late content blob(s), at most %s after their creation", late, maxAge.String())
+		}
+	}
+	s.logger.Debugf("rescan: end")
+}
+
+// runRescan rescans the trailing windows of the selected content types
+// every RescanIntervalSeconds until the watcher stops.
+func (s *SubscriptionWatcher) runRescan(ctx context.Context, done chan struct{}, out chan<- ResourceAudits) {
+	ticker := time.NewTicker(time.Duration(s.Config().RescanIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case t := <-ticker.C:
+			s.rescan(ctx, done, out, s.Config().ContentTypes(), t)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package office365
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestPlanRescan(t *testing.T) {
+	now := time.Date(2020, 4, 16, 12, 30, 45, 0, time.UTC)
+	ct := schema.AuditExchange
+
+	cases := []struct {
+		Horizon         int
+		LastRequestTime time.Time
+		WantStart       time.Time
+		WantEnd         time.Time
+		WantChunks      int
+	}{
+		{
+			Horizon:    12 * 60,
+			WantChunks: 0,
+		},
+		{
+			Horizon:         12 * 60,
+			LastRequestTime: now,
+			WantStart:       now.Add(-time.Minute).Add(-12 * time.Hour).Truncate(time.Minute),
+			WantEnd:         now.Add(-time.Minute).Truncate(time.Minute),
+			WantChunks:      1,
+		},
+		{
+			Horizon:         36 * 60,
+			LastRequestTime: now,
+			WantStart:       now.Add(-time.Minute).Add(-36 * time.Hour).Truncate(time.Minute),
+			WantEnd:         now.Add(-time.Minute).Truncate(time.Minute),
+			WantChunks:      2,
+		},
+		{
+			Horizon:         7 * 24 * 60,
+			LastRequestTime: now,
+			WantStart:       now.Add(-intervalOneWeek).Add(backfillMargin).Truncate(time.Minute),
+			WantEnd:         now.Add(-time.Minute).Truncate(time.Minute),
+			WantChunks:      7,
+		},
+	}
+
+	for idx, c := range cases {
+		t.Run(fmt.Sprintf("%d.", idx+1), func(t *testing.T) {
+			watcher := stubWatcher(t, nil, SubscriptionWatcherConfig{RescanHorizonMinutes: c.Horizon, RescanIntervalSeconds: 1})
+			if !c.LastRequestTime.IsZero() {
+				watcher.SetLastRequestTime(context.Background(), ct, c.LastRequestTime)
+			}
+
+			chunks, err := watcher.planRescan(context.Background(), ct, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != c.WantChunks {
+				t.Fatalf("got %d chunks but want %d", len(chunks), c.WantChunks)
+			}
+			if len(chunks) == 0 {
+				return
+			}
+			if got := chunks[0].Start; !got.Equal(c.WantStart) {
+				t.Errorf("got start %v but want %v", got, c.WantStart)
+			}
+			if got := chunks[len(chunks)-1].End; !got.Equal(c.WantEnd) {
+				t.Errorf("got end %v but want %v", got, c.WantEnd)
+			}
+		})
+	}
+}
+
+func TestRescanLateContent(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditGeneral
+	now := time.Now()
+	created := now.Add(-time.Hour).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+	content := []Content{
+		{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Format(CreatedDatetimeFormat)},
+		{ContentType: ct.String(), ContentID: "late", ContentCreated: created.Format(CreatedDatetimeFormat)},
+	}
+	audits := map[string][]interface{}{
+		"abc":  {schema.AuditRecord{ID: String("1"), RecordType: &tp}},
+		"late": {schema.AuditRecord{ID: String("2"), RecordType: &tp}},
+	}
+	stubContentPipeline(t, mux, client, content, audits)
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{RescanHorizonMinutes: 12 * 60, RescanIntervalSeconds: 1})
+	ctx := context.Background()
+	// tailing went past the content, but only listed abc
+	watcher.SetLastRequestTime(ctx, ct, now)
+	watcher.SetContentProcessed(ctx, ct, "abc", created.Add(intervalOneWeek))
+
+	done := make(chan struct{})
+	defer close(done)
+	out := make(chan ResourceAudits)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		watcher.rescan(ctx, done, out, []schema.ContentType{ct}, now)
+	}()
+
+	var ids []string
+Loop:
+	for {
+		select {
+		case r := <-out:
+			ids = append(ids, *r.AuditRecord.(schema.AuditRecord).ID)
+			r.Ack()
+		case <-finished:
+			break Loop
+		}
+	}
+	testDeep(t, ids, []string{"2"})
+
+	if ok, _ := watcher.ContentProcessed(ctx, ct, "late"); !ok {
+		t.Errorf("late content not recorded as processed")
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"io"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 // ResourceHandler is an interface for handling streamed resources.
+// Implementations must call Ack on every resource once it has been durably handled,
+// that is, once it would not be lost if the process was to exit.
+// Resources that are never acknowledged are fetched again on the next run.
+// Handle should return an error when resources can no longer be handled.
 type ResourceHandler interface {
 	Handle(<-chan ResourceAudits) error
 }
@@ -19,13 +21,14 @@ type ResourceHandler interface {
 // It writes json representation of a resource on the provided writer.
 type JSONHandler struct {
 	writer io.Writer
-	logger *logrus.Logger
+	logger Logger
 	indent bool
 }
 
 // NewJSONHandler returns a JSONHandler using the provided writer.
-func NewJSONHandler(w io.Writer, l *logrus.Logger, indent bool) *JSONHandler {
-	return &JSONHandler{w, l, indent}
+// Nothing is logged when l is nil.
+func NewJSONHandler(w io.Writer, l Logger, indent bool) *JSONHandler {
+	return &JSONHandler{w, orNop(l), indent}
 }
 
 // Handle .
@@ -38,20 +41,26 @@ func (h JSONHandler) Handle(in <-chan ResourceAudits) error {
 		}
 		recordStr, err := json.Marshal(record)
 		if err != nil {
-			h.logger.Error(err)
+			// the record can never be written, acknowledge it so that it does not
+			// hold back the checkpoint of its content type
+			h.logger.Errorf("%s", err)
+			res.Ack()
 			continue
 		}
-		if !h.indent {
-			fmt.Fprintln(h.writer, string(recordStr))
-			continue
+		line := string(recordStr)
+		if h.indent {
+			var out bytes.Buffer
+			if err := json.Indent(&out, recordStr, "", "\t"); err != nil {
+				h.logger.Errorf("%s", err)
+				res.Ack()
+				continue
+			}
+			line = out.String()
 		}
-		var out bytes.Buffer
-		err = json.Indent(&out, recordStr, "", "\t")
-		if err != nil {
-			h.logger.Error(err)
-			continue
+		if _, err := fmt.Fprintln(h.writer, line); err != nil {
+			return err
 		}
-		fmt.Fprintln(h.writer, out.String())
+		res.Ack()
 	}
 	return nil
 }
@@ -0,0 +1,193 @@
+package office365
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// RouteMatch selects the records sent to a route.
+// A record matches when it matches every non empty list of the RouteMatch,
+// and it matches a list when one of its values is equal to the corresponding
+// record field. Record types, workloads and operations are compared case-insensitively.
+// An empty RouteMatch matches every record.
+type RouteMatch struct {
+	ContentTypes []schema.ContentType
+	RecordTypes  []string
+	Workloads    []string
+	Operations   []string
+}
+
+// Matches returns whether the provided record matches.
+func (m RouteMatch) Matches(res ResourceAudits) bool {
+	if len(m.ContentTypes) > 0 {
+		if res.ContentType == nil {
+			return false
+		}
+		found := false
+		for _, ct := range m.ContentTypes {
+			if ct == *res.ContentType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(m.RecordTypes) == 0 && len(m.Workloads) == 0 && len(m.Operations) == 0 {
+		return true
+	}
+	base, ok := BaseRecord(res.AuditRecord)
+	if !ok {
+		return false
+	}
+	var recordType, workload, operation string
+	if base.RecordType != nil {
+		recordType = base.RecordType.String()
+	}
+	if base.Workload != nil {
+		workload = *base.Workload
+	}
+	if base.Operation != nil {
+		operation = *base.Operation
+	}
+	return matchAny(m.RecordTypes, recordType) &&
+		matchAny(m.Workloads, workload) &&
+		matchAny(m.Operations, operation)
+}
+
+// matchAny returns whether values is empty or contains v, ignoring case.
+func matchAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route sends the records matching Match to Handler.
+// Name is used when logging.
+type Route struct {
+	Name    string
+	Match   RouteMatch
+	Handler ResourceHandler
+}
+
+// RouterHandler implements the ResourceHandler interface.
+// It sends each record to the handler of the first route it matches,
+// or to the default handler when it matches none.
+// Records matching no route are acknowledged and dropped when there is no default handler.
+type RouterHandler struct {
+	routes   []Route
+	fallback ResourceHandler
+	logger   Logger
+}
+
+// NewRouterHandler returns a RouterHandler using the provided routes, in order,
+// and the provided default handler, which may be nil.
+// Nothing is logged when l is nil.
+func NewRouterHandler(routes []Route, fallback ResourceHandler, l Logger) *RouterHandler {
+	return &RouterHandler{routes: routes, fallback: fallback, logger: orNop(l)}
+}
+
+// Handle implements the ResourceHandler interface.
+// Each route handler is fed by its own channel, and they all stop once in is closed.
+// It returns once every route handler returned, with the first error returned by one of them.
+// A route handler returning before in is closed stops the other ones.
+func (h *RouterHandler) Handle(in <-chan ResourceAudits) error {
+	handlers := make([]ResourceHandler, 0, len(h.routes)+1)
+	names := make([]string, 0, len(h.routes)+1)
+	for i, r := range h.routes {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		handlers = append(handlers, r.Handler)
+		names = append(names, name)
+	}
+	if h.fallback != nil {
+		handlers = append(handlers, h.fallback)
+		names = append(names, "default")
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	outs := make([]chan ResourceAudits, len(handlers))
+	results := make(chan result, len(handlers))
+	for i := range handlers {
+		outs[i] = make(chan ResourceAudits)
+		go func(i int) {
+			results <- result{names[i], handlers[i].Handle(outs[i])}
+		}(i)
+	}
+
+	var first *result
+	received := 0
+loop:
+	for {
+		var res ResourceAudits
+		select {
+		case r, ok := <-in:
+			if !ok {
+				break loop
+			}
+			res = r
+		case r := <-results:
+			received++
+			first = &r
+			break loop
+		}
+		i := h.route(res)
+		if i < 0 {
+			res.Ack()
+			continue
+		}
+		select {
+		case outs[i] <- res:
+		case r := <-results:
+			// a route stopped, the record is never acknowledged
+			// and is fetched again on the next run
+			received++
+			first = &r
+			break loop
+		}
+	}
+	for _, out := range outs {
+		close(out)
+	}
+	for ; received < len(handlers); received++ {
+		r := <-results
+		if r.err != nil && (first == nil || first.err == nil) {
+			first = &r
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	if first.err == nil {
+		return fmt.Errorf("router: route %s stopped", first.name)
+	}
+	h.logger.Errorf("router: route %s: %s", first.name, first.err)
+	return first.err
+}
+
+// route returns the index of the handler of the provided record, or -1.
+func (h *RouterHandler) route(res ResourceAudits) int {
+	for i, r := range h.routes {
+		if r.Match.Matches(res) {
+			return i
+		}
+	}
+	if h.fallback != nil {
+		return len(h.routes)
+	}
+	return -1
+}
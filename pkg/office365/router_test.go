@@ -0,0 +1,110 @@
+package office365
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func routerRecord(ct schema.ContentType, id string, rt schema.AuditLogRecordType, workload, operation string) ResourceAudits {
+	return ResourceAudits{
+		ContentType: &ct,
+		AuditRecord: schema.AuditRecord{
+			ID:         &id,
+			RecordType: &rt,
+			Workload:   &workload,
+			Operation:  &operation,
+		},
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	record := routerRecord(schema.AuditExchange, "1", schema.ExchangeAdminType, "Exchange", "New-InboxRule")
+
+	cases := []struct {
+		name  string
+		match RouteMatch
+		want  bool
+	}{
+		{"empty", RouteMatch{}, true},
+		{"content type", RouteMatch{ContentTypes: []schema.ContentType{schema.DLPAll, schema.AuditExchange}}, true},
+		{"other content type", RouteMatch{ContentTypes: []schema.ContentType{schema.DLPAll}}, false},
+		{"record type", RouteMatch{RecordTypes: []string{"exchangeadmin"}}, true},
+		{"workload and operation", RouteMatch{Workloads: []string{"Exchange"}, Operations: []string{"Set-Mailbox", "New-InboxRule"}}, true},
+		{"other operation", RouteMatch{Workloads: []string{"Exchange"}, Operations: []string{"Set-Mailbox"}}, false},
+	}
+	for _, c := range cases {
+		if got := c.match.Matches(record); got != c.want {
+			t.Errorf("%s: got %t but want %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRouterHandler(t *testing.T) {
+	dlp, aad, fallback := &ackHandler{}, &ackHandler{}, &ackHandler{}
+	h := NewRouterHandler([]Route{
+		{Name: "dlp", Match: RouteMatch{ContentTypes: []schema.ContentType{schema.DLPAll}}, Handler: dlp},
+		{Name: "aad", Match: RouteMatch{Workloads: []string{"AzureActiveDirectory"}}, Handler: aad},
+	}, fallback, nil)
+
+	records := []ResourceAudits{
+		routerRecord(schema.DLPAll, "1", schema.ComplianceDLPExchangeType, "Exchange", "DlpRuleMatch"),
+		routerRecord(schema.AuditAzureActiveDirectory, "2", schema.AzureActiveDirectoryType, "AzureActiveDirectory", "UserLoggedIn"),
+		routerRecord(schema.AuditExchange, "3", schema.ExchangeAdminType, "Exchange", "Set-Mailbox"),
+		routerRecord(schema.DLPAll, "4", schema.ComplianceDLPExchangeType, "AzureActiveDirectory", "DlpRuleMatch"),
+	}
+	in := make(chan ResourceAudits, len(records))
+	var acked int32
+	for _, r := range records {
+		in <- r.WithAck(func() { atomic.AddInt32(&acked, 1) })
+	}
+	close(in)
+	if err := h.Handle(in); err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+
+	// the first matching route wins
+	testDeep(t, dlp.ids, []string{"1", "4"})
+	testDeep(t, aad.ids, []string{"2"})
+	testDeep(t, fallback.ids, []string{"3"})
+	if got := atomic.LoadInt32(&acked); int(got) != len(records) {
+		t.Errorf("got %d acknowledged records but want %d", got, len(records))
+	}
+
+	// records matching no route are dropped without a default route
+	in = make(chan ResourceAudits, 1)
+	atomic.StoreInt32(&acked, 0)
+	in <- records[2].WithAck(func() { atomic.AddInt32(&acked, 1) })
+	close(in)
+	if err := NewRouterHandler(nil, nil, nil).Handle(in); err != nil {
+		t.Fatalf("Handle: unexpected error: %s", err)
+	}
+	if atomic.LoadInt32(&acked) != 1 {
+		t.Errorf("unrouted record not acknowledged")
+	}
+}
+
+// errHandler implements the ResourceHandler interface.
+// It returns its error right away.
+type errHandler struct {
+	err error
+}
+
+func (h errHandler) Handle(<-chan ResourceAudits) error {
+	return h.err
+}
+
+func TestRouterHandlerError(t *testing.T) {
+	errRoute := errors.New("route failed")
+	h := NewRouterHandler([]Route{
+		{Match: RouteMatch{ContentTypes: []schema.ContentType{schema.DLPAll}}, Handler: errHandler{errRoute}},
+	}, &ackHandler{}, nil)
+
+	// the input is never closed, the failed route stops the router
+	in := make(chan ResourceAudits)
+	if err := h.Handle(in); !errors.Is(err, errRoute) {
+		t.Fatalf("Handle: got error %v but want %v", err, errRoute)
+	}
+}
@@ -0,0 +1,95 @@
+package office365
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// pollJitter is the fraction of the interval of a content type
+// by which the time of its next poll is randomly moved.
+var pollJitter = 0.2
+
+// pollSchedule decides when the pipeline of each content type is triggered
+// when the adaptive polling interval is enabled.
+// The interval of a content type is halved after a cycle that found new content
+// and doubled after a cycle that found none, within the configured bounds.
+// Jitter is added so that content types backing off do not poll in lockstep.
+type pollSchedule struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	interval map[schema.ContentType]time.Duration
+	next     map[schema.ContentType]time.Time
+	running  map[schema.ContentType]bool
+	found    map[schema.ContentType]int
+}
+
+func newPollSchedule() *pollSchedule {
+	return &pollSchedule{
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		interval: make(map[schema.ContentType]time.Duration),
+		next:     make(map[schema.ContentType]time.Time),
+		running:  make(map[schema.ContentType]bool),
+		found:    make(map[schema.ContentType]int),
+	}
+}
+
+// due returns whether the pipeline of ct must be triggered at the provided time.
+// A pipeline is not due while its current cycle is running.
+func (p *pollSchedule) due(ct schema.ContentType, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.running[ct] && !now.Before(p.next[ct])
+}
+
+// start records that the pipeline of ct has been triggered.
+func (p *pollSchedule) start(ct schema.ContentType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running[ct] = true
+}
+
+// contentFound records that the current cycle of ct found new content.
+func (p *pollSchedule) contentFound(ct schema.ContentType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.found[ct]++
+}
+
+// cycle adjusts the interval of ct once its cycle completed, and returns
+// the time until its next poll. The interval starts at initial.
+func (p *pollSchedule) cycle(ct schema.ContentType, now time.Time, initial, min, max time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, ok := p.interval[ct]
+	if !ok {
+		d = initial
+	}
+	if p.found[ct] > 0 {
+		d /= 2
+	} else {
+		d *= 2
+	}
+	d = clampDuration(d, min, max)
+	p.interval[ct] = d
+
+	jitter := time.Duration((p.rand.Float64()*2 - 1) * pollJitter * float64(d))
+	wait := clampDuration(d+jitter, min, max)
+	p.next[ct] = now.Add(wait)
+	p.found[ct] = 0
+	p.running[ct] = false
+	return wait
+}
+
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
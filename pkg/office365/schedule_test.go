@@ -0,0 +1,57 @@
+package office365
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestPollSchedule(t *testing.T) {
+	ct := schema.AuditExchange
+	now := time.Now()
+	initial, min, max := 40*time.Second, 10*time.Second, 5*time.Minute
+
+	p := newPollSchedule()
+	if !p.due(ct, now) {
+		t.Fatalf("content type not due before its first cycle")
+	}
+	p.start(ct)
+	if p.due(ct, now) {
+		t.Errorf("content type due while its cycle is running")
+	}
+
+	// the interval shortens while content is found
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		p.contentFound(ct)
+		waits = append(waits, p.cycle(ct, now, initial, min, max))
+	}
+	// and backs off when listings are empty
+	for i := 0; i < 7; i++ {
+		waits = append(waits, p.cycle(ct, now, initial, min, max))
+	}
+	want := []time.Duration{
+		20 * time.Second, 10 * time.Second, 10 * time.Second,
+		20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute, 5 * time.Minute,
+	}
+	for i, w := range want {
+		// jitter moves the poll within the bounds
+		lo := clampDuration(w-time.Duration(pollJitter*float64(w)), min, max)
+		hi := clampDuration(w+time.Duration(pollJitter*float64(w)), min, max)
+		if waits[i] < lo || waits[i] > hi {
+			t.Errorf("cycle %d: got wait %s but want between %s and %s", i, waits[i], lo, hi)
+		}
+	}
+
+	last := waits[len(waits)-1]
+	if p.due(ct, now.Add(last-time.Second)) {
+		t.Errorf("content type due before its next poll")
+	}
+	if !p.due(ct, now.Add(last)) {
+		t.Errorf("content type not due at its next poll")
+	}
+	if !p.due(schema.DLPAll, now) {
+		t.Errorf("other content type not due before its first cycle")
+	}
+}
@@ -1,7 +1,9 @@
 package office365
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"sync"
 	"time"
@@ -9,111 +11,479 @@ import (
 	"github.com/devodev/go-office365/v0/pkg/office365/schema"
 )
 
-// State is an interface for storinm and retrievinm Watcher state.
+// State is an interface for storing and retrieving Watcher state.
+//
+// State holds checkpoints for each content type. Getters return the zero time
+// when no checkpoint has been set for the content type. Setters only ever move
+// a checkpoint forward: setting a time that is not after the current checkpoint
+// is a no-op and is not an error.
+//
+// Every method returns ctx.Err() if the context is done before the operation completes,
+// and an error if the operation could not be carried out by the underlying storage,
+// in which case the checkpoint is left unchanged.
+//
+// Implementations must be safe for concurrent use.
+// The statetest package provides a conformance test suite for implementations.
 type State interface {
-	setLastContentCreated(*schema.ContentType, time.Time)
-	getLastContentCreated(*schema.ContentType) time.Time
-	setLastRequestTime(*schema.ContentType, time.Time)
-	getLastRequestTime(*schema.ContentType) time.Time
-	Read(io.Reader) error
-	Write(io.Writer) error
+	// LastContentCreated returns the creation time of the last content
+	// whose records have all been handled.
+	LastContentCreated(context.Context, schema.ContentType) (time.Time, error)
+	// SetLastContentCreated moves the LastContentCreated checkpoint forward.
+	SetLastContentCreated(context.Context, schema.ContentType, time.Time) error
+
+	// LastRequestTime returns the end of the last time window
+	// whose content has all been handled.
+	LastRequestTime(context.Context, schema.ContentType) (time.Time, error)
+	// SetLastRequestTime moves the LastRequestTime checkpoint forward.
+	SetLastRequestTime(context.Context, schema.ContentType, time.Time) error
+
+	// BackfillProgress returns the end of the last backfill chunk
+	// of a contiguous sequence of handled chunks.
+	BackfillProgress(context.Context, schema.ContentType) (time.Time, error)
+	// SetBackfillProgress moves the BackfillProgress checkpoint forward.
+	SetBackfillProgress(context.Context, schema.ContentType, time.Time) error
+
+	// ContentProcessed returns whether the content identified by contentID
+	// has been recorded as processed.
+	ContentProcessed(ctx context.Context, ct schema.ContentType, contentID string) (bool, error)
+	// SetContentProcessed records the content identified by contentID as processed,
+	// until its expiration.
+	SetContentProcessed(ctx context.Context, ct schema.ContentType, contentID string, expiration time.Time) error
+	// PruneContent forgets processed content that expired before the provided time.
+	PruneContent(ctx context.Context, ct schema.ContentType, before time.Time) error
+}
+
+// Checkpoint identifies one of the checkpoints kept by State for each content type.
+type Checkpoint string
+
+// Checkpoint enum.
+const (
+	CheckpointLastContentCreated Checkpoint = "lastContentCreated"
+	CheckpointLastRequestTime    Checkpoint = "lastRequestTime"
+	CheckpointBackfillProgress   Checkpoint = "backfillProgress"
+)
+
+// GetCheckpoints returns the list of Checkpoint.
+func GetCheckpoints() []Checkpoint {
+	return []Checkpoint{
+		CheckpointLastContentCreated,
+		CheckpointLastRequestTime,
+		CheckpointBackfillProgress,
+	}
+}
+
+// GetCheckpoint returns the Checkpoint represented by the provided string literal.
+func GetCheckpoint(s string) (Checkpoint, error) {
+	for _, c := range GetCheckpoints() {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("Checkpoint invalid")
+}
+
+// StateEditor is implemented by State backends whose content
+// can be inspected and edited outside of the watcher.
+type StateEditor interface {
+	// ContentTypeState returns a copy of the state of the content type.
+	ContentTypeState(context.Context, schema.ContentType) (*ContentTypeState, error)
+	// ReplaceCheckpoint sets a checkpoint of the content type, even when the provided
+	// time is before the current checkpoint. The zero time clears the checkpoint.
+	ReplaceCheckpoint(context.Context, schema.ContentType, Checkpoint, time.Time) error
+	// ResetContentType clears every checkpoint, processed content and gap of the content type.
+	ResetContentType(context.Context, schema.ContentType) error
+}
+
+// GapLedger is implemented by State backends which can record the time windows
+// and content blobs the watcher failed to fetch.
+// When the State used by the SubscriptionWatcher implements it, failures are recorded
+// and retried with backoff until they expire, instead of holding back checkpoints.
+type GapLedger interface {
+	// Gaps returns the gaps of the content type, sorted by key.
+	Gaps(context.Context, schema.ContentType) ([]Gap, error)
+	// SetGap records the gap, replacing the gap of the content type with the same key.
+	SetGap(context.Context, schema.ContentType, Gap) error
+	// DeleteGap forgets the gap of the content type identified by key.
+	DeleteGap(ctx context.Context, ct schema.ContentType, key string) error
+}
+
+// stateContext is used by the watcher to commit checkpoints.
+// Records acknowledged while the watcher is shutting down must still
+// move their checkpoint forward, so commits are not tied to the watcher context.
+var stateContext = context.Background()
+
+// checkpoints holds a time per content type.
+type checkpoints struct {
+	mu sync.RWMutex
+	m  map[schema.ContentType]time.Time
+}
+
+func newCheckpoints() *checkpoints {
+	return &checkpoints{m: make(map[schema.ContentType]time.Time)}
+}
+
+func (c *checkpoints) get(ct schema.ContentType) time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m[ct]
+}
+
+func (c *checkpoints) advance(ct schema.ContentType, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.m[ct]
+	if !ok || last.Before(t) {
+		c.m[ct] = t
+	}
+}
+
+// replaceOne sets the checkpoint of ct regardless of its current value.
+// The zero time removes it.
+func (c *checkpoints) replaceOne(ct schema.ContentType, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.IsZero() {
+		delete(c.m, ct)
+		return
+	}
+	c.m[ct] = t
+}
+
+// processedContent holds the expiration of processed content
+// per content type and content ID.
+type processedContent struct {
+	mu sync.RWMutex
+	m  map[schema.ContentType]map[string]time.Time
+}
+
+func newProcessedContent() *processedContent {
+	return &processedContent{m: make(map[schema.ContentType]map[string]time.Time)}
+}
+
+func (p *processedContent) has(ct schema.ContentType, id string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.m[ct][id]
+	return ok
+}
+
+func (p *processedContent) add(ct schema.ContentType, id string, expiration time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.m[ct] == nil {
+		p.m[ct] = make(map[string]time.Time)
+	}
+	p.m[ct][id] = expiration
+}
+
+func (p *processedContent) prune(ct schema.ContentType, before time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, expiration := range p.m[ct] {
+		if expiration.Before(before) {
+			delete(p.m[ct], id)
+		}
+	}
+}
+
+// copyOne returns a copy of the processed content of ct, or nil when there is none.
+func (p *processedContent) copyOne(ct schema.ContentType) map[string]time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.m[ct]) == 0 {
+		return nil
+	}
+	out := make(map[string]time.Time, len(p.m[ct]))
+	for id, expiration := range p.m[ct] {
+		out[id] = expiration
+	}
+	return out
+}
+
+// replaceOne replaces the processed content of ct.
+func (p *processedContent) replaceOne(ct schema.ContentType, ids map[string]time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(ids) == 0 {
+		delete(p.m, ct)
+		return
+	}
+	p.m[ct] = ids
 }
 
 // MemoryState is an in-memory State interface implementation.
+// It is the reference implementation of State.
 type MemoryState struct {
-	muCreated          *sync.RWMutex
-	lastContentCreated map[schema.ContentType]time.Time
-	muRequest          *sync.RWMutex
-	lastRequestTime    map[schema.ContentType]time.Time
+	muTenant sync.RWMutex
+	tenant   string
+
+	lastContentCreated *checkpoints
+	lastRequestTime    *checkpoints
+	backfillProgress   *checkpoints
+	processedContent   *processedContent
+	gaps               *gaps
 }
 
 // NewMemoryState returns a new MemoryState.
 func NewMemoryState() *MemoryState {
 	return &MemoryState{
-		muCreated:          &sync.RWMutex{},
-		lastContentCreated: make(map[schema.ContentType]time.Time),
-		muRequest:          &sync.RWMutex{},
-		lastRequestTime:    make(map[schema.ContentType]time.Time),
+		lastContentCreated: newCheckpoints(),
+		lastRequestTime:    newCheckpoints(),
+		backfillProgress:   newCheckpoints(),
+		processedContent:   newProcessedContent(),
+		gaps:               newGaps(),
+	}
+}
+
+// LastContentCreated implements the State interface.
+func (m *MemoryState) LastContentCreated(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
 	}
+	return m.lastContentCreated.get(ct), nil
 }
 
-func (m *MemoryState) setLastContentCreated(ct *schema.ContentType, t time.Time) {
-	m.muCreated.Lock()
-	defer m.muCreated.Unlock()
+// SetLastContentCreated implements the State interface.
+func (m *MemoryState) SetLastContentCreated(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.lastContentCreated.advance(ct, t)
+	return nil
+}
 
-	last, ok := m.lastContentCreated[*ct]
-	if !ok || last.Before(t) {
-		m.lastContentCreated[*ct] = t
+// LastRequestTime implements the State interface.
+func (m *MemoryState) LastRequestTime(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return m.lastRequestTime.get(ct), nil
+}
+
+// SetLastRequestTime implements the State interface.
+func (m *MemoryState) SetLastRequestTime(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	m.lastRequestTime.advance(ct, t)
+	return nil
 }
 
-func (m *MemoryState) getLastContentCreated(ct *schema.ContentType) time.Time {
-	m.muCreated.RLock()
-	defer m.muCreated.RUnlock()
+// BackfillProgress implements the State interface.
+func (m *MemoryState) BackfillProgress(ctx context.Context, ct schema.ContentType) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return m.backfillProgress.get(ct), nil
+}
 
-	t, ok := m.lastContentCreated[*ct]
-	if !ok {
-		return time.Time{}
+// SetBackfillProgress implements the State interface.
+func (m *MemoryState) SetBackfillProgress(ctx context.Context, ct schema.ContentType, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return t
+	m.backfillProgress.advance(ct, t)
+	return nil
 }
 
-func (m *MemoryState) setLastRequestTime(ct *schema.ContentType, t time.Time) {
-	m.muRequest.Lock()
-	defer m.muRequest.Unlock()
+// ContentProcessed implements the State interface.
+func (m *MemoryState) ContentProcessed(ctx context.Context, ct schema.ContentType, contentID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return m.processedContent.has(ct, contentID), nil
+}
 
-	last, ok := m.lastRequestTime[*ct]
-	if !ok || last.Before(t) {
-		m.lastRequestTime[*ct] = t
+// SetContentProcessed implements the State interface.
+func (m *MemoryState) SetContentProcessed(ctx context.Context, ct schema.ContentType, contentID string, expiration time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.processedContent.add(ct, contentID, expiration)
+	return nil
+}
+
+// PruneContent implements the State interface.
+func (m *MemoryState) PruneContent(ctx context.Context, ct schema.ContentType, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.processedContent.prune(ct, before)
+	return nil
+}
+
+// Gaps implements the GapLedger interface.
+func (m *MemoryState) Gaps(ctx context.Context, ct schema.ContentType) ([]Gap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.gaps.list(ct), nil
+}
+
+// SetGap implements the GapLedger interface.
+func (m *MemoryState) SetGap(ctx context.Context, ct schema.ContentType, g Gap) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.gaps.set(ct, g)
+	return nil
+}
+
+// DeleteGap implements the GapLedger interface.
+func (m *MemoryState) DeleteGap(ctx context.Context, ct schema.ContentType, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.gaps.delete(ct, key)
+	return nil
+}
+
+// Tenant returns the tenant the state belongs to, if any.
+func (m *MemoryState) Tenant(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
+	m.muTenant.RLock()
+	defer m.muTenant.RUnlock()
+	return m.tenant, nil
 }
 
-func (m *MemoryState) getLastRequestTime(ct *schema.ContentType) time.Time {
-	m.muRequest.RLock()
-	defer m.muRequest.RUnlock()
+// SetTenant records the tenant the state belongs to.
+func (m *MemoryState) SetTenant(ctx context.Context, tenant string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.muTenant.Lock()
+	defer m.muTenant.Unlock()
+	m.tenant = tenant
+	return nil
+}
 
-	t, ok := m.lastRequestTime[*ct]
-	if !ok {
-		return time.Time{}
+func (m *MemoryState) checkpoint(c Checkpoint) (*checkpoints, error) {
+	switch c {
+	case CheckpointLastContentCreated:
+		return m.lastContentCreated, nil
+	case CheckpointLastRequestTime:
+		return m.lastRequestTime, nil
+	case CheckpointBackfillProgress:
+		return m.backfillProgress, nil
 	}
-	return t
+	return nil, fmt.Errorf("Checkpoint invalid")
+}
+
+// ContentTypeState implements the StateEditor interface.
+func (m *MemoryState) ContentTypeState(ctx context.Context, ct schema.ContentType) (*ContentTypeState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.contentTypeState(ct), nil
+}
+
+func (m *MemoryState) contentTypeState(ct schema.ContentType) *ContentTypeState {
+	return &ContentTypeState{
+		LastContentCreated: m.lastContentCreated.get(ct),
+		LastRequestTime:    m.lastRequestTime.get(ct),
+		BackfillProgress:   m.backfillProgress.get(ct),
+		ProcessedContent:   m.processedContent.copyOne(ct),
+		Gaps:               m.gaps.copyOne(ct),
+	}
+}
+
+// ReplaceCheckpoint implements the StateEditor interface.
+func (m *MemoryState) ReplaceCheckpoint(ctx context.Context, ct schema.ContentType, c Checkpoint, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cp, err := m.checkpoint(c)
+	if err != nil {
+		return err
+	}
+	cp.replaceOne(ct, t)
+	return nil
+}
+
+// ResetContentType implements the StateEditor interface.
+func (m *MemoryState) ResetContentType(ctx context.Context, ct schema.ContentType) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.setContentTypeState(ct, &ContentTypeState{})
+	return nil
+}
+
+func (m *MemoryState) setContentTypeState(ct schema.ContentType, s *ContentTypeState) {
+	m.lastContentCreated.replaceOne(ct, s.LastContentCreated)
+	m.lastRequestTime.replaceOne(ct, s.LastRequestTime)
+	m.backfillProgress.replaceOne(ct, s.BackfillProgress)
+	m.processedContent.replaceOne(ct, s.ProcessedContent)
+	m.gaps.replaceOne(ct, s.Gaps)
 }
 
 func (m *MemoryState) returnState() *StateData {
-	m.muCreated.RLock()
-	m.muRequest.RLock()
-	defer m.muCreated.RUnlock()
-	defer m.muRequest.RUnlock()
+	m.muTenant.RLock()
+	tenant := m.tenant
+	m.muTenant.RUnlock()
 
-	return &StateData{
-		LastContentCreated: m.lastContentCreated,
-		LastRequestTime:    m.lastRequestTime,
+	data := &StateData{
+		Version:      StateFormatVersion,
+		Tenant:       tenant,
+		ContentTypes: make(map[string]*ContentTypeState),
 	}
+	for _, ct := range schema.GetContentTypes() {
+		s := m.contentTypeState(ct)
+		if s.LastContentCreated.IsZero() && s.LastRequestTime.IsZero() && s.BackfillProgress.IsZero() && len(s.ProcessedContent) == 0 && len(s.Gaps) == 0 {
+			continue
+		}
+		data.ContentTypes[ct.String()] = s
+	}
+	return data
 }
 
-func (m *MemoryState) setState(b *StateData) {
-	m.muCreated.Lock()
-	m.muRequest.Lock()
-	defer m.muCreated.Unlock()
-	defer m.muRequest.Unlock()
+func (m *MemoryState) setState(data *StateData) error {
+	states := make(map[schema.ContentType]*ContentTypeState)
+	for name, s := range data.ContentTypes {
+		ct, err := schema.GetContentType(name)
+		if err != nil {
+			return fmt.Errorf("%w: unknown content type: %s", ErrStateFormat, name)
+		}
+		if s == nil {
+			s = &ContentTypeState{}
+		}
+		states[*ct] = s
+	}
 
-	m.lastContentCreated = b.LastContentCreated
-	m.lastRequestTime = b.LastRequestTime
+	m.muTenant.Lock()
+	m.tenant = data.Tenant
+	m.muTenant.Unlock()
+	for _, ct := range schema.GetContentTypes() {
+		s, ok := states[ct]
+		if !ok {
+			s = &ContentTypeState{}
+		}
+		m.setContentTypeState(ct, s)
+	}
+	return nil
 }
 
 // Read will decode json from a reader and populate its state.
+// State written using an older format version is migrated.
 func (m *MemoryState) Read(r io.Reader) error {
-	decoder := json.NewDecoder(r)
-
-	var blob StateData
-	if err := decoder.Decode(&blob); err != nil {
+	data, err := decodeStateData(r)
+	if err != nil {
 		return err
 	}
-	m.setState(&blob)
-	return nil
+	return m.setState(data)
 }
 
-// Write will encode its state as json to a writer.
+// Write will encode its state as json to a writer,
+// using the current format version.
 func (m *MemoryState) Write(w io.Writer) error {
 	encoder := json.NewEncoder(w)
 
@@ -123,9 +493,3 @@ func (m *MemoryState) Write(w io.Writer) error {
 	}
 	return nil
 }
-
-// StateData holds the internal state of MemoryState.
-type StateData struct {
-	LastContentCreated map[schema.ContentType]time.Time
-	LastRequestTime    map[schema.ContentType]time.Time
-}
@@ -0,0 +1,129 @@
+package office365_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+	"github.com/devodev/go-office365/v0/pkg/office365/statetest"
+)
+
+func TestMemoryState(t *testing.T) {
+	statetest.Run(t, func(t *testing.T) office365.State {
+		return office365.NewMemoryState()
+	})
+}
+
+func TestMemoryStateReadWrite(t *testing.T) {
+	ctx := context.Background()
+	ct := schema.AuditExchange
+	now := time.Date(2020, 4, 16, 12, 30, 45, 0, time.UTC)
+
+	state := office365.NewMemoryState()
+	if err := state.SetLastContentCreated(ctx, ct, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetLastRequestTime(ctx, ct, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetContentProcessed(ctx, ct, "abc", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetTenant(ctx, "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := state.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := office365.NewMemoryState()
+	if err := restored.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := restored.LastContentCreated(ctx, ct); !got.Equal(now.Add(-time.Minute)) {
+		t.Errorf("got lastContentCreated %v but want %v", got, now.Add(-time.Minute))
+	}
+	if got, _ := restored.LastRequestTime(ctx, ct); !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v but want %v", got, now)
+	}
+	if got, _ := restored.BackfillProgress(ctx, ct); !got.IsZero() {
+		t.Errorf("got backfillProgress %v but want zero time", got)
+	}
+	if ok, _ := restored.ContentProcessed(ctx, ct, "abc"); !ok {
+		t.Errorf("content abc not processed after restoring")
+	}
+	if got, _ := restored.Tenant(ctx); got != "1234" {
+		t.Errorf("got tenant %q but want %q", got, "1234")
+	}
+}
+
+func TestMemoryStateMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	// version 1 keyed state by the value of schema.ContentType
+	legacy := `{
+		"LastContentCreated": {"1": "2020-04-16T12:29:00Z"},
+		"LastRequestTime": {"1": "2020-04-16T12:30:00Z", "4": "2020-04-16T11:30:00Z"},
+		"BackfillProgress": null
+	}`
+	state := office365.NewMemoryState()
+	if err := state.Read(strings.NewReader(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Date(2020, 4, 16, 12, 30, 0, 0, time.UTC)
+	if got, _ := state.LastRequestTime(ctx, schema.AuditExchange); !got.Equal(want) {
+		t.Errorf("got Audit.Exchange lastRequestTime %v but want %v", got, want)
+	}
+	want = time.Date(2020, 4, 16, 11, 30, 0, 0, time.UTC)
+	if got, _ := state.LastRequestTime(ctx, schema.DLPAll); !got.Equal(want) {
+		t.Errorf("got DLP.All lastRequestTime %v but want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := state.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var written office365.StateData
+	if err := json.Unmarshal(buf.Bytes(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Version != office365.StateFormatVersion {
+		t.Errorf("got version %d but want %d", written.Version, office365.StateFormatVersion)
+	}
+	if _, ok := written.ContentTypes["Audit.Exchange"]; !ok {
+		t.Errorf("state not keyed by content type name: %s", buf.String())
+	}
+}
+
+func TestMemoryStateReadUnsupported(t *testing.T) {
+	cases := []string{
+		`{"version": 99, "contentTypes": {}}`,
+		`{"version": 2, "contentTypes": {"Audit.Unknown": {}}}`,
+		`{"LastRequestTime": {"42": "2020-04-16T12:30:00Z"}}`,
+	}
+	for idx, c := range cases {
+		t.Run(fmt.Sprintf("%d.", idx+1), func(t *testing.T) {
+			state := office365.NewMemoryState()
+			if err := state.Read(strings.NewReader(c)); !errors.Is(err, office365.ErrStateFormat) {
+				t.Errorf("got error %v but want %v", err, office365.ErrStateFormat)
+			}
+		})
+	}
+}
+
+func TestMemoryStateReadInvalid(t *testing.T) {
+	state := office365.NewMemoryState()
+	if err := state.Read(strings.NewReader("not json")); err == nil {
+		t.Fatal("got no error reading invalid state")
+	}
+}
@@ -0,0 +1,130 @@
+package office365
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// StateFormatVersion is the version of the format written by MemoryState.
+//
+// Version 1 kept checkpoints in maps keyed by the value of schema.ContentType,
+// which depends on declaration order. Version 2 keys them by content type name
+// and records the tenant the state belongs to.
+// Version 1 state is migrated when read.
+const StateFormatVersion = 2
+
+// ErrStateFormat is returned when reading state using an unsupported format,
+// as opposed to state that is empty or corrupted.
+var ErrStateFormat = errors.New("unsupported state format")
+
+// StateData is the serialized form of MemoryState.
+type StateData struct {
+	Version      int                          `json:"version"`
+	Tenant       string                       `json:"tenant,omitempty"`
+	ContentTypes map[string]*ContentTypeState `json:"contentTypes"`
+}
+
+// ContentTypeState holds the state of a single content type.
+type ContentTypeState struct {
+	LastContentCreated time.Time            `json:"lastContentCreated"`
+	LastRequestTime    time.Time            `json:"lastRequestTime"`
+	BackfillProgress   time.Time            `json:"backfillProgress"`
+	ProcessedContent   map[string]time.Time `json:"processedContent,omitempty"`
+	Gaps               map[string]Gap       `json:"gaps,omitempty"`
+}
+
+// legacyContentTypes maps the values of schema.ContentType
+// used by version 1 to content type names.
+var legacyContentTypes = map[int]string{
+	0: "Audit.AzureActiveDirectory",
+	1: "Audit.Exchange",
+	2: "Audit.SharePoint",
+	3: "Audit.General",
+	4: "DLP.All",
+}
+
+// legacyStateData is the version 1 format.
+type legacyStateData struct {
+	LastContentCreated map[int]time.Time
+	LastRequestTime    map[int]time.Time
+	BackfillProgress   map[int]time.Time
+	ProcessedContent   map[int]map[string]time.Time
+}
+
+// migrate converts version 1 state to the current format.
+func (l *legacyStateData) migrate() (*StateData, error) {
+	data := &StateData{Version: StateFormatVersion, ContentTypes: make(map[string]*ContentTypeState)}
+
+	get := func(v int) (*ContentTypeState, error) {
+		name, ok := legacyContentTypes[v]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown version 1 content type: %d", ErrStateFormat, v)
+		}
+		if data.ContentTypes[name] == nil {
+			data.ContentTypes[name] = &ContentTypeState{}
+		}
+		return data.ContentTypes[name], nil
+	}
+	for v, t := range l.LastContentCreated {
+		s, err := get(v)
+		if err != nil {
+			return nil, err
+		}
+		s.LastContentCreated = t
+	}
+	for v, t := range l.LastRequestTime {
+		s, err := get(v)
+		if err != nil {
+			return nil, err
+		}
+		s.LastRequestTime = t
+	}
+	for v, t := range l.BackfillProgress {
+		s, err := get(v)
+		if err != nil {
+			return nil, err
+		}
+		s.BackfillProgress = t
+	}
+	for v, ids := range l.ProcessedContent {
+		s, err := get(v)
+		if err != nil {
+			return nil, err
+		}
+		s.ProcessedContent = ids
+	}
+	return data, nil
+}
+
+// decodeStateData decodes state written using any supported format version.
+func decodeStateData(r io.Reader) (*StateData, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, err
+	}
+
+	switch probe.Version {
+	case 0:
+		var legacy legacyStateData
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			return nil, err
+		}
+		return legacy.migrate()
+	case StateFormatVersion:
+		var data StateData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+	return nil, fmt.Errorf("%w: version %d", ErrStateFormat, probe.Version)
+}
@@ -0,0 +1,522 @@
+// Package statetest provides a conformance test suite for
+// implementations of the office365.State interface.
+//
+// Third party implementations can be verified by calling Run from a test:
+//
+//	func TestState(t *testing.T) {
+//		statetest.Run(t, func(t *testing.T) office365.State {
+//			return NewMyState(t)
+//		})
+//	}
+package statetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365"
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// checkpoint exposes one of the checkpoint kinds of a State
+// so that every kind can be exercised by the same tests.
+type checkpoint struct {
+	name string
+	get  func(office365.State) func(context.Context, schema.ContentType) (time.Time, error)
+	set  func(office365.State) func(context.Context, schema.ContentType, time.Time) error
+}
+
+var checkpoints = []checkpoint{
+	{
+		name: "LastContentCreated",
+		get: func(s office365.State) func(context.Context, schema.ContentType) (time.Time, error) {
+			return s.LastContentCreated
+		},
+		set: func(s office365.State) func(context.Context, schema.ContentType, time.Time) error {
+			return s.SetLastContentCreated
+		},
+	},
+	{
+		name: "LastRequestTime",
+		get: func(s office365.State) func(context.Context, schema.ContentType) (time.Time, error) {
+			return s.LastRequestTime
+		},
+		set: func(s office365.State) func(context.Context, schema.ContentType, time.Time) error {
+			return s.SetLastRequestTime
+		},
+	},
+	{
+		name: "BackfillProgress",
+		get: func(s office365.State) func(context.Context, schema.ContentType) (time.Time, error) {
+			return s.BackfillProgress
+		},
+		set: func(s office365.State) func(context.Context, schema.ContentType, time.Time) error {
+			return s.SetBackfillProgress
+		},
+	},
+}
+
+// Run runs the conformance test suite against the State returned by newState.
+// newState is called once per subtest and must return an empty State.
+// The office365.StateEditor and office365.GapLedger interfaces are also verified, when implemented.
+func Run(t *testing.T, newState func(t *testing.T) office365.State) {
+	for _, c := range checkpoints {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Run("Empty", func(t *testing.T) { testEmpty(t, newState(t), c) })
+			t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, newState(t), c) })
+			t.Run("Monotonic", func(t *testing.T) { testMonotonic(t, newState(t), c) })
+			t.Run("Isolation", func(t *testing.T) { testIsolation(t, newState(t), c) })
+			t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newState(t), c) })
+			t.Run("Canceled", func(t *testing.T) { testCanceled(t, newState(t), c) })
+		})
+	}
+	t.Run("ProcessedContent", func(t *testing.T) {
+		t.Run("RoundTrip", func(t *testing.T) { testContentRoundTrip(t, newState(t)) })
+		t.Run("Prune", func(t *testing.T) { testContentPrune(t, newState(t)) })
+		t.Run("Canceled", func(t *testing.T) { testContentCanceled(t, newState(t)) })
+	})
+	t.Run("Gaps", func(t *testing.T) {
+		t.Run("RoundTrip", func(t *testing.T) { testGapsRoundTrip(t, newState(t)) })
+		t.Run("Canceled", func(t *testing.T) { testGapsCanceled(t, newState(t)) })
+	})
+	t.Run("Editor", func(t *testing.T) { testEditor(t, newState(t)) })
+}
+
+// base is a reference time with a location other than UTC,
+// to verify that implementations compare instants rather than representations.
+var base = time.Date(2020, 4, 16, 12, 30, 45, 123456789, time.FixedZone("EDT", -4*60*60))
+
+func get(t *testing.T, s office365.State, c checkpoint, ct schema.ContentType) time.Time {
+	t.Helper()
+
+	got, err := c.get(s)(context.Background(), ct)
+	if err != nil {
+		t.Fatalf("%s(%s): unexpected error: %s", c.name, ct.String(), err)
+	}
+	return got
+}
+
+func set(t *testing.T, s office365.State, c checkpoint, ct schema.ContentType, v time.Time) {
+	t.Helper()
+
+	if err := c.set(s)(context.Background(), ct, v); err != nil {
+		t.Fatalf("Set%s(%s): unexpected error: %s", c.name, ct.String(), err)
+	}
+}
+
+func testEmpty(t *testing.T, s office365.State, c checkpoint) {
+	for _, ct := range schema.GetContentTypes() {
+		if got := get(t, s, c, ct); !got.IsZero() {
+			t.Errorf("%s(%s): got %v but want zero time", c.name, ct.String(), got)
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, s office365.State, c checkpoint) {
+	ct := schema.AuditExchange
+
+	set(t, s, c, ct, base)
+	if got := get(t, s, c, ct); !got.Equal(base) {
+		t.Errorf("%s: got %v but want %v", c.name, got, base)
+	}
+	next := base.Add(time.Minute)
+	set(t, s, c, ct, next)
+	if got := get(t, s, c, ct); !got.Equal(next) {
+		t.Errorf("%s: got %v but want %v", c.name, got, next)
+	}
+}
+
+func testMonotonic(t *testing.T, s office365.State, c checkpoint) {
+	ct := schema.AuditSharePoint
+
+	set(t, s, c, ct, base)
+	set(t, s, c, ct, base.Add(-time.Hour))
+	if got := get(t, s, c, ct); !got.Equal(base) {
+		t.Errorf("%s: checkpoint moved backward: got %v but want %v", c.name, got, base)
+	}
+	set(t, s, c, ct, base.UTC())
+	if got := get(t, s, c, ct); !got.Equal(base) {
+		t.Errorf("%s: got %v but want %v", c.name, got, base)
+	}
+}
+
+func testIsolation(t *testing.T, s office365.State, c checkpoint) {
+	cts := schema.GetContentTypes()
+	for idx, ct := range cts {
+		set(t, s, c, ct, base.Add(time.Duration(idx)*time.Hour))
+	}
+	for idx, ct := range cts {
+		want := base.Add(time.Duration(idx) * time.Hour)
+		if got := get(t, s, c, ct); !got.Equal(want) {
+			t.Errorf("%s(%s): got %v but want %v", c.name, ct.String(), got, want)
+		}
+	}
+
+	// other checkpoint kinds must not be affected
+	for _, other := range checkpoints {
+		if other.name == c.name {
+			continue
+		}
+		for _, ct := range cts {
+			if got := get(t, s, other, ct); !got.IsZero() {
+				t.Errorf("%s(%s): got %v after setting %s but want zero time", other.name, ct.String(), got, c.name)
+			}
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, s office365.State, c checkpoint) {
+	const workers, sets = 8, 50
+	ct := schema.AuditGeneral
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*sets)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sets; i++ {
+				v := base.Add(time.Duration(i*workers+w) * time.Second)
+				if err := c.set(s)(context.Background(), ct, v); err != nil {
+					errs <- fmt.Errorf("Set%s: %s", c.name, err)
+					return
+				}
+				if _, err := c.get(s)(context.Background(), ct); err != nil {
+					errs <- fmt.Errorf("%s: %s", c.name, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	want := base.Add(time.Duration(workers*sets-1) * time.Second)
+	if got := get(t, s, c, ct); !got.Equal(want) {
+		t.Errorf("%s: got %v but want %v", c.name, got, want)
+	}
+}
+
+func testCanceled(t *testing.T, s office365.State, c checkpoint) {
+	ct := schema.AuditAzureActiveDirectory
+	set(t, s, c, ct, base)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.get(s)(ctx, ct); err == nil {
+		t.Errorf("%s: got no error using a canceled context", c.name)
+	}
+	if err := c.set(s)(ctx, ct, base.Add(time.Hour)); err == nil {
+		t.Errorf("Set%s: got no error using a canceled context", c.name)
+	}
+	if got := get(t, s, c, ct); !got.Equal(base) {
+		t.Errorf("%s: got %v after a canceled set but want %v", c.name, got, base)
+	}
+}
+
+func processed(t *testing.T, s office365.State, ct schema.ContentType, id string) bool {
+	t.Helper()
+
+	ok, err := s.ContentProcessed(context.Background(), ct, id)
+	if err != nil {
+		t.Fatalf("ContentProcessed(%s, %s): unexpected error: %s", ct.String(), id, err)
+	}
+	return ok
+}
+
+func setProcessed(t *testing.T, s office365.State, ct schema.ContentType, id string, expiration time.Time) {
+	t.Helper()
+
+	if err := s.SetContentProcessed(context.Background(), ct, id, expiration); err != nil {
+		t.Fatalf("SetContentProcessed(%s, %s): unexpected error: %s", ct.String(), id, err)
+	}
+}
+
+func prune(t *testing.T, s office365.State, ct schema.ContentType, before time.Time) {
+	t.Helper()
+
+	if err := s.PruneContent(context.Background(), ct, before); err != nil {
+		t.Fatalf("PruneContent(%s): unexpected error: %s", ct.String(), err)
+	}
+}
+
+func testContentRoundTrip(t *testing.T, s office365.State) {
+	ct := schema.AuditExchange
+
+	if processed(t, s, ct, "abc") {
+		t.Fatalf("content abc processed before being set")
+	}
+	setProcessed(t, s, ct, "abc", base)
+	if !processed(t, s, ct, "abc") {
+		t.Errorf("content abc not processed after being set")
+	}
+	if processed(t, s, ct, "def") {
+		t.Errorf("content def processed but only abc was set")
+	}
+	if processed(t, s, schema.AuditSharePoint, "abc") {
+		t.Errorf("content abc processed for another content type")
+	}
+
+	// setting content twice is not an error
+	setProcessed(t, s, ct, "abc", base.Add(time.Hour))
+	if !processed(t, s, ct, "abc") {
+		t.Errorf("content abc not processed after being set twice")
+	}
+}
+
+func testContentPrune(t *testing.T, s office365.State) {
+	ct := schema.AuditGeneral
+	other := schema.DLPAll
+
+	setProcessed(t, s, ct, "expired", base.Add(-time.Hour))
+	setProcessed(t, s, ct, "current", base.Add(time.Hour))
+	setProcessed(t, s, other, "expired", base.Add(-time.Hour))
+
+	prune(t, s, ct, base)
+	if processed(t, s, ct, "expired") {
+		t.Errorf("expired content not pruned")
+	}
+	if !processed(t, s, ct, "current") {
+		t.Errorf("unexpired content pruned")
+	}
+	if !processed(t, s, other, "expired") {
+		t.Errorf("content of another content type pruned")
+	}
+}
+
+func testContentCanceled(t *testing.T, s office365.State) {
+	ct := schema.AuditAzureActiveDirectory
+	setProcessed(t, s, ct, "abc", base)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.ContentProcessed(ctx, ct, "abc"); err == nil {
+		t.Errorf("ContentProcessed: got no error using a canceled context")
+	}
+	if err := s.SetContentProcessed(ctx, ct, "def", base); err == nil {
+		t.Errorf("SetContentProcessed: got no error using a canceled context")
+	}
+	if err := s.PruneContent(ctx, ct, base.Add(time.Hour)); err == nil {
+		t.Errorf("PruneContent: got no error using a canceled context")
+	}
+	if processed(t, s, ct, "def") {
+		t.Errorf("content def processed after a canceled set")
+	}
+	if !processed(t, s, ct, "abc") {
+		t.Errorf("content abc pruned after a canceled prune")
+	}
+}
+
+func ledger(t *testing.T, s office365.State) office365.GapLedger {
+	t.Helper()
+
+	l, ok := s.(office365.GapLedger)
+	if !ok {
+		t.Skip("State does not implement office365.GapLedger")
+	}
+	return l
+}
+
+func gaps(t *testing.T, l office365.GapLedger, ct schema.ContentType) []office365.Gap {
+	t.Helper()
+
+	got, err := l.Gaps(context.Background(), ct)
+	if err != nil {
+		t.Fatalf("Gaps(%s): unexpected error: %s", ct.String(), err)
+	}
+	return got
+}
+
+func setGap(t *testing.T, l office365.GapLedger, ct schema.ContentType, g office365.Gap) {
+	t.Helper()
+
+	if err := l.SetGap(context.Background(), ct, g); err != nil {
+		t.Fatalf("SetGap(%s, %s): unexpected error: %s", ct.String(), g.Key(), err)
+	}
+}
+
+// sameGap returns whether the gaps hold the same values,
+// comparing instants rather than representations.
+func sameGap(a, b office365.Gap) bool {
+	return a.Key() == b.Key() &&
+		a.Start.Equal(b.Start) && a.End.Equal(b.End) &&
+		a.Created.Equal(b.Created) && a.Expiration.Equal(b.Expiration) &&
+		a.FirstFailed.Equal(b.FirstFailed) && a.NextAttempt.Equal(b.NextAttempt) &&
+		a.Attempts == b.Attempts && a.LastError == b.LastError && a.Unrecoverable == b.Unrecoverable
+}
+
+func testGapsRoundTrip(t *testing.T, s office365.State) {
+	l := ledger(t, s)
+	ctx := context.Background()
+	ct := schema.AuditExchange
+
+	if got := gaps(t, l, ct); len(got) != 0 {
+		t.Fatalf("Gaps: got %v before any was set", got)
+	}
+	window := office365.Gap{
+		Kind:        office365.GapWindow,
+		Start:       base.Add(-time.Hour),
+		End:         base,
+		FirstFailed: base,
+		Attempts:    1,
+		NextAttempt: base.Add(time.Minute),
+		LastError:   "boom",
+	}
+	content := office365.Gap{
+		Kind:        office365.GapContent,
+		ContentID:   "abc",
+		Created:     base.Add(-time.Hour),
+		Expiration:  base.Add(time.Hour),
+		FirstFailed: base,
+		Attempts:    1,
+		NextAttempt: base.Add(time.Minute),
+		LastError:   "boom",
+	}
+	setGap(t, l, ct, window)
+	setGap(t, l, ct, content)
+
+	got := gaps(t, l, ct)
+	if len(got) != 2 || !sameGap(got[0], content) || !sameGap(got[1], window) {
+		t.Fatalf("Gaps: got %+v but want %+v sorted by key", got, []office365.Gap{content, window})
+	}
+	if got := gaps(t, l, schema.AuditSharePoint); len(got) != 0 {
+		t.Errorf("Gaps: got %v for another content type", got)
+	}
+
+	// setting a gap with the same key replaces it
+	content.Attempts = 2
+	content.Unrecoverable = true
+	setGap(t, l, ct, content)
+	got = gaps(t, l, ct)
+	if len(got) != 2 || !sameGap(got[0], content) {
+		t.Errorf("Gaps: got %+v after replacing but want %+v", got, content)
+	}
+
+	if err := l.DeleteGap(ctx, ct, window.Key()); err != nil {
+		t.Fatalf("DeleteGap: unexpected error: %s", err)
+	}
+	if got := gaps(t, l, ct); len(got) != 1 || !sameGap(got[0], content) {
+		t.Errorf("Gaps: got %+v after deleting but want %+v", got, content)
+	}
+	// deleting a missing gap is not an error
+	if err := l.DeleteGap(ctx, ct, window.Key()); err != nil {
+		t.Errorf("DeleteGap: unexpected error deleting a missing gap: %s", err)
+	}
+}
+
+func testGapsCanceled(t *testing.T, s office365.State) {
+	l := ledger(t, s)
+	ct := schema.AuditAzureActiveDirectory
+	g := office365.Gap{Kind: office365.GapContent, ContentID: "abc", Expiration: base}
+	setGap(t, l, ct, g)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := l.Gaps(ctx, ct); err == nil {
+		t.Errorf("Gaps: got no error using a canceled context")
+	}
+	if err := l.SetGap(ctx, ct, office365.Gap{Kind: office365.GapContent, ContentID: "def"}); err == nil {
+		t.Errorf("SetGap: got no error using a canceled context")
+	}
+	if err := l.DeleteGap(ctx, ct, g.Key()); err == nil {
+		t.Errorf("DeleteGap: got no error using a canceled context")
+	}
+	if got := gaps(t, l, ct); len(got) != 1 || got[0].Key() != g.Key() {
+		t.Errorf("Gaps: got %+v after canceled operations but want %+v", got, g)
+	}
+}
+
+func testEditor(t *testing.T, s office365.State) {
+	e, ok := s.(office365.StateEditor)
+	if !ok {
+		t.Skip("State does not implement office365.StateEditor")
+	}
+	ctx := context.Background()
+	ct := schema.AuditExchange
+	other := schema.AuditSharePoint
+
+	for _, c := range checkpoints {
+		set(t, s, c, ct, base)
+		set(t, s, c, other, base)
+	}
+	setProcessed(t, s, ct, "abc", base)
+	setProcessed(t, s, other, "abc", base)
+	l, hasGaps := s.(office365.GapLedger)
+	gap := office365.Gap{Kind: office365.GapContent, ContentID: "abc", Expiration: base}
+	if hasGaps {
+		setGap(t, l, ct, gap)
+		setGap(t, l, other, gap)
+	}
+
+	got, err := e.ContentTypeState(ctx, ct)
+	if err != nil {
+		t.Fatalf("ContentTypeState: unexpected error: %s", err)
+	}
+	for _, v := range []time.Time{got.LastContentCreated, got.LastRequestTime, got.BackfillProgress} {
+		if !v.Equal(base) {
+			t.Errorf("ContentTypeState: got checkpoint %v but want %v", v, base)
+		}
+	}
+	if _, ok := got.ProcessedContent["abc"]; !ok || len(got.ProcessedContent) != 1 {
+		t.Errorf("ContentTypeState: got processed content %v but want abc", got.ProcessedContent)
+	}
+	if hasGaps {
+		if g, ok := got.Gaps[gap.Key()]; !ok || !sameGap(g, gap) || len(got.Gaps) != 1 {
+			t.Errorf("ContentTypeState: got gaps %+v but want %+v", got.Gaps, gap)
+		}
+	}
+
+	// checkpoints can be moved backward and cleared
+	earlier := base.Add(-time.Hour)
+	if err := e.ReplaceCheckpoint(ctx, ct, office365.CheckpointLastRequestTime, earlier); err != nil {
+		t.Fatalf("ReplaceCheckpoint: unexpected error: %s", err)
+	}
+	if got := get(t, s, checkpoints[1], ct); !got.Equal(earlier) {
+		t.Errorf("LastRequestTime: got %v after replacing but want %v", got, earlier)
+	}
+	if err := e.ReplaceCheckpoint(ctx, ct, office365.CheckpointLastRequestTime, time.Time{}); err != nil {
+		t.Fatalf("ReplaceCheckpoint: unexpected error: %s", err)
+	}
+	if got := get(t, s, checkpoints[1], ct); !got.IsZero() {
+		t.Errorf("LastRequestTime: got %v after clearing but want zero time", got)
+	}
+	if err := e.ReplaceCheckpoint(ctx, ct, office365.Checkpoint("invalid"), base); err == nil {
+		t.Errorf("ReplaceCheckpoint: got no error using an invalid checkpoint")
+	}
+
+	if err := e.ResetContentType(ctx, ct); err != nil {
+		t.Fatalf("ResetContentType: unexpected error: %s", err)
+	}
+	for _, c := range checkpoints {
+		if got := get(t, s, c, ct); !got.IsZero() {
+			t.Errorf("%s: got %v after reset but want zero time", c.name, got)
+		}
+		if got := get(t, s, c, other); !got.Equal(base) {
+			t.Errorf("%s: got %v for another content type after reset but want %v", c.name, got, base)
+		}
+	}
+	if processed(t, s, ct, "abc") {
+		t.Errorf("content abc processed after reset")
+	}
+	if !processed(t, s, other, "abc") {
+		t.Errorf("content abc of another content type not processed after reset")
+	}
+	if hasGaps {
+		if got := gaps(t, l, ct); len(got) != 0 {
+			t.Errorf("Gaps: got %+v after reset", got)
+		}
+		if got := gaps(t, l, other); len(got) != 1 {
+			t.Errorf("Gaps: got %+v for another content type after reset but want %+v", got, gap)
+		}
+	}
+}
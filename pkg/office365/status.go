@@ -0,0 +1,212 @@
+package office365
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+// WatcherStatus is a snapshot of the progress of a SubscriptionWatcher.
+type WatcherStatus struct {
+	Started time.Time `json:"started"`
+	// TokenObtained is set once a request reached the API,
+	// meaning that an access token was obtained.
+	TokenObtained bool `json:"tokenObtained"`
+	// SubscriptionsListed is the last time subscriptions were listed successfully.
+	SubscriptionsListed *time.Time `json:"subscriptionsListed,omitempty"`
+	// LastError is the last error not related to a specific content type.
+	LastError *StatusError `json:"lastError,omitempty"`
+
+	ContentTypes map[string]*ContentTypeStatus `json:"contentTypes"`
+}
+
+// ContentTypeStatus is a snapshot of the progress of the pipeline of a content type.
+type ContentTypeStatus struct {
+	// LastCycle is the last time the pipeline went through a window,
+	// or through a backfill chunk, without error.
+	LastCycle *time.Time `json:"lastCycle,omitempty"`
+	// LastProgress is the last time a content blob was fetched or skipped,
+	// so that long windows and backfill chunks are seen progressing.
+	LastProgress *time.Time                `json:"lastProgress,omitempty"`
+	LastError    *StatusError              `json:"lastError,omitempty"`
+	Checkpoints  map[Checkpoint]*time.Time `json:"checkpoints"`
+}
+
+// StatusError is an error encountered by a SubscriptionWatcher.
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Ready returns whether an access token was obtained and subscriptions were listed.
+func (w *WatcherStatus) Ready() bool {
+	return w.TokenObtained && w.SubscriptionsListed != nil
+}
+
+// Healthy returns an error listing the content types whose pipeline neither
+// went through a cycle nor fetched content within maxAge, as of now.
+// Pipelines that did not make progress yet are measured from Started.
+func (w *WatcherStatus) Healthy(now time.Time, maxAge time.Duration) error {
+	var stale []string
+	for name, ct := range w.ContentTypes {
+		last := w.Started
+		if ct.LastCycle != nil && ct.LastCycle.After(last) {
+			last = *ct.LastCycle
+		}
+		if ct.LastProgress != nil && ct.LastProgress.After(last) {
+			last = *ct.LastProgress
+		}
+		if now.Sub(last) > maxAge {
+			stale = append(stale, fmt.Sprintf("%s (%s)", name, now.Sub(last).Truncate(time.Second).String()))
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return fmt.Errorf("no progress within %s: %s", maxAge.String(), strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// watcherStatus tracks the progress of a SubscriptionWatcher.
+type watcherStatus struct {
+	mu                  sync.Mutex
+	started             time.Time
+	tokenObtained       bool
+	subscriptionsListed time.Time
+	lastError           *StatusError
+	lastCycle           map[schema.ContentType]time.Time
+	lastProgress        map[schema.ContentType]time.Time
+	lastErrors          map[schema.ContentType]*StatusError
+}
+
+func newWatcherStatus() *watcherStatus {
+	return &watcherStatus{
+		started:      time.Now(),
+		lastCycle:    make(map[schema.ContentType]time.Time),
+		lastProgress: make(map[schema.ContentType]time.Time),
+		lastErrors:   make(map[schema.ContentType]*StatusError),
+	}
+}
+
+// start resets the time pipelines are measured from.
+func (w *watcherStatus) start(t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.started = t
+}
+
+// listed records that subscriptions were listed, or the error encountered doing so.
+func (w *watcherStatus) listed(t time.Time, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var errResp *ErrorResponse
+	if err == nil || errors.As(err, &errResp) {
+		w.tokenObtained = true
+	}
+	if err != nil {
+		w.lastError = &StatusError{Time: t, Message: err.Error()}
+		return
+	}
+	w.subscriptionsListed = t
+}
+
+// listedSince returns whether subscriptions were listed at or after t.
+func (w *watcherStatus) listedSince(t time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.subscriptionsListed.IsZero() && !w.subscriptionsListed.Before(t)
+}
+
+// cycle records that the pipeline of ct went through a cycle.
+func (w *watcherStatus) cycle(ct schema.ContentType, t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.After(w.lastCycle[ct]) {
+		w.lastCycle[ct] = t
+	}
+}
+
+// progress records that the pipeline of ct fetched or skipped a content blob.
+func (w *watcherStatus) progress(ct schema.ContentType, t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.After(w.lastProgress[ct]) {
+		w.lastProgress[ct] = t
+	}
+}
+
+// fail records an error encountered by the pipeline of ct.
+// Errors caused by cancellation are ignored.
+func (w *watcherStatus) fail(ct schema.ContentType, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastErrors[ct] = &StatusError{Time: time.Now(), Message: err.Error()}
+}
+
+// Status returns a snapshot of the progress of the watcher,
+// including the checkpoints of every selected content type.
+func (s *SubscriptionWatcher) Status(ctx context.Context) (*WatcherStatus, error) {
+	timePtr := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+
+	s.status.mu.Lock()
+	status := &WatcherStatus{
+		Started:             s.status.started,
+		TokenObtained:       s.status.tokenObtained,
+		SubscriptionsListed: timePtr(s.status.subscriptionsListed),
+		LastError:           s.status.lastError,
+		ContentTypes:        make(map[string]*ContentTypeStatus),
+	}
+	for _, ct := range s.Config().ContentTypes() {
+		status.ContentTypes[ct.String()] = &ContentTypeStatus{
+			LastCycle:    timePtr(s.status.lastCycle[ct]),
+			LastProgress: timePtr(s.status.lastProgress[ct]),
+			LastError:    s.status.lastErrors[ct],
+		}
+	}
+	s.status.mu.Unlock()
+
+	for _, ct := range s.Config().ContentTypes() {
+		checkpoints := make(map[Checkpoint]*time.Time)
+		for _, c := range GetCheckpoints() {
+			get, err := s.checkpointGetter(c)
+			if err != nil {
+				return nil, err
+			}
+			t, err := get(ctx, ct)
+			if err != nil {
+				return nil, err
+			}
+			checkpoints[c] = timePtr(t)
+		}
+		status.ContentTypes[ct.String()].Checkpoints = checkpoints
+	}
+	return status, nil
+}
+
+// checkpointGetter returns the State getter of the provided checkpoint.
+func (s *SubscriptionWatcher) checkpointGetter(c Checkpoint) (func(context.Context, schema.ContentType) (time.Time, error), error) {
+	switch c {
+	case CheckpointLastContentCreated:
+		return s.State.LastContentCreated, nil
+	case CheckpointLastRequestTime:
+		return s.State.LastRequestTime, nil
+	case CheckpointBackfillProgress:
+		return s.State.BackfillProgress, nil
+	}
+	return nil, fmt.Errorf("checkpoint invalid: %s", c)
+}
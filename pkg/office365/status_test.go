@@ -0,0 +1,112 @@
+package office365
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func TestWatcherStatus(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditSharePoint
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	stubContentPipeline(t, mux, client, nil, nil)
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{IncludeContentTypes: []schema.ContentType{ct}})
+	done := make(chan struct{})
+	defer close(done)
+
+	status, err := watcher.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Ready() {
+		t.Errorf("got ready before subscriptions were listed")
+	}
+
+	now := time.Now()
+	for sub := range watcher.fetchSubscriptions(context.Background(), done, now) {
+		for range watcher.fetchContent(context.Background(), done, sub) {
+		}
+	}
+
+	status, err = watcher.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Ready() {
+		t.Errorf("got not ready after subscriptions were listed: %+v", status)
+	}
+	ctStatus := status.ContentTypes[ct.String()]
+	if ctStatus == nil || ctStatus.LastCycle == nil {
+		t.Fatalf("got no cycle for %s: %+v", ct.String(), status.ContentTypes)
+	}
+	if got := ctStatus.Checkpoints[CheckpointLastRequestTime]; got == nil || !got.Equal(now) {
+		t.Errorf("got lastRequestTime checkpoint %v but want %v", got, now)
+	}
+	if err := status.Healthy(time.Now(), time.Minute); err != nil {
+		t.Errorf("got unhealthy: %s", err)
+	}
+	if err := status.Healthy(ctStatus.LastCycle.Add(2*time.Minute), time.Minute); err == nil {
+		t.Errorf("got healthy although no cycle completed within a minute")
+	}
+
+	// content fetched within a long window or backfill chunk counts as progress
+	watcher.contentFetched(ct, "abc", 1)
+	status, err = watcher.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctStatus = status.ContentTypes[ct.String()]
+	if ctStatus.LastProgress == nil || ctStatus.LastProgress.Before(*ctStatus.LastCycle) {
+		t.Fatalf("got lastProgress %v after content was fetched", ctStatus.LastProgress)
+	}
+	if err := status.Healthy(ctStatus.LastProgress.Add(30*time.Second), time.Minute); err != nil {
+		t.Errorf("got unhealthy although content was fetched within a minute: %s", err)
+	}
+	if err := status.Healthy(ctStatus.LastProgress.Add(2*time.Minute), time.Minute); err == nil {
+		t.Errorf("got healthy although no progress was made within a minute")
+	}
+}
+
+func TestWatcherStatusNotReady(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	done := make(chan struct{})
+	defer close(done)
+
+	for range watcher.fetchSubscriptions(context.Background(), done, time.Now()) {
+	}
+
+	status, err := watcher.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.TokenObtained {
+		t.Errorf("got no token obtained although the API responded")
+	}
+	if status.Ready() {
+		t.Errorf("got ready although subscriptions could not be listed")
+	}
+	if status.LastError == nil {
+		t.Errorf("got no last error")
+	}
+}
@@ -103,6 +103,15 @@ func (s *SubscriptionService) Stop(ctx context.Context, ct *schema.ContentType)
 	return resp, err
 }
 
+// SubscriptionStatus is the status of a subscription returned by the API.
+type SubscriptionStatus string
+
+// SubscriptionStatus enum.
+const (
+	SubscriptionStatusEnabled  SubscriptionStatus = "enabled"
+	SubscriptionStatusDisabled SubscriptionStatus = "disabled"
+)
+
 // Subscription represents a response.
 type Subscription struct {
 	ContentType *string  `json:"contentType"`
@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/devodev/go-office365/v0/pkg/office365/schema"
-	"github.com/sirupsen/logrus"
+)
+
+var (
+	defaultFetchConcurrency = 1
+
+	// errWindowNotHandled is reported when some records of a window were not acknowledged.
+	errWindowNotHandled = errors.New("window not fully handled, will retry")
 )
 
 // Watcher is an interface used by Watch for generating a stream of records.
@@ -20,12 +28,25 @@ type Watcher interface {
 // It fetches current subscriptions, then queries content available for a given interval
 // and proceed to query audit records.
 type SubscriptionWatcher struct {
+	mu     sync.RWMutex
 	client *Client
 	config SubscriptionWatcherConfig
-	logger *logrus.Logger
+	logger Logger
+	status *watcherStatus
+	// schedule decides when pipelines are triggered when the polling interval is adaptive.
+	schedule *pollSchedule
+	// stopping is closed once no new work must be started.
+	stopping chan struct{}
+	// reloaded notifies Run that the configuration changed.
+	reloaded chan struct{}
 
 	State
 	Handler ResourceHandler
+	// Metrics receives measurements about the content and records going through the watcher.
+	Metrics Metrics
+	// Events receives the events of the watcher, when not nil.
+	// Events are dropped when the channel is full, so it should be buffered.
+	Events chan<- Event
 }
 
 // SubscriptionWatcherConfig .
@@ -33,128 +54,448 @@ type SubscriptionWatcherConfig struct {
 	LookBehindMinutes     int
 	TickerIntervalSeconds int
 	AddExtendedSchemas    bool
+
+	// IncludeContentTypes restricts the watcher to the provided content types.
+	// When empty, every content type is watched.
+	IncludeContentTypes []schema.ContentType
+	// ExcludeContentTypes removes the provided content types from the watched ones.
+	ExcludeContentTypes []schema.ContentType
+
+	// EnsureSubscriptions makes the watcher start the subscriptions of selected content types
+	// that are missing or disabled, at startup and on every tick.
+	EnsureSubscriptions bool
+	// Webhook is provided when starting subscriptions, if not nil.
+	Webhook *Webhook
+
+	// BackfillFrom makes the watcher walk the window between BackfillFrom and now
+	// for each selected content type, before tailing. Backfill is disabled when zero.
+	// It is limited to the last 7 days, as older content is not available.
+	BackfillFrom time.Time
+	// BackfillConcurrency is the maximum number of backfill chunks fetched concurrently.
+	BackfillConcurrency int
+
+	// RescanHorizonMinutes makes the watcher list the windows it already went through
+	// again, up to RescanHorizonMinutes in the past, to pick up content that shows up
+	// in listings after its creation time. Rescan is disabled when zero.
+	RescanHorizonMinutes int
+	// RescanIntervalSeconds is the interval at which rescans are triggered.
+	RescanIntervalSeconds int
+
+	// FetchConcurrency is the maximum number of content blobs whose audit records
+	// are fetched concurrently by the pipeline of each content type. Defaults to 1.
+	// Records are still sent in the order content was listed, one content blob at a time.
+	FetchConcurrency int
+	// ContentTypeFetchConcurrency overrides FetchConcurrency for the provided content types.
+	ContentTypeFetchConcurrency map[schema.ContentType]int
+
+	// ShutdownTimeoutSeconds is the time given to in-flight content blobs to be handled
+	// once the context provided to Run is cancelled. No new work is started meanwhile.
+	// In-flight requests and records are abandoned right away when zero.
+	ShutdownTimeoutSeconds int
+
+	// MinPollIntervalSeconds and MaxPollIntervalSeconds make the polling interval adaptive
+	// when MaxPollIntervalSeconds is greater than 0. The interval of each content type
+	// starts at TickerIntervalSeconds, is halved after a cycle that found new content and
+	// doubled after a cycle that found none, within those bounds. Jitter is added to every poll.
+	MinPollIntervalSeconds int
+	MaxPollIntervalSeconds int
 }
 
-// NewSubscriptionWatcher returns a new watcher that uses the provided client
-// for querying the API.
-func NewSubscriptionWatcher(client *Client, conf SubscriptionWatcherConfig, s State, h ResourceHandler, l *logrus.Logger) (*SubscriptionWatcher, error) {
-	lookBehindDur := time.Duration(conf.LookBehindMinutes) * time.Minute
+// ContentTypes returns the content types selected by the include and exclude lists,
+// sorted in declaration order.
+func (c SubscriptionWatcherConfig) ContentTypes() []schema.ContentType {
+	candidates := c.IncludeContentTypes
+	if len(candidates) == 0 {
+		candidates = schema.GetContentTypes()
+	}
+	excluded := make(map[schema.ContentType]bool)
+	for _, ct := range c.ExcludeContentTypes {
+		excluded[ct] = true
+	}
+
+	var result []schema.ContentType
+	seen := make(map[schema.ContentType]bool)
+	for _, ct := range candidates {
+		if excluded[ct] || seen[ct] {
+			continue
+		}
+		seen[ct] = true
+		result = append(result, ct)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// adaptive returns whether the polling interval of content types is adaptive.
+func (c SubscriptionWatcherConfig) adaptive() bool {
+	return c.MaxPollIntervalSeconds > 0
+}
+
+// tickInterval returns the interval at which subscriptions are checked.
+// When the polling interval is adaptive, it is checked at the shortest interval
+// and only the content types that are due are triggered.
+func (c SubscriptionWatcherConfig) tickInterval() time.Duration {
+	if c.adaptive() {
+		return time.Duration(c.MinPollIntervalSeconds) * time.Second
+	}
+	return time.Duration(c.TickerIntervalSeconds) * time.Second
+}
+
+// MaxPollInterval returns the longest time between two triggers of the pipeline of a content type.
+func (c SubscriptionWatcherConfig) MaxPollInterval() time.Duration {
+	if c.adaptive() {
+		return time.Duration(c.MaxPollIntervalSeconds) * time.Second
+	}
+	return time.Duration(c.TickerIntervalSeconds) * time.Second
+}
+
+// fetchConcurrency returns the maximum number of content blobs of ct fetched concurrently.
+func (c SubscriptionWatcherConfig) fetchConcurrency(ct schema.ContentType) int {
+	n := c.FetchConcurrency
+	if v, ok := c.ContentTypeFetchConcurrency[ct]; ok {
+		n = v
+	}
+	if n <= 0 {
+		n = defaultFetchConcurrency
+	}
+	return n
+}
+
+// selected returns whether the provided content type is watched.
+func (c SubscriptionWatcherConfig) selected(ct schema.ContentType) bool {
+	for _, t := range c.ContentTypes() {
+		if t == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error if the configuration is invalid.
+func (c SubscriptionWatcherConfig) validate() error {
+	lookBehindDur := time.Duration(c.LookBehindMinutes) * time.Minute
 	if lookBehindDur <= 0 {
-		return nil, fmt.Errorf("lookBehindMinutes must be greater than 0")
+		return fmt.Errorf("lookBehindMinutes must be greater than 0")
 	}
 	if lookBehindDur > 24*time.Hour {
-		return nil, fmt.Errorf("lookBehindMinutes must be less than or equal to 24 hours")
+		return fmt.Errorf("lookBehindMinutes must be less than or equal to 24 hours")
 	}
 
-	tickerIntervalDur := time.Duration(conf.TickerIntervalSeconds) * time.Second
+	tickerIntervalDur := time.Duration(c.TickerIntervalSeconds) * time.Second
 	if tickerIntervalDur <= 0 {
-		return nil, fmt.Errorf("tickerIntervalSeconds must be greater than 0")
+		return fmt.Errorf("tickerIntervalSeconds must be greater than 0")
 	}
 	if tickerIntervalDur > time.Hour {
-		return nil, fmt.Errorf("tickerIntervalSeconds must be less than or equal to 1 hour")
+		return fmt.Errorf("tickerIntervalSeconds must be less than or equal to 1 hour")
+	}
+
+	if len(c.ContentTypes()) == 0 {
+		return fmt.Errorf("at least one content type must be selected")
+	}
+
+	if c.BackfillFrom.After(time.Now()) {
+		return fmt.Errorf("backfillFrom must not be in the future")
+	}
+	if c.BackfillConcurrency < 0 {
+		return fmt.Errorf("backfillConcurrency must be greater than or equal to 0")
+	}
+
+	if c.MinPollIntervalSeconds < 0 || c.MaxPollIntervalSeconds < 0 {
+		return fmt.Errorf("minPollIntervalSeconds and maxPollIntervalSeconds must be greater than or equal to 0")
+	}
+	if c.adaptive() {
+		if c.MinPollIntervalSeconds == 0 {
+			return fmt.Errorf("minPollIntervalSeconds must be greater than 0")
+		}
+		if c.MinPollIntervalSeconds > c.MaxPollIntervalSeconds {
+			return fmt.Errorf("minPollIntervalSeconds must be less than or equal to maxPollIntervalSeconds")
+		}
+		if time.Duration(c.MaxPollIntervalSeconds)*time.Second > time.Hour {
+			return fmt.Errorf("maxPollIntervalSeconds must be less than or equal to 1 hour")
+		}
+	}
+
+	if c.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("shutdownTimeoutSeconds must be greater than or equal to 0")
+	}
+
+	if c.FetchConcurrency < 0 {
+		return fmt.Errorf("fetchConcurrency must be greater than or equal to 0")
+	}
+	for ct, n := range c.ContentTypeFetchConcurrency {
+		if n < 0 {
+			return fmt.Errorf("fetchConcurrency of %s must be greater than or equal to 0", ct.String())
+		}
+	}
+
+	rescanHorizonDur := time.Duration(c.RescanHorizonMinutes) * time.Minute
+	if rescanHorizonDur < 0 {
+		return fmt.Errorf("rescanHorizonMinutes must be greater than or equal to 0")
+	}
+	if rescanHorizonDur > intervalOneWeek {
+		return fmt.Errorf("rescanHorizonMinutes must be less than or equal to 7 days")
+	}
+	if rescanHorizonDur > 0 && c.RescanIntervalSeconds <= 0 {
+		return fmt.Errorf("rescanIntervalSeconds must be greater than 0")
+	}
+	return nil
+}
+
+// NewSubscriptionWatcher returns a new watcher that uses the provided client
+// for querying the API. Nothing is logged when l is nil.
+func NewSubscriptionWatcher(client *Client, conf SubscriptionWatcherConfig, s State, h ResourceHandler, l Logger) (*SubscriptionWatcher, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
 	}
 
 	watcher := &SubscriptionWatcher{
-		client: client,
-		config: conf,
-		logger: l,
+		client:   client,
+		config:   conf,
+		logger:   orNop(l),
+		status:   newWatcherStatus(),
+		schedule: newPollSchedule(),
+		reloaded: make(chan struct{}, 1),
 
 		State:   s,
 		Handler: h,
+		Metrics: NopMetrics{},
 	}
 	return watcher, nil
 }
 
+// Config returns the configuration currently used by the watcher.
+func (s *SubscriptionWatcher) Config() SubscriptionWatcherConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// getClient returns the client currently used by the watcher.
+func (s *SubscriptionWatcher) getClient() *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
+// Reload replaces the client and configuration used by the watcher, without losing its state.
+// Pipelines are started for content types added to the selection and stopped for the ones removed
+// once their current cycle completes. Other pipelines pick up the new configuration on their next cycle.
+// Backfill settings are only used when Run starts.
+func (s *SubscriptionWatcher) Reload(client *Client, conf SubscriptionWatcherConfig) error {
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.client = client
+	s.config = conf
+	s.mu.Unlock()
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
 // Run implements the Watcher interface.
+// Once ctx is cancelled, no new work is started and in-flight content blobs
+// are given up to ShutdownTimeoutSeconds to be handled before being abandoned.
+// It returns once the handler returns.
 func (s *SubscriptionWatcher) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
 	done := make(chan struct{})
 	out := make(chan ResourceAudits)
+	s.stopping = make(chan struct{})
+	s.status.start(time.Now())
+
+	// work is only cancelled once the shutdown timeout expires
+	parent := ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drained := make(chan struct{})
 
 	// setup worker pool
 	// workers receive jobs and send results to output channel
 	workers := make(map[schema.ContentType]chan ResourceSubscription)
-	contentTypes := schema.GetContentTypes()
-
-	wg.Add(len(contentTypes))
-	for _, ct := range contentTypes {
-		s.logger.WithField("content-type", ct.String()).Info("starting worker")
+	startWorker := func(ct schema.ContentType) {
+		s.logger.WithField("content-type", ct.String()).Infof("starting worker")
 		ch := make(chan ResourceSubscription, 1)
 		workers[ct] = ch
 
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for res := range ch {
+				if s.stopped() {
+					continue
+				}
 				contentCh := s.fetchContent(ctx, done, res)
-				auditCh := s.fetchAudits(ctx, done, contentCh)
+				auditCh := s.fetchAudits(ctx, done, ct, contentCh)
 
 				for a := range auditCh {
 					out <- a
 				}
+				s.scheduleNext(ct)
 			}
 		}()
 	}
+	closeWorker := func(ct schema.ContentType) {
+		s.logger.WithField("content-type", ct.String()).Infof("closing worker")
+		close(workers[ct])
+		delete(workers, ct)
+	}
+	conf := s.Config()
+	contentTypes := conf.ContentTypes()
+	for _, ct := range contentTypes {
+		startWorker(ct)
+	}
+
+	// rescans start once backfill is over
+	tailing := make(chan struct{})
+	if conf.RescanHorizonMinutes > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-s.stopping:
+				return
+			case <-tailing:
+			}
+			s.runRescan(ctx, done, out)
+		}()
+	}
+
+	// gaps are retried when the state can record them
+	if ledger, ok := s.gapLedger(); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runGapRetry(ctx, done, out, ledger)
+		}()
+	}
 
 	// this goroutine is responsible for closing output channel
 	go func() {
 		wg.Wait()
+		close(drained)
 		close(out)
 	}()
 
 	// setup ticker that will periodically fetch subscriptions
 	// and create jobs for workers.
-	// this goroutine is responsible for closing worker channels
+	// this goroutine is responsible for starting and closing workers
+	wg.Add(1)
 	go func() {
-		tickerDur := time.Duration(s.config.TickerIntervalSeconds) * time.Second
+		defer wg.Done()
+
+		tickerDur := conf.tickInterval()
 		ticker := time.NewTicker(tickerDur)
-		defer ticker.Stop()
+		defer func() { ticker.Stop() }()
 
-		s.logger.Infoln("start main")
-		s.logger.Infof("using config: %+v", s.config)
+		s.logger.Infof("start main")
+		s.logger.Infof("using config: %+v", conf)
 
 		fetch := func(t time.Time) {
+			// with an adaptive interval, only the content types that are due are triggered
+			adaptive := s.Config().adaptive()
+			if adaptive {
+				due := false
+				for ct := range workers {
+					due = due || s.schedule.due(ct, t)
+				}
+				if !due {
+					return
+				}
+			}
+
 			subCh := s.fetchSubscriptions(ctx, done, t)
 			for sub := range subCh {
 				ctLogger := s.logger.WithField("content-type", sub.ContentType.String())
 				workerCh, ok := workers[*sub.ContentType]
 				if !ok {
-					ctLogger.Error("no worker registered for content-type")
+					ctLogger.Errorf("no worker registered for content-type")
+					continue
+				}
+				if adaptive && !s.schedule.due(*sub.ContentType, t) {
 					continue
 				}
 				select {
 				default:
-					ctLogger.Warn("worker is busy, skipping")
+					ctLogger.Warnf("worker is busy, skipping")
 				case workerCh <- sub:
-					ctLogger.Debugln("sent work")
+					s.schedule.start(*sub.ContentType)
+					ctLogger.Debugf("sent work")
 				}
 			}
 		}
 
-		fetch(time.Now())
+		if !conf.BackfillFrom.IsZero() {
+			s.backfill(ctx, done, out, contentTypes)
+		}
+		close(tailing)
+
+		if !s.stopped() {
+			fetch(time.Now())
+		}
 	Loop:
 		for {
 			select {
-			case <-done:
-				for ct, workerCh := range workers {
-					s.logger.WithField("content-type", ct.String()).Info("closing worker")
-					close(workerCh)
+			case <-s.stopping:
+				for ct := range workers {
+					closeWorker(ct)
 				}
 				break Loop
+			case <-s.reloaded:
+				conf := s.Config()
+				s.logger.Infof("reloaded config: %+v", conf)
+
+				// workers are started before others are closed
+				// so that the output channel is never closed in between
+				selected := make(map[schema.ContentType]bool)
+				for _, ct := range conf.ContentTypes() {
+					selected[ct] = true
+					if _, ok := workers[ct]; !ok {
+						startWorker(ct)
+					}
+				}
+				for ct := range workers {
+					if !selected[ct] {
+						closeWorker(ct)
+					}
+				}
+				if d := conf.tickInterval(); d != tickerDur {
+					tickerDur = d
+					ticker.Stop()
+					ticker = time.NewTicker(tickerDur)
+				}
 			case t := <-ticker.C:
 				fetch(t)
 			}
 		}
-		s.logger.Infoln("end main")
+		s.logger.Infof("end main")
 	}()
 
 	// this goroutine is responsible for notifying
 	// everyone that we want to exit
 	go func() {
 		select {
-		case <-ctx.Done():
-			close(done)
+		case <-parent.Done():
+		case <-drained:
 			return
 		}
+		close(s.stopping)
+
+		if timeout := time.Duration(s.Config().ShutdownTimeoutSeconds) * time.Second; timeout > 0 {
+			s.logger.Infof("stopping: waiting up to %s for in-flight content", timeout.String())
+			select {
+			case <-drained:
+				return
+			case <-time.After(timeout):
+				s.logger.Warnf("stopping: shutdown timeout expired, abandoning in-flight content")
+			}
+		}
+		cancel()
+		close(done)
 	}()
 
 	return s.Handler.Handle(out)
@@ -167,14 +508,23 @@ func (s *SubscriptionWatcher) fetchSubscriptions(ctx context.Context, done chan
 	output := func() {
 		defer wg.Done()
 
-		s.logger.Debugln("fetchSubscriptions: start")
+		s.logger.Debugf("fetchSubscriptions: start")
 
-		_, subscriptions, err := s.client.Subscription.List(ctx)
+		_, subscriptions, err := s.getClient().Subscription.List(ctx)
+		if !errors.Is(err, context.Canceled) {
+			s.status.listed(time.Now(), err)
+		}
 		if err != nil {
 			subscriptions = []Subscription{}
 			if !errors.Is(err, context.Canceled) {
 				s.logger.Errorf("fetchSubscriptions: fetching subscriptions: %s", err)
 			}
+			s.fetchFailed(nil, "", OperationSubscriptions, err)
+		} else {
+			s.emit(SubscriptionsListed{Time: time.Now(), Subscriptions: subscriptions})
+			if s.Config().EnsureSubscriptions {
+				subscriptions = s.ensureSubscriptions(ctx, subscriptions)
+			}
 		}
 		for _, sub := range subscriptions {
 			ct, err := schema.GetContentType(*sub.ContentType)
@@ -182,13 +532,17 @@ func (s *SubscriptionWatcher) fetchSubscriptions(ctx context.Context, done chan
 				s.logger.Errorf("fetchSubscriptions: mapping contentType: %s", err)
 				continue
 			}
+			if !s.Config().selected(*ct) {
+				s.logger.WithField("content-type", ct.String()).Debugf("fetchSubscriptions: content-type not selected, skipping")
+				continue
+			}
 			select {
 			case <-done:
 				return
 			case out <- ResourceSubscription{ct, t, sub}:
 			}
 		}
-		s.logger.Debugln("fetchSubscriptions: end")
+		s.logger.Debugf("fetchSubscriptions: end")
 	}
 
 	wg.Add(1)
@@ -202,6 +556,58 @@ func (s *SubscriptionWatcher) fetchSubscriptions(ctx context.Context, done chan
 	return out
 }
 
+// ensureSubscriptions starts the subscriptions of selected content types
+// that are either missing or disabled, and returns the updated list of subscriptions.
+func (s *SubscriptionWatcher) ensureSubscriptions(ctx context.Context, subscriptions []Subscription) []Subscription {
+	current := make(map[schema.ContentType]int)
+	for idx, sub := range subscriptions {
+		if sub.ContentType == nil {
+			continue
+		}
+		ct, err := schema.GetContentType(*sub.ContentType)
+		if err != nil {
+			continue
+		}
+		current[*ct] = idx
+	}
+
+	for _, ct := range s.Config().ContentTypes() {
+		ct := ct
+		ctLogger := s.logger.WithField("content-type", ct.String())
+
+		status := "missing"
+		idx, ok := current[ct]
+		if ok {
+			if sub := subscriptions[idx]; sub.Status != nil {
+				status = *sub.Status
+			}
+			if strings.EqualFold(status, string(SubscriptionStatusEnabled)) {
+				continue
+			}
+		}
+
+		_, sub, err := s.getClient().Subscription.Start(ctx, &ct, s.Config().Webhook)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctLogger.Errorf("ensureSubscriptions: could not start subscription (%s): %s", status, err)
+			}
+			s.fetchFailed(&ct, "", OperationSubscriptions, err)
+			continue
+		}
+		ctLogger.Infof("ensureSubscriptions: started subscription (%s)", status)
+
+		if sub == nil {
+			continue
+		}
+		if ok {
+			subscriptions[idx] = *sub
+		} else {
+			subscriptions = append(subscriptions, *sub)
+		}
+	}
+	return subscriptions
+}
+
 func (s *SubscriptionWatcher) fetchContent(ctx context.Context, done chan struct{}, res ResourceSubscription) chan ResourceContent {
 	var wg sync.WaitGroup
 	out := make(chan ResourceContent)
@@ -210,13 +616,30 @@ func (s *SubscriptionWatcher) fetchContent(ctx context.Context, done chan struct
 		defer wg.Done()
 
 		ctLogger := s.logger.WithField("content-type", sub.ContentType.String())
-		ctLogger.Debugln("fetchContent: start")
+		ctLogger.Debugf("fetchContent: start")
+
+		// processed content is only needed until it expires
+		if err := s.State.PruneContent(ctx, *sub.ContentType, sub.RequestTime); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctLogger.Errorf("fetchContent: could not prune processed content: %s", err)
+			}
+			s.status.fail(*sub.ContentType, err)
+			s.fetchFailed(sub.ContentType, "", OperationState, err)
+		}
 
 		end := sub.RequestTime
 		ctLogger.Debugf("fetchContent: request.RequestTime: %s", sub.RequestTime.String())
 
 		for {
-			lastRequestTime := s.getLastRequestTime(sub.ContentType)
+			lastRequestTime, err := s.State.LastRequestTime(ctx, *sub.ContentType)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					ctLogger.Errorf("fetchContent: could not get lastRequestTime: %s", err)
+				}
+				s.status.fail(*sub.ContentType, err)
+				s.fetchFailed(sub.ContentType, "", OperationState, err)
+				return
+			}
 			ctLogger.Debugf("fetchContent: got lastRequestTime: %s", lastRequestTime.String())
 
 			start := lastRequestTime
@@ -224,29 +647,101 @@ func (s *SubscriptionWatcher) fetchContent(ctx context.Context, done chan struct
 
 			ctLogger.Debugf("fetchContent: got timewindow start: %s", start.String())
 			ctLogger.Debugf("fetchContent: got timewindow end: %s", end.String())
+			s.emit(WindowPlanned{Time: time.Now(), ContentType: *sub.ContentType, Source: WindowSourceTail, Start: start, End: end})
 
-			_, content, err := s.client.Content.List(ctx, sub.ContentType, start, end)
+			_, content, err := s.getClient().Content.List(ctx, sub.ContentType, start, end)
 			if err != nil {
 				if !errors.Is(err, context.Canceled) {
 					ctLogger.Errorf("fetchContent: could not fetch content: %s", err)
 				}
+				s.status.fail(*sub.ContentType, err)
+				s.fetchFailed(sub.ContentType, "", OperationContent, err)
+
+				// tailing moves past the window once it is recorded in the gap ledger
+				gap := Gap{Kind: GapWindow, Start: start, End: end}
+				if !s.recordGap(ctLogger, *sub.ContentType, gap, err) {
+					return
+				}
+				if err := s.setCheckpoint(stateContext, *sub.ContentType, CheckpointLastRequestTime, end); err != nil {
+					ctLogger.Errorf("fetchContent: could not set lastRequestTime: %s", err)
+					s.fetchFailed(sub.ContentType, "", OperationState, err)
+					return
+				}
+				ctLogger.Debugf("fetchContent: set lastRequestTime: %s", end.String())
 				return
 			}
-			for _, c := range content {
+			s.Metrics.ContentListed(*sub.ContentType, len(content))
+			s.emit(ContentListed{Time: time.Now(), ContentType: *sub.ContentType, Start: start, End: end, Count: len(content)})
+
+			// content is sorted by creation time so that the last content created
+			// checkpoint only moves forward as content gets acknowledged
+			window := newContentWindow(func(t time.Time) {
+				s.setLastContentCreated(ctLogger, *sub.ContentType, t)
+			})
+			interrupted := false
+		Content:
+			for _, c := range sortContent(ctLogger, content) {
+				if s.stopped() {
+					interrupted = true
+					break
+				}
+				// the content is added to the window before the select, since the
+				// value sent is evaluated even when another case is chosen
+				res := ResourceContent{
+					ContentType: sub.ContentType,
+					RequestTime: sub.RequestTime,
+					Content:     c.Content,
+					created:     c.created,
+					expiration:  c.expiration,
+					window:      window,
+					mark:        window.add(c.created),
+				}
 				select {
 				case <-done:
+					window.drop()
 					return
-				case out <- ResourceContent{sub.ContentType, sub.RequestTime, c}:
+				case <-s.stopping:
+					window.drop()
+					interrupted = true
+					break Content
+				case out <- res:
+				}
+			}
+
+			// the request time checkpoint is only moved once
+			// every record of the window has been acknowledged
+			if !window.wait(done) {
+				select {
+				case <-done:
+				default:
+					if !s.stopped() {
+						ctLogger.Errorf("fetchContent: window not fully handled, will retry")
+						s.status.fail(*sub.ContentType, errWindowNotHandled)
+					}
 				}
+				return
+			}
+			if interrupted {
+				ctLogger.Infof("fetchContent: stopping, the rest of the window will be fetched on next start")
+				return
+			}
+			if err := s.setCheckpoint(stateContext, *sub.ContentType, CheckpointLastRequestTime, end); err != nil {
+				ctLogger.Errorf("fetchContent: could not set lastRequestTime: %s", err)
+				s.status.fail(*sub.ContentType, err)
+				s.fetchFailed(sub.ContentType, "", OperationState, err)
+				return
 			}
-			s.setLastRequestTime(sub.ContentType, end)
 			ctLogger.Debugf("fetchContent: set lastRequestTime: %s", end.String())
 
 			if !end.Before(sub.RequestTime) {
 				break
 			}
+			if s.stopped() {
+				return
+			}
 		}
-		ctLogger.Debugln("fetchContent: end")
+		s.status.cycle(*sub.ContentType, time.Now())
+		ctLogger.Debugf("fetchContent: end")
 	}
 
 	wg.Add(1)
@@ -260,54 +755,98 @@ func (s *SubscriptionWatcher) fetchContent(ctx context.Context, done chan struct
 	return out
 }
 
-func (s *SubscriptionWatcher) fetchAudits(ctx context.Context, done chan struct{}, contentCh chan ResourceContent) chan ResourceAudits {
+// fetchAudits fetches the audit records of the content received on contentCh,
+// up to the fetch concurrency of ct at a time, and sends them in the order
+// content was received. Records of a content blob are sent together.
+func (s *SubscriptionWatcher) fetchAudits(ctx context.Context, done chan struct{}, ct schema.ContentType, contentCh chan ResourceContent) chan ResourceAudits {
 	var wg sync.WaitGroup
 	out := make(chan ResourceAudits)
 
-	output := func(ch <-chan ResourceContent) {
-		defer wg.Done()
+	ctLogger := s.logger.WithField("content-type", ct.String())
 
-		for res := range ch {
-			ctLogger := s.logger.WithField("content-type", res.ContentType.String())
-			ctLogger.Debugln("fetchAudits: start")
+	// pending holds the results of content being fetched, in the order content was received.
+	// the content at the head of the queue is being sent, so the buffer
+	// only needs to hold the remaining concurrent fetches
+	pending := make(chan chan fetchedContent, s.Config().fetchConcurrency(ct)-1)
 
-			lastContentCreated := s.getLastContentCreated(res.ContentType)
-			ctLogger.Debugf("fetchAudits: got lastContentCreated: %s", lastContentCreated.String())
+	dispatch := func(ch <-chan ResourceContent) {
+		defer wg.Done()
+		defer close(pending)
 
-			created, err := time.ParseInLocation(CreatedDatetimeFormat, res.Content.ContentCreated, time.Local)
-			if err != nil {
-				ctLogger.Errorf("fetchAudits: could not parse ContentCreated: %s", err)
+		for res := range ch {
+			// content not being fetched yet is left for the next start
+			if s.stopped() {
+				res.fail()
 				continue
 			}
-			ctLogger.Debugf("fetchAudits: content found: %s", created.String())
-			if !created.After(lastContentCreated) {
-				ctLogger.Debugf("fetchAudits: content skipped: last[%s] GT current[%s]", lastContentCreated.String(), created.String())
+			result := make(chan fetchedContent, 1)
+			select {
+			case <-done:
+				return
+			case <-s.stopping:
+				res.fail()
 				continue
+			case pending <- result:
 			}
-			s.setLastContentCreated(res.ContentType, created)
-			ctLogger.Debugf("fetchAudits: set lastContentCreated: %s", created.String())
+			go func(res ResourceContent) {
+				audits, skipped, err := s.fetchContentAudits(ctx, ctLogger, res)
+				result <- fetchedContent{res, audits, skipped, err}
+			}(res)
+		}
+	}
 
-			ctLogger.Debugln("fetchAudits: content fetching..")
-			_, audits, err := s.client.Audit.List(ctx, res.Content.ContentID, s.config.AddExtendedSchemas)
-			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					ctLogger.Errorf("fetchAudits: could not fetch audits: %s", err)
+	output := func() {
+		defer wg.Done()
+
+		for result := range pending {
+			var f fetchedContent
+			select {
+			case <-done:
+				return
+			case f = <-result:
+			}
+			res := f.res
+			if f.err != nil {
+				s.status.fail(*res.ContentType, f.err)
+
+				// the window moves past content once it is recorded in the gap ledger,
+				// it fails and is retried when the state could not be read
+				gap := Gap{Kind: GapContent, ContentID: res.Content.ContentID, Created: res.created, Expiration: res.expiration}
+				if s.recordGap(ctLogger, *res.ContentType, gap, f.err) {
+					res.complete()
+				} else {
+					res.fail()
 				}
 				continue
 			}
-			for _, a := range audits {
-				select {
-				case <-done:
+			if f.skipped {
+				res.complete()
+				continue
+			}
+			s.schedule.contentFound(ct)
+
+			a := newAcker(len(f.audits), func() {
+				s.setContentProcessed(ctLogger, res)
+				res.complete()
+			})
+			for _, audit := range f.audits {
+				r := ResourceAudits{
+					ContentType: res.ContentType,
+					RequestTime: res.RequestTime,
+					AuditRecord: audit,
+					ack:         a.ackFunc(),
+				}
+				if !s.send(done, out, r) {
 					return
-				case out <- ResourceAudits{res.ContentType, res.RequestTime, a}:
 				}
 			}
-			ctLogger.Debugln("fetchAudits: end")
+			ctLogger.Debugf("fetchAudits: end")
 		}
 	}
 
-	wg.Add(1)
-	go output(contentCh)
+	wg.Add(2)
+	go dispatch(contentCh)
+	go output()
 
 	go func() {
 		wg.Wait()
@@ -317,13 +856,193 @@ func (s *SubscriptionWatcher) fetchAudits(ctx context.Context, done chan struct{
 	return out
 }
 
+// fetchedContent is the result of fetching the audit records of a content blob.
+type fetchedContent struct {
+	res     ResourceContent
+	audits  []interface{}
+	skipped bool
+	err     error
+}
+
+// fetchContentAudits returns the audit records of the provided content,
+// or whether it was skipped since it has already been processed.
+func (s *SubscriptionWatcher) fetchContentAudits(ctx context.Context, ctLogger Logger, res ResourceContent) ([]interface{}, bool, error) {
+	ctLogger.Debugf("fetchAudits: start")
+
+	ctLogger.Debugf("fetchAudits: content found: %s (%s)", res.Content.ContentID, res.created.String())
+	processed, err := s.State.ContentProcessed(ctx, *res.ContentType, res.Content.ContentID)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			ctLogger.Errorf("fetchAudits: could not get content state: %s", err)
+		}
+		s.fetchFailed(res.ContentType, res.Content.ContentID, OperationState, err)
+		return nil, false, &stateError{err}
+	}
+	if processed {
+		ctLogger.Debugf("fetchAudits: content skipped: %s already processed", res.Content.ContentID)
+		s.contentSkipped(*res.ContentType, res.Content.ContentID)
+		return nil, true, nil
+	}
+
+	ctLogger.Debugf("fetchAudits: content fetching..")
+	_, audits, err := s.getClient().Audit.List(ctx, res.Content.ContentID, s.Config().AddExtendedSchemas)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			ctLogger.Errorf("fetchAudits: could not fetch audits: %s", err)
+		}
+		s.fetchFailed(res.ContentType, res.Content.ContentID, OperationAudit, err)
+		return nil, false, err
+	}
+	s.contentFetched(*res.ContentType, res.Content.ContentID, len(audits))
+	return audits, false, nil
+}
+
+// fetchWindow lists the content available in the window and sends the audit records
+// of content that has not been processed yet. source is one of the WindowSource constants.
+// It returns the content that was fetched, once every record has been acknowledged.
+func (s *SubscriptionWatcher) fetchWindow(ctx context.Context, done chan struct{}, out chan<- ResourceAudits, ct schema.ContentType, source string, start, end, requestTime time.Time) ([]ResourceContent, error) {
+	ctLogger := s.logger.WithField("content-type", ct.String())
+
+	s.emit(WindowPlanned{Time: time.Now(), ContentType: ct, Source: source, Start: start, End: end})
+	_, content, err := s.getClient().Content.List(ctx, &ct, start, end)
+	if err != nil {
+		s.fetchFailed(&ct, "", OperationContent, err)
+		return nil, err
+	}
+	s.Metrics.ContentListed(ct, len(content))
+	s.emit(ContentListed{Time: time.Now(), ContentType: ct, Start: start, End: end, Count: len(content)})
+
+	window := newContentWindow(func(t time.Time) {
+		s.setLastContentCreated(ctLogger, ct, t)
+	})
+	var fetched []ResourceContent
+	for _, res := range sortContent(ctLogger, content) {
+		if s.stopped() {
+			return nil, context.Canceled
+		}
+		res.ContentType = &ct
+		res.RequestTime = requestTime
+		m := window.add(res.created)
+
+		processed, err := s.State.ContentProcessed(ctx, ct, res.Content.ContentID)
+		if err != nil {
+			window.fail()
+			s.fetchFailed(&ct, res.Content.ContentID, OperationState, err)
+			return nil, &stateError{err}
+		}
+		if processed {
+			ctLogger.Debugf("fetchWindow: content skipped: %s already processed", res.Content.ContentID)
+			s.contentSkipped(ct, res.Content.ContentID)
+			window.complete(m)
+			continue
+		}
+
+		_, audits, err := s.getClient().Audit.List(ctx, res.Content.ContentID, s.Config().AddExtendedSchemas)
+		if err != nil {
+			window.fail()
+			s.fetchFailed(&ct, res.Content.ContentID, OperationAudit, err)
+			return nil, err
+		}
+		s.contentFetched(ct, res.Content.ContentID, len(audits))
+		res := res
+		a := newAcker(len(audits), func() {
+			s.setContentProcessed(ctLogger, res)
+			window.complete(m)
+		})
+		for _, audit := range audits {
+			r := ResourceAudits{
+				ContentType: &ct,
+				RequestTime: requestTime,
+				AuditRecord: audit,
+				ack:         a.ackFunc(),
+			}
+			if !s.send(done, out, r) {
+				return nil, context.Canceled
+			}
+		}
+		fetched = append(fetched, res)
+	}
+	if !window.wait(done) {
+		return nil, context.Canceled
+	}
+	return fetched, nil
+}
+
+// scheduleNext adjusts the polling interval of ct once its cycle completed.
+func (s *SubscriptionWatcher) scheduleNext(ct schema.ContentType) {
+	conf := s.Config()
+	initial := time.Duration(conf.TickerIntervalSeconds) * time.Second
+	min := time.Duration(conf.MinPollIntervalSeconds) * time.Second
+	max := time.Duration(conf.MaxPollIntervalSeconds) * time.Second
+	wait := s.schedule.cycle(ct, time.Now(), initial, min, max)
+	if conf.adaptive() {
+		s.logger.WithField("content-type", ct.String()).Debugf("next poll in %s", wait.String())
+	}
+}
+
+// stopped returns whether new work must not be started.
+func (s *SubscriptionWatcher) stopped() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// send sends the record to the handler, unless done is closed first.
+// It returns whether the record was sent.
+func (s *SubscriptionWatcher) send(done chan struct{}, out chan<- ResourceAudits, r ResourceAudits) bool {
+	select {
+	case <-done:
+		return false
+	case out <- r:
+	}
+	s.Metrics.RecordEmitted(*r.ContentType, recordType(r.AuditRecord))
+	return true
+}
+
+// setContentProcessed records the content as processed so that it is not
+// fetched again, by an overlapping window or after a restart, until it expires.
+func (s *SubscriptionWatcher) setContentProcessed(ctLogger Logger, res ResourceContent) {
+	err := s.State.SetContentProcessed(stateContext, *res.ContentType, res.Content.ContentID, res.expiration)
+	if err != nil {
+		ctLogger.Errorf("could not set content %s processed: %s", res.Content.ContentID, err)
+		s.fetchFailed(res.ContentType, res.Content.ContentID, OperationState, err)
+	}
+}
+
+// setLastContentCreated moves the last content created checkpoint of ct.
+func (s *SubscriptionWatcher) setLastContentCreated(ctLogger Logger, ct schema.ContentType, t time.Time) {
+	if err := s.setCheckpoint(stateContext, ct, CheckpointLastContentCreated, t); err != nil {
+		ctLogger.Errorf("could not set lastContentCreated: %s", err)
+		s.fetchFailed(&ct, "", OperationState, err)
+		return
+	}
+	ctLogger.Debugf("set lastContentCreated: %s", t.String())
+}
+
+// contentFetched reports that the records of a content blob have been fetched.
+func (s *SubscriptionWatcher) contentFetched(ct schema.ContentType, contentID string, records int) {
+	s.Metrics.ContentFetched(ct)
+	s.status.progress(ct, time.Now())
+	s.emit(ContentFetched{Time: time.Now(), ContentType: ct, ContentID: contentID, Records: records})
+}
+
+// contentSkipped reports that a content blob has been skipped since it has already been processed.
+func (s *SubscriptionWatcher) contentSkipped(ct schema.ContentType, contentID string) {
+	s.Metrics.ContentSkipped(ct)
+	s.status.progress(ct, time.Now())
+	s.emit(ContentSkipped{Time: time.Now(), ContentType: ct, ContentID: contentID})
+}
+
 func (s *SubscriptionWatcher) getTimeWindow(requestTime, start, end time.Time) (time.Time, time.Time) {
 	if start.Equal(end) {
 		end = requestTime
 	}
 
 	delta := end.Sub(start)
-	lookbehindDelta := time.Duration(s.config.LookBehindMinutes) * time.Minute
+	lookbehindDelta := time.Duration(s.Config().LookBehindMinutes) * time.Minute
 
 	switch {
 	case start.IsZero(), start.After(end), delta < lookbehindDelta:
@@ -361,6 +1080,50 @@ type ResourceContent struct {
 	ContentType *schema.ContentType
 	RequestTime time.Time
 	Content     Content
+
+	created    time.Time
+	expiration time.Time
+	window     *contentWindow
+	mark       *mark
+}
+
+// complete marks the content as handled within its window.
+func (r ResourceContent) complete() {
+	if r.window != nil {
+		r.window.complete(r.mark)
+	}
+}
+
+// fail marks the content as failed within its window.
+func (r ResourceContent) fail() {
+	if r.window != nil {
+		r.window.fail()
+	}
+}
+
+// sortContent parses the creation and expiration time of the provided content
+// and returns them sorted by creation time.
+// Content with an invalid creation time is logged and dropped.
+// Content with an invalid expiration time is considered
+// to expire after the retention period of the API.
+func sortContent(logger Logger, content []Content) []ResourceContent {
+	var result []ResourceContent
+	for _, c := range content {
+		created, err := time.ParseInLocation(CreatedDatetimeFormat, c.ContentCreated, time.Local)
+		if err != nil {
+			logger.Errorf("could not parse ContentCreated: %s", err)
+			continue
+		}
+		expiration, err := time.ParseInLocation(CreatedDatetimeFormat, c.ContentExpiration, time.Local)
+		if err != nil {
+			expiration = created.Add(intervalOneWeek)
+		}
+		result = append(result, ResourceContent{Content: c, created: created, expiration: expiration})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].created.Before(result[j].created)
+	})
+	return result
 }
 
 // ResourceAudits .
@@ -368,4 +1131,24 @@ type ResourceAudits struct {
 	ContentType *schema.ContentType
 	RequestTime time.Time
 	AuditRecord interface{}
+
+	ack func()
+}
+
+// Ack acknowledges that the record has been durably handled.
+// ResourceHandler implementations must call it once for each record they receive,
+// as the watcher only advances its checkpoints once every record
+// of a content blob has been acknowledged.
+func (r ResourceAudits) Ack() {
+	if r.ack != nil {
+		r.ack()
+	}
+}
+
+// WithAck returns a copy of the record acknowledged using the provided function.
+// It is used by handlers passing records on to another handler,
+// such as a handler buffering records.
+func (r ResourceAudits) WithAck(ack func()) ResourceAudits {
+	r.ack = ack
+	return r
 }
@@ -0,0 +1,574 @@
+package office365
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devodev/go-office365/v0/pkg/office365/schema"
+)
+
+func stubWatcher(t *testing.T, client *Client, conf SubscriptionWatcherConfig) *SubscriptionWatcher {
+	t.Helper()
+	if conf.LookBehindMinutes == 0 {
+		conf.LookBehindMinutes = 1
+	}
+	if conf.TickerIntervalSeconds == 0 {
+		conf.TickerIntervalSeconds = 1
+	}
+	watcher, err := NewSubscriptionWatcher(client, conf, NewMemoryState(), nil, nil)
+	if err != nil {
+		t.Fatalf("error occurred creating watcher: %v", err)
+	}
+	return watcher
+}
+
+func TestWatcherContentTypes(t *testing.T) {
+	cases := []struct {
+		Include []schema.ContentType
+		Exclude []schema.ContentType
+		Want    []schema.ContentType
+	}{
+		{
+			Want: []schema.ContentType{
+				schema.AuditAzureActiveDirectory,
+				schema.AuditExchange,
+				schema.AuditSharePoint,
+				schema.AuditGeneral,
+				schema.DLPAll,
+			},
+		},
+		{
+			Include: []schema.ContentType{schema.DLPAll},
+			Want:    []schema.ContentType{schema.DLPAll},
+		},
+		{
+			Exclude: []schema.ContentType{schema.DLPAll, schema.AuditGeneral},
+			Want: []schema.ContentType{
+				schema.AuditAzureActiveDirectory,
+				schema.AuditExchange,
+				schema.AuditSharePoint,
+			},
+		},
+		{
+			Include: []schema.ContentType{schema.DLPAll, schema.AuditExchange, schema.DLPAll},
+			Exclude: []schema.ContentType{schema.AuditExchange},
+			Want:    []schema.ContentType{schema.DLPAll},
+		},
+		{
+			Include: []schema.ContentType{schema.DLPAll},
+			Exclude: []schema.ContentType{schema.DLPAll},
+			Want:    nil,
+		},
+	}
+
+	for idx, c := range cases {
+		t.Run(fmt.Sprintf("%d.", idx+1), func(t *testing.T) {
+			conf := SubscriptionWatcherConfig{
+				IncludeContentTypes: c.Include,
+				ExcludeContentTypes: c.Exclude,
+			}
+			testDeep(t, conf.ContentTypes(), c.Want)
+		})
+	}
+}
+
+func TestWatcherEnsureSubscriptions(t *testing.T) {
+
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	var mu sync.Mutex
+	var started []string
+
+	url := client.getURL("subscriptions/start", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		EnforceMethod(t, r, "POST")
+		contentType := EnforceAndReturnContentType(t, r)
+
+		mu.Lock()
+		started = append(started, contentType)
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(&Subscription{
+			ContentType: &contentType,
+			Status:      String(string(SubscriptionStatusEnabled)),
+		})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{
+		IncludeContentTypes: []schema.ContentType{
+			schema.AuditExchange,
+			schema.AuditSharePoint,
+			schema.DLPAll,
+		},
+		EnsureSubscriptions: true,
+	})
+
+	subscriptions := []Subscription{
+		{ContentType: String(schema.AuditExchange.String()), Status: String(string(SubscriptionStatusEnabled))},
+		{ContentType: String(schema.AuditSharePoint.String()), Status: String(string(SubscriptionStatusDisabled))},
+		{ContentType: String(schema.AuditGeneral.String()), Status: String(string(SubscriptionStatusDisabled))},
+	}
+	got := watcher.ensureSubscriptions(context.Background(), subscriptions)
+
+	testDeep(t, started, []string{schema.AuditSharePoint.String(), schema.DLPAll.String()})
+
+	want := []Subscription{
+		{ContentType: String(schema.AuditExchange.String()), Status: String(string(SubscriptionStatusEnabled))},
+		{ContentType: String(schema.AuditSharePoint.String()), Status: String(string(SubscriptionStatusEnabled))},
+		{ContentType: String(schema.AuditGeneral.String()), Status: String(string(SubscriptionStatusDisabled))},
+		{ContentType: String(schema.DLPAll.String()), Status: String(string(SubscriptionStatusEnabled))},
+	}
+	testDeep(t, got, want)
+}
+
+func stubContentPipeline(t *testing.T, mux *http.ServeMux, client *Client, content []Content, audits map[string][]interface{}) {
+	t.Helper()
+
+	url := client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		EnforceMethod(t, r, "GET")
+		json.NewEncoder(w).Encode(content)
+	})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		EnforceMethod(t, r, "GET")
+		contentID := r.URL.Path[len(url.Path):]
+		json.NewEncoder(w).Encode(audits[contentID])
+	})
+}
+
+func TestWatcherCheckpointAfterAck(t *testing.T) {
+
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+	content := []Content{
+		{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Add(time.Second).Format(CreatedDatetimeFormat)},
+		{ContentType: ct.String(), ContentID: "def", ContentCreated: created.Format(CreatedDatetimeFormat)},
+	}
+	audits := map[string][]interface{}{
+		"abc": {schema.AuditRecord{ID: String("1"), RecordType: &tp}},
+		"def": {schema.AuditRecord{ID: String("2"), RecordType: &tp}, schema.AuditRecord{ID: String("3"), RecordType: &tp}},
+	}
+	stubContentPipeline(t, mux, client, content, audits)
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	done := make(chan struct{})
+	defer close(done)
+
+	res := ResourceSubscription{ContentType: &ct, RequestTime: now}
+	auditCh := watcher.fetchAudits(context.Background(), done, ct, watcher.fetchContent(context.Background(), done, res))
+
+	var received []ResourceAudits
+	for i := 0; i < 3; i++ {
+		received = append(received, <-auditCh)
+	}
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.IsZero() {
+		t.Fatalf("lastRequestTime moved before records were acknowledged: %v", got)
+	}
+
+	// content is handled in order of creation
+	if got := *received[0].AuditRecord.(schema.AuditRecord).ID; got != "2" {
+		t.Fatalf("got record %v first but want 2", got)
+	}
+	received[0].Ack()
+	if got := checkpoint(t, watcher.LastContentCreated, ct); !got.IsZero() {
+		t.Errorf("lastContentCreated moved before content was fully acknowledged: %v", got)
+	}
+	received[1].Ack()
+	if got := checkpoint(t, watcher.LastContentCreated, ct); !got.Equal(created) {
+		t.Errorf("got lastContentCreated %v but want %v", got, created)
+	}
+	received[2].Ack()
+
+	if _, ok := <-auditCh; ok {
+		t.Fatalf("got more records than expected")
+	}
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v but want %v", got, now)
+	}
+	if got, want := checkpoint(t, watcher.LastContentCreated, ct), created.Add(time.Second); !got.Equal(want) {
+		t.Errorf("got lastContentCreated %v but want %v", got, want)
+	}
+}
+
+func TestWatcherFetchConcurrency(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	ids := []string{"a", "b", "c", "d"}
+	var content []Content
+	for idx, id := range ids {
+		content = append(content, Content{ContentType: ct.String(), ContentID: id, ContentCreated: created.Add(time.Duration(idx) * time.Second).Format(CreatedDatetimeFormat)})
+	}
+	url := client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(content)
+	})
+
+	// the first content is only returned once every content is being fetched
+	var requested sync.WaitGroup
+	requested.Add(len(ids))
+	allRequested := make(chan struct{})
+	go func() {
+		requested.Wait()
+		close(allRequested)
+	}()
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		contentID := r.URL.Path[len(url.Path):]
+		requested.Done()
+		if contentID == ids[0] {
+			select {
+			case <-allRequested:
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode([]schema.AuditRecord{
+			{ID: String(contentID + "1"), RecordType: &tp},
+			{ID: String(contentID + "2"), RecordType: &tp},
+		})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{
+		ContentTypeFetchConcurrency: map[schema.ContentType]int{ct: len(ids)},
+	})
+	done := make(chan struct{})
+	defer close(done)
+
+	res := ResourceSubscription{ContentType: &ct, RequestTime: now}
+	auditCh := watcher.fetchAudits(context.Background(), done, ct, watcher.fetchContent(context.Background(), done, res))
+
+	var got []string
+	for r := range auditCh {
+		got = append(got, *r.AuditRecord.(schema.AuditRecord).ID)
+		r.Ack()
+	}
+
+	// records of a content blob are sent together, in the order content was created
+	testDeep(t, got, []string{"a1", "a2", "b1", "b2", "c1", "c2", "d1", "d2"})
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.Equal(now) {
+		t.Errorf("got lastRequestTime %v but want %v", got, now)
+	}
+	if got, want := checkpoint(t, watcher.LastContentCreated, ct), created.Add(3*time.Second); !got.Equal(want) {
+		t.Errorf("got lastContentCreated %v but want %v", got, want)
+	}
+}
+
+func TestWatcherContentDedup(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditSharePoint
+	now := time.Now()
+	created := now.Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.SharePointFileOperationType
+	// content sharing a creation time must all be fetched
+	content := []Content{
+		{ContentType: ct.String(), ContentID: "abc", ContentCreated: created.Format(CreatedDatetimeFormat)},
+		{ContentType: ct.String(), ContentID: "def", ContentCreated: created.Format(CreatedDatetimeFormat)},
+	}
+	audits := map[string][]interface{}{
+		"abc": {schema.AuditRecord{ID: String("1"), RecordType: &tp}},
+		"def": {schema.AuditRecord{ID: String("2"), RecordType: &tp}},
+	}
+	stubContentPipeline(t, mux, client, content, audits)
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{})
+	done := make(chan struct{})
+	defer close(done)
+
+	run := func(requestTime time.Time) []string {
+		res := ResourceSubscription{ContentType: &ct, RequestTime: requestTime}
+		auditCh := watcher.fetchAudits(context.Background(), done, ct, watcher.fetchContent(context.Background(), done, res))
+
+		var ids []string
+		for r := range auditCh {
+			ids = append(ids, *r.AuditRecord.(schema.AuditRecord).ID)
+			r.Ack()
+		}
+		return ids
+	}
+
+	if got := run(now); len(got) != 2 {
+		t.Fatalf("got records %v but want 2 records", got)
+	}
+	for _, id := range []string{"abc", "def"} {
+		if ok, _ := watcher.ContentProcessed(context.Background(), ct, id); !ok {
+			t.Errorf("content %s not recorded as processed", id)
+		}
+	}
+
+	// an overlapping window lists the same content again
+	if got := run(now.Add(time.Second)); len(got) != 0 {
+		t.Errorf("got records %v again from an overlapping window", got)
+	}
+}
+
+// checkpoint returns the checkpoint of ct using get, failing the test on error.
+func checkpoint(t *testing.T, get func(context.Context, schema.ContentType) (time.Time, error), ct schema.ContentType) time.Time {
+	t.Helper()
+
+	got, err := get(context.Background(), ct)
+	if err != nil {
+		t.Fatalf("could not get checkpoint: %s", err)
+	}
+	return got
+}
+
+// ackHandler implements the ResourceHandler interface.
+// It acknowledges and records the ID of every record it receives.
+type ackHandler struct {
+	ids []string
+}
+
+func (h *ackHandler) Handle(in <-chan ResourceAudits) error {
+	for r := range in {
+		h.ids = append(h.ids, *r.AuditRecord.(schema.AuditRecord).ID)
+		r.Ack()
+	}
+	return nil
+}
+
+func TestWatcherShutdown(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	created := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Content{
+			{ContentType: ct.String(), ContentID: "a", ContentCreated: created.Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "b", ContentCreated: created.Add(time.Second).Format(CreatedDatetimeFormat)},
+		})
+	})
+
+	// the first content is only returned once shutdown started
+	requested := make(chan string, 2)
+	release := make(chan struct{})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		contentID := r.URL.Path[len(url.Path):]
+		requested <- contentID
+		<-release
+		json.NewEncoder(w).Encode([]schema.AuditRecord{{ID: String(contentID + "1"), RecordType: &tp}})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{
+		IncludeContentTypes:    []schema.ContentType{ct},
+		ShutdownTimeoutSeconds: 5,
+	})
+	handler := &ackHandler{}
+	watcher.Handler = handler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error)
+	go func() {
+		runErr <- watcher.Run(ctx)
+	}()
+
+	if got := <-requested; got != "a" {
+		t.Fatalf("got content %s requested first but want a", got)
+	}
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop once in-flight content was handled")
+	}
+
+	// the in-flight content is handled, the rest of the window is left for the next start
+	testDeep(t, handler.ids, []string{"a1"})
+	select {
+	case got := <-requested:
+		t.Errorf("got content %s requested after shutdown started", got)
+	default:
+	}
+	if ok, _ := watcher.ContentProcessed(context.Background(), ct, "a"); !ok {
+		t.Errorf("content a not recorded as processed")
+	}
+	if got := checkpoint(t, watcher.LastContentCreated, ct); !got.Equal(created) {
+		t.Errorf("got lastContentCreated %v but want %v", got, created)
+	}
+	if got := checkpoint(t, watcher.LastRequestTime, ct); !got.IsZero() {
+		t.Errorf("got lastRequestTime %v but want it unchanged", got)
+	}
+}
+
+func TestWatcherShutdownBlockedContent(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	ct := schema.AuditExchange
+	created := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	tp := schema.ExchangeAdminType
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(ct.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	// with a fetch concurrency of 1, the listing of content is blocked
+	// sending the third content once shutdown starts
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Content{
+			{ContentType: ct.String(), ContentID: "a", ContentCreated: created.Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "b", ContentCreated: created.Add(time.Second).Format(CreatedDatetimeFormat)},
+			{ContentType: ct.String(), ContentID: "c", ContentCreated: created.Add(2 * time.Second).Format(CreatedDatetimeFormat)},
+		})
+	})
+	requested := make(chan string, 3)
+	release := make(chan struct{})
+	url = client.getURL("audit/", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		contentID := r.URL.Path[len(url.Path):]
+		requested <- contentID
+		<-release
+		json.NewEncoder(w).Encode([]schema.AuditRecord{{ID: String(contentID + "1"), RecordType: &tp}})
+	})
+
+	watcher := stubWatcher(t, client, SubscriptionWatcherConfig{
+		IncludeContentTypes:    []schema.ContentType{ct},
+		ShutdownTimeoutSeconds: 5,
+	})
+	handler := &ackHandler{}
+	watcher.Handler = handler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error)
+	go func() {
+		runErr <- watcher.Run(ctx)
+	}()
+
+	if got := <-requested; got != "a" {
+		t.Fatalf("got content %s requested first but want a", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	// the watcher stops once the in-flight content is handled,
+	// without waiting for the shutdown timeout
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watcher waited for the shutdown timeout")
+	}
+	testDeep(t, handler.ids, []string{"a1"})
+	if got := checkpoint(t, watcher.LastContentCreated, ct); !got.Equal(created) {
+		t.Errorf("got lastContentCreated %v but want %v", got, created)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	client, mux, teardown := stubClient()
+	defer teardown()
+
+	url := client.getURL("subscriptions/list", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]Subscription{
+			{ContentType: String(schema.AuditExchange.String()), Status: String(string(SubscriptionStatusEnabled))},
+			{ContentType: String(schema.AuditSharePoint.String()), Status: String(string(SubscriptionStatusEnabled))},
+		})
+	})
+	listed := make(chan string, 100)
+	url = client.getURL("subscriptions/content", nil)
+	mux.HandleFunc(url.Path, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case listed <- r.URL.Query().Get("contentType"):
+		default:
+		}
+		json.NewEncoder(w).Encode([]Content{})
+	})
+
+	conf := SubscriptionWatcherConfig{IncludeContentTypes: []schema.ContentType{schema.AuditExchange}}
+	watcher := stubWatcher(t, client, conf)
+	watcher.Handler = &ackHandler{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error)
+	go func() {
+		runErr <- watcher.Run(ctx)
+	}()
+
+	waitListed := func(ct schema.ContentType) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-listed:
+				if got == ct.String() {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("content of %s not listed", ct.String())
+			}
+		}
+	}
+	waitListed(schema.AuditExchange)
+
+	conf = watcher.Config()
+	invalid := conf
+	invalid.LookBehindMinutes = 0
+	if err := watcher.Reload(client, invalid); err == nil {
+		t.Errorf("got no error reloading an invalid configuration")
+	}
+	conf.IncludeContentTypes = []schema.ContentType{schema.AuditExchange, schema.AuditSharePoint}
+	conf.ExcludeContentTypes = []schema.ContentType{schema.AuditExchange}
+	if err := watcher.Reload(client, conf); err != nil {
+		t.Fatal(err)
+	}
+	// a pipeline is started for the content type added to the selection
+	waitListed(schema.AuditSharePoint)
+
+	cancel()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+}